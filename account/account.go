@@ -2,8 +2,8 @@ package account
 
 import (
 	"github.com/qedus/nds"
+	"github.com/the-information/ori/audit"
 	"github.com/the-information/ori/errors"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 	"net/http"
@@ -21,8 +21,12 @@ var Entity = "APIAccount"
 
 var ErrConflict = errors.New(http.StatusConflict, "A competing change to the account has already been made")
 var ErrAccountExists = errors.New(http.StatusConflict, "An account with that email already exists")
-var ErrPasswordTooShort = errors.New(http.StatusBadRequest, "Password is too short")
 var ErrUnsaveableAccount = errors.New(http.StatusBadRequest, "This is a special account that cannot be saved")
+var ErrNotMarkedDeleted = errors.New(http.StatusConflict, "The account must be marked deleted before it is removed in batches")
+var ErrAccountDeleted = errors.New(http.StatusConflict, "The account has been marked deleted")
+
+// MaxRemovalBatchSize is the most descendants RemoveBatch deletes at once.
+const MaxRemovalBatchSize = 500
 
 // Account represents an account to access the API. It handles
 // all logic to do with authentication and password checking.
@@ -48,14 +52,62 @@ type Account struct {
 	// in conjunction with auth.Check.
 	Roles []string `json:"roles,omitempty"`
 
-	// SecurePassword is a bcrypt hash of the account's password.
+	// Verified is true once the owner of the account has confirmed that Email
+	// belongs to them. ChangeEmail resets it.
+	Verified bool `json:"verified"`
+
+	// VerifiedAt is the time at which Email was last confirmed.
+	VerifiedAt time.Time `json:"verifiedAt,omitempty"`
+
+	// SecurePassword is a hash of the account's password.
 	// Do not read or modify this variable yourself; use
 	// CheckPassword and SetPassword instead.
 	SecurePassword []byte `json:"-" datastore:",noindex"`
 
+	// PasswordScheme names the scheme SecurePassword was hashed with,
+	// such as BcryptScheme. It is empty for accounts saved before schemes
+	// were recorded, which use bcrypt.
+	PasswordScheme string `json:"-" datastore:",noindex"`
+
+	// TOTPEnabled is true once the account has set up two-factor authentication
+	// with EnrollTOTP and ConfirmTOTP.
+	TOTPEnabled bool `json:"totpEnabled"`
+
+	// TOTPSecret is the secret the account's authenticator app shares.
+	TOTPSecret []byte `json:"-" datastore:",noindex"`
+
+	// TOTPLastStep is the time step of the last TOTP code used, so codes can't be replayed.
+	TOTPLastStep int64 `json:"-" datastore:",noindex"`
+
+	// RecoveryCodes holds the SHA-256 hashes of the account's unused recovery codes,
+	// which stand in for a TOTP code when the authenticator app is lost.
+	RecoveryCodes []string `json:"-" datastore:",noindex"`
+
+	// Disabled is true if the account has been disabled with Disable. Disabled
+	// accounts can't log in, and auth.Middleware rejects their tokens and API keys.
+	Disabled bool `json:"disabled"`
+
+	// DisabledReason says why the account was disabled.
+	DisabledReason string `json:"disabledReason,omitempty" datastore:",noindex"`
+
+	// DisabledAt is the time at which the account was disabled.
+	DisabledAt time.Time `json:"disabledAt,omitempty"`
+
+	// DeletedAt is the time at which the account was marked deleted with MarkDeleted,
+	// to be removed a batch at a time with RemoveBatch.
+	DeletedAt time.Time `json:"deletedAt,omitempty"`
+
+	// Profile holds the app's own fields for the account, in the type registered with
+	// RegisterProfile. It is saved in the same entity as the account.
+	Profile interface{} `json:"profile,omitempty" datastore:"-"`
+
 	// We keep this to check to see if somebody's tried to mutate the
 	// Email field between saves.
 	originalEmail string
+
+	// profileProps holds the stored profile properties when no profile
+	// has been registered, so saving the account doesn't lose them.
+	profileProps []datastore.Property
 }
 
 const (
@@ -96,15 +148,21 @@ func (a *Account) IsZero() bool {
 		a.originalEmail == "")
 }
 
-// HasRole checks if account has role role.
-func (a *Account) HasRole(role string) bool {
+// HasRole checks if account has role role, either directly or because one of
+// its roles implies role according to the RoleGraph configured for ctx.
+func (a *Account) HasRole(ctx context.Context, role string) bool {
+	return roleGraph(ctx).Implies(a.Roles, role)
+}
 
-	for _, existingRole := range a.Roles {
-		if role == existingRole {
-			return true
-		}
+// EffectiveRoles returns every role the account has, directly or by implication
+// according to the RoleGraph configured for ctx.
+func (a *Account) EffectiveRoles(ctx context.Context) ([]string, error) {
+
+	if graph, err := GetRoleGraph(ctx); err != nil {
+		return nil, err
+	} else {
+		return graph.Expand(a.Roles), nil
 	}
-	return false
 
 }
 
@@ -118,6 +176,46 @@ func (a *Account) Nobody() bool {
 	return a.flag == nobody
 }
 
+// String returns the account's email address, which is "super@" for Super and "nobody@" for Nobody.
+func (a *Account) String() string {
+	return a.Email
+}
+
+// Disable marks the account as disabled for reason. Save the account afterwards.
+func (a *Account) Disable(reason string) {
+	a.Disabled = true
+	a.DisabledReason = reason
+	a.DisabledAt = time.Now()
+}
+
+// Enable undoes Disable. Save the account afterwards. It returns ErrAccountDeleted,
+// leaving the account disabled, if the account has been marked deleted.
+func (a *Account) Enable() error {
+
+	if a.Deleted() {
+		return ErrAccountDeleted
+	}
+
+	a.Disabled = false
+	a.DisabledReason = ""
+	a.DisabledAt = time.Time{}
+	return nil
+
+}
+
+// MarkDeleted marks the account deleted, so it can be removed with RemoveBatch. It also
+// disables the account, so it can't be used while its entities are being deleted.
+// Save the account afterwards.
+func (a *Account) MarkDeleted() {
+	a.Disable("deleted")
+	a.DeletedAt = time.Now()
+}
+
+// Deleted checks whether the account has been marked deleted with MarkDeleted.
+func (a *Account) Deleted() bool {
+	return !a.DeletedAt.IsZero()
+}
+
 // Key returns the account's datastore key.
 func (a *Account) Key(ctx context.Context) *datastore.Key {
 
@@ -129,22 +227,54 @@ func (a *Account) Key(ctx context.Context) *datastore.Key {
 
 }
 
-// CheckPassword securely compares account's SecurePassword with the bcrypt hash
-// of proposedPassword. See the documentation of bcrypt.CompareHashAndPassword
-// for more information.
+// CheckPassword securely compares proposedPassword with the account's SecurePassword,
+// returning ErrPasswordMismatch if they don't match.
 func (a *Account) CheckPassword(proposedPassword string) error {
-	return bcrypt.CompareHashAndPassword(a.SecurePassword, []byte(proposedPassword))
+	return comparePassword(a.PasswordScheme, a.SecurePassword, proposedPassword)
+}
+
+// NeedsRehash checks whether SecurePassword was hashed differently than the password
+// policy for ctx says passwords should be hashed now. If so, the password should be
+// passed to Rehash once it has been checked. auth.CheckLogin does this.
+func (a *Account) NeedsRehash(ctx context.Context) (bool, error) {
+
+	if policy, err := GetPasswordPolicy(ctx); err != nil {
+		return false, err
+	} else {
+		return policy.Hashing.outdated(a.PasswordScheme, a.SecurePassword), nil
+	}
+
+}
+
+// Rehash changes SecurePassword to a new hash of password, made as the password policy
+// for ctx describes, without checking password against the policy's other rules. Only
+// call it with the password CheckPassword has just accepted, and save the account afterwards.
+func (a *Account) Rehash(ctx context.Context, password string) (err error) {
+
+	policy, err := GetPasswordPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	a.PasswordScheme, a.SecurePassword, err = policy.Hashing.hash(password)
+	return err
+
 }
 
-// SetPassword changes SecurePassword to the bcrypt hash of plaintextPassword.
-// It returns an error if the password is insufficiently entropic.
-// See the documentation of bcrypt.GenerateFromPassword for more information.
-func (a *Account) SetPassword(plaintextPassword string) (err error) {
-	if len(plaintextPassword) < 6 {
-		return ErrPasswordTooShort
+// SetPassword changes SecurePassword to a hash of plaintextPassword, made as the
+// password policy for ctx describes. It returns a *PasswordPolicyError if the
+// password breaks the policy.
+func (a *Account) SetPassword(ctx context.Context, plaintextPassword string) error {
+
+	policy, err := GetPasswordPolicy(ctx)
+	if err != nil {
+		return err
+	} else if err := policy.Check(plaintextPassword); err != nil {
+		return err
 	}
-	a.SecurePassword, err = bcrypt.GenerateFromPassword([]byte(plaintextPassword), bcrypt.DefaultCost)
+
+	a.PasswordScheme, a.SecurePassword, err = policy.Hashing.hash(plaintextPassword)
 	return err
+
 }
 
 // New creates and returns a new blank account. It returns an error if an account
@@ -154,10 +284,38 @@ func New(ctx context.Context, email, password string) (*Account, error) {
 	account := new(Account)
 	account.Email = email
 	account.CreatedAt = time.Now()
-	if err := account.SetPassword(password); err != nil {
+	account.Profile = NewProfile()
+	if err := account.SetPassword(ctx, password); err != nil {
 		return nil, err
 	}
 
+	if err := create(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+
+}
+
+// NewWithoutPassword creates an account identified by email that has no password, so it
+// can't log in with one until it is given one with SetPassword or a password reset. It is
+// meant for accounts that log in through an external identity provider; see LinkIdentity.
+func NewWithoutPassword(ctx context.Context, email string) (*Account, error) {
+
+	account := new(Account)
+	account.Email = email
+	account.CreatedAt = time.Now()
+	account.Profile = NewProfile()
+
+	if err := create(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+
+}
+
+// create saves a new account, returning ErrAccountExists if there already is one with its email.
+func create(ctx context.Context, account *Account) error {
+
 	err := nds.RunInTransaction(ctx, func(txCtx context.Context) error {
 
 		dsKey := account.Key(txCtx)
@@ -173,12 +331,12 @@ func New(ctx context.Context, email, password string) (*Account, error) {
 	}, nil)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	account.flag = camethroughus
-	account.originalEmail = email
-	return account, nil
+	account.originalEmail = account.Email
+	return nil
 
 }
 
@@ -196,8 +354,11 @@ func Get(ctx context.Context, email string, account *Account) error {
 
 }
 
-// ChangeEmail changes the email address of an account from oldEmail to newEmail.
-// It performs this operation atomically.
+// ChangeEmail changes the email address of an account from oldEmail to newEmail,
+// and marks the account as unverified. Its organization memberships and linked
+// identities move with it, as does whatever other packages move with OnChangeEmail;
+// other entities stored under the account are left where they are. It performs
+// this operation atomically, recording it in the audit log.
 func ChangeEmail(ctx context.Context, oldEmail, newEmail string) error {
 
 	return nds.RunInTransaction(ctx, func(txCtx context.Context) error {
@@ -228,9 +389,14 @@ func ChangeEmail(ctx context.Context, oldEmail, newEmail string) error {
 			return ErrAccountExists
 		}
 
-		// at this point, we set FromAccount's email address to the new one
+		before := fromAccount
+
+		// at this point, we set FromAccount's email address to the new one,
+		// which nobody has confirmed yet
 		fromAccount.Email = newEmail
 		fromAccount.LastUpdatedAt = time.Now()
+		fromAccount.Verified = false
+		fromAccount.VerifiedAt = time.Time{}
 
 		s.Add(2)
 
@@ -252,19 +418,125 @@ func ChangeEmail(ctx context.Context, oldEmail, newEmail string) error {
 			return errFrom
 		} else if errTo != nil {
 			return errTo
+		} else if err := moveDescendants(txCtx, fromAccountKey, toAccountKey); err != nil {
+			return err
 		}
 
-		return nil
+		emailChangeFuncs.RLock()
+		defer emailChangeFuncs.RUnlock()
+		for _, f := range emailChangeFuncs.fs {
+			if err := f(txCtx, oldEmail, newEmail); err != nil {
+				return err
+			}
+		}
+
+		if changes, err := diff(&before, &fromAccount); err != nil {
+			return err
+		} else {
+			return audit.Write(txCtx, audit.AccountChangeEmail, oldEmail, changes)
+		}
 
 	}, xgTransaction)
 
 }
 
+// An EmailChangeFunc updates whatever a package keeps about the account at oldEmail when
+// ChangeEmail gives it the address newEmail. It runs inside ChangeEmail's transaction, so
+// returning an error undoes the whole change.
+type EmailChangeFunc func(ctx context.Context, oldEmail, newEmail string) error
+
+var emailChangeFuncs struct {
+	sync.RWMutex
+	fs []EmailChangeFunc
+}
+
+// OnChangeEmail registers f to be called by every ChangeEmail. Register it in an init
+// function, before any email address is changed.
+func OnChangeEmail(f EmailChangeFunc) {
+
+	emailChangeFuncs.Lock()
+	emailChangeFuncs.fs = append(emailChangeFuncs.fs, f)
+	emailChangeFuncs.Unlock()
+
+}
+
+// moveDescendants moves the account package's own entities stored under the account at
+// from, its organization memberships and linked identities, to the account at to, and sets
+// Membership.Email to the new address. Other packages move theirs with OnChangeEmail.
+func moveDescendants(ctx context.Context, from, to *datastore.Key) error {
+
+	var memberships []Membership
+	var identities []Identity
+
+	membershipKeys, err := datastore.NewQuery(MembershipEntity).Ancestor(from).GetAll(ctx, &memberships)
+	if err != nil {
+		return err
+	}
+
+	identityKeys, err := datastore.NewQuery(IdentityEntity).Ancestor(from).GetAll(ctx, &identities)
+	if err != nil {
+		return err
+	}
+
+	for i := range memberships {
+		memberships[i].Email = to.StringID()
+	}
+
+	if err := moveEntities(ctx, from, to, membershipKeys, memberships); err != nil {
+		return err
+	}
+	return moveEntities(ctx, from, to, identityKeys, identities)
+
+}
+
+// moveEntities saves entities, a slice of the entities stored at keys under from, at the
+// same keys under to, and deletes them from under from.
+func moveEntities(ctx context.Context, from, to *datastore.Key, keys []*datastore.Key, entities interface{}) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	newKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		newKeys[i] = rekey(ctx, key, from, to)
+	}
+
+	if _, err := nds.PutMulti(ctx, newKeys, entities); err != nil {
+		return err
+	}
+	return nds.DeleteMulti(ctx, keys)
+
+}
+
+// rekey returns key with its ancestor from replaced by to.
+func rekey(ctx context.Context, key, from, to *datastore.Key) *datastore.Key {
+
+	if key.Equal(from) {
+		return to
+	}
+	return datastore.NewKey(ctx, key.Kind(), key.StringID(), key.IntID(), rekey(ctx, key.Parent(), from, to))
+
+}
+
 // Save saves the account pointed to by account to the datastore. It modifies
 // account.LastUpdatedAt for convenience. It returns an error if the account cannot
 // be saved because it was not obtained through the API methods, or if the state of the
-// account in the datastore has changed in the interim.
+// account in the datastore has changed in the interim. The changes are recorded in the
+// audit log.
 func Save(ctx context.Context, account *Account) error {
+	return save(ctx, account, audit.AccountSave)
+}
+
+// SaveLogin is like Save, but for the bookkeeping done while logging in to account, such as
+// rehashing its password or using up a TOTP code. It records the changes in the audit log as
+// audit.AccountLogin instead of audit.AccountSave, so they can be told apart from changes
+// someone made to the account.
+func SaveLogin(ctx context.Context, account *Account) error {
+	return save(ctx, account, audit.AccountLogin)
+}
+
+func save(ctx context.Context, account *Account, action string) error {
 
 	if account.flag != camethroughus || account.Email != account.originalEmail {
 		return ErrUnsaveableAccount
@@ -272,17 +544,27 @@ func Save(ctx context.Context, account *Account) error {
 
 	return nds.RunInTransaction(ctx, func(txCtx context.Context) error {
 
+		before := &Account{}
 		if hasChanged, err := HasChanged(txCtx, account); err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		} else if hasChanged {
 			return ErrConflict
+		} else if err := nds.Get(txCtx, account.Key(txCtx), before); err == datastore.ErrNoSuchEntity {
+			before = nil
+		} else if err != nil {
+			return err
 		}
 
 		account.LastUpdatedAt = time.Now()
-		_, err := nds.Put(ctx, account.Key(ctx), account)
-		return err
+		if _, err := nds.Put(txCtx, account.Key(txCtx), account); err != nil {
+			return err
+		} else if changes, err := diff(before, account); err != nil {
+			return err
+		} else {
+			return audit.Write(txCtx, action, account.Email, changes)
+		}
 
-	}, nil)
+	}, xgTransaction)
 
 }
 
@@ -302,7 +584,9 @@ func HasChanged(ctx context.Context, account *Account) (bool, error) {
 }
 
 // Remove safely deletes an account and all its associated information in the datastore. This includes
-// any objects that are descendants of the Account (i.e., a cascading delete).
+// any objects that are descendants of the Account (i.e., a cascading delete). The removal
+// is recorded in the audit log. Everything is deleted in one transaction, so accounts with
+// more descendants than that allows must be removed with MarkDeleted and RemoveBatch instead.
 func Remove(ctx context.Context, account *Account) error {
 
 	return datastore.RunInTransaction(ctx, func(txCtx context.Context) error {
@@ -324,8 +608,97 @@ func Remove(ctx context.Context, account *Account) error {
 		}
 
 		keys = append(keys, acctKey)
-		return nds.DeleteMulti(txCtx, keys)
+		if err := nds.DeleteMulti(txCtx, keys); err != nil {
+			return err
+		} else if changes, err := diff(account, nil); err != nil {
+			return err
+		} else {
+			return audit.Write(txCtx, audit.AccountRemove, account.Email, changes)
+		}
 
-	}, nil)
+	}, xgTransaction)
+
+}
+
+// RemovalProgress reports on a call to RemoveBatch.
+type RemovalProgress struct {
+	// Email is the email address of the account being removed.
+	Email string `json:"email"`
+	// Deleted is the number of the account's descendants the batch deleted.
+	Deleted int `json:"deleted"`
+	// Done is true once the account itself has been deleted, and removal is complete.
+	Done bool `json:"done"`
+}
+
+// RemoveBatch deletes up to size of the descendants of account, which must have been
+// marked deleted with MarkDeleted and saved. Once there are none left, it removes the
+// account itself with Remove. Call it until the returned progress is Done; since each
+// batch starts afresh from whatever is left, removal can be resumed at any point.
+func RemoveBatch(ctx context.Context, account *Account, size int) (*RemovalProgress, error) {
+
+	if !account.Deleted() {
+		return nil, ErrNotMarkedDeleted
+	} else if size <= 0 || size > MaxRemovalBatchSize {
+		size = MaxRemovalBatchSize
+	}
+
+	acctKey := account.Key(ctx)
+	progress := &RemovalProgress{Email: account.Email}
+
+	// the ancestor query finds the account too, so ask for one more
+	found, err := datastore.NewQuery("").
+		Ancestor(acctKey).
+		KeysOnly().
+		Limit(size + 1).
+		GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, 0, len(found))
+	for _, key := range found {
+		if !key.Equal(acctKey) && len(keys) < size {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		if err := Remove(ctx, account); err != nil {
+			return nil, err
+		}
+		progress.Done = true
+	} else if err := nds.DeleteMulti(ctx, keys); err != nil {
+		return nil, err
+	} else {
+		progress.Deleted = len(keys)
+	}
+
+	return progress, nil
+
+}
+
+// auditRedacted lists the account's properties whose values are kept out of the audit log.
+var auditRedacted = []string{"SecurePassword", "TOTPSecret", "RecoveryCodes"}
+
+// diff lists the differences between two versions of an account for the audit log.
+// A nil version is one that doesn't exist.
+func diff(before, after *Account) ([]audit.Change, error) {
+
+	var beforeProps, afterProps []datastore.Property
+	var err error
+
+	if before != nil {
+		if beforeProps, err = before.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	if after != nil {
+		if afterProps, err = after.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return audit.Diff(beforeProps, afterProps, auditRedacted...), nil
 
 }
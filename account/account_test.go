@@ -2,11 +2,13 @@ package account
 
 import (
 	"github.com/qedus/nds"
+	"github.com/the-information/ori/internal"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -64,16 +66,58 @@ func TestHasRole(t *testing.T) {
 		Roles: []string{"foo", "bar"},
 	}
 
-	if !account.HasRole("foo") {
+	if !account.HasRole(ctx, "foo") {
 		t.Errorf("Expected account to have role foo, but it didn't")
 	}
-	if account.HasRole("baz") {
+	if account.HasRole(ctx, "baz") {
 		t.Errorf("Expected account not to have role baz, but it did")
 
 	}
 
 }
 
+func TestRoleGraph(t *testing.T) {
+
+	graph := `{"admin":["editor"],"editor":["viewer"],"viewer":["admin"]}`
+	if _, err := ParseRoleGraph(graph); err != nil {
+		t.Fatalf("Unexpected error %s parsing role graph", err)
+	}
+
+	graphCtx := context.WithValue(ctx, internal.ConfigContextKey, &datastore.PropertyList{{Name: "RoleGraph", Value: graph}})
+	account := Account{
+		Roles: []string{"editor"},
+	}
+
+	if !account.HasRole(graphCtx, "viewer") {
+		t.Errorf("Expected editor to imply viewer, but it didn't")
+	}
+	if !account.HasRole(graphCtx, "admin") {
+		t.Errorf("Expected the cycle back to admin to be followed, but it wasn't")
+	}
+	if roles, err := account.EffectiveRoles(graphCtx); err != nil || len(roles) != 3 || roles[0] != "editor" {
+		t.Errorf("Unexpected effective roles %v, error %v", roles, err)
+	}
+
+	if _, err := ParseRoleGraph("INVALIDJSON"); err == nil {
+		t.Errorf("Should have gotten an error parsing an invalid role graph")
+	}
+
+	// an invalid graph doesn't stop accounts being retrieved, and only roles held directly count
+	badCtx := context.WithValue(ctx, internal.ConfigContextKey, &datastore.PropertyList{{Name: "RoleGraph", Value: "INVALIDJSON"}})
+	New(ctx, "graph@bar.com", "foobar")
+	if err := Get(badCtx, "graph@bar.com", &account); err != nil {
+		t.Errorf("Unexpected error %s getting account with an invalid role graph", err)
+	}
+	account.Roles = []string{"editor"}
+	if !account.HasRole(badCtx, "editor") || account.HasRole(badCtx, "viewer") {
+		t.Errorf("Expected only the editor role with an invalid role graph")
+	}
+	if _, err := account.EffectiveRoles(badCtx); err == nil {
+		t.Errorf("Expected an error getting effective roles with an invalid role graph")
+	}
+
+}
+
 func TestKey(t *testing.T) {
 
 	account := Account{
@@ -104,7 +148,7 @@ func TestCheckPassword(t *testing.T) {
 func TestSetPassword(t *testing.T) {
 
 	account := Account{}
-	account.SetPassword("foobar")
+	account.SetPassword(ctx, "foobar")
 
 	if err := account.CheckPassword("foobar"); err != nil {
 		t.Errorf("Got unexpected CheckPassword failure %s", err)
@@ -115,6 +159,27 @@ func TestSetPassword(t *testing.T) {
 
 }
 
+func TestDisable(t *testing.T) {
+
+	account := Account{}
+	account.Disable("spam")
+
+	if !account.Disabled || account.DisabledReason != "spam" || account.DisabledAt.IsZero() {
+		t.Errorf("Expected account to be disabled for spam, but got %+v", account)
+	}
+
+	account.Enable()
+	if account.Disabled || account.DisabledReason != "" || !account.DisabledAt.IsZero() {
+		t.Errorf("Expected account to be enabled again, but got %+v", account)
+	}
+
+	account.MarkDeleted()
+	if err := account.Enable(); err != ErrAccountDeleted || !account.Disabled {
+		t.Errorf("Expected a deleted account to stay disabled, but got %+v, error %v", account, err)
+	}
+
+}
+
 func TestNewAndGet(t *testing.T) {
 
 	// New
@@ -163,10 +228,22 @@ func TestChangeEmail(t *testing.T) {
 	if err := ChangeEmail(ctx, "quux@bar.com", "foo@bar.com"); err != ErrAccountExists {
 		t.Errorf("Expected to get ErrAccountExists when changing emails, but got %s", err)
 	}
+	var quux Account
+	Get(ctx, "quux@bar.com", &quux)
+	quux.Verified = true
+	Save(ctx, &quux)
+
 	if err := ChangeEmail(ctx, "quux@bar.com", "baz@bar.com"); err != nil {
 		t.Errorf("Got unexpected error %s while trying to change quux@bar.com to baz@bar.com", err)
 	}
 
+	var baz Account
+	if err := Get(ctx, "baz@bar.com", &baz); err != nil {
+		t.Errorf("Got unexpected error %s getting baz@bar.com", err)
+	} else if baz.Verified {
+		t.Errorf("Expected the new address not to be verified")
+	}
+
 	// try to change an account that doesn't exist
 	if err := ChangeEmail(ctx, "quux@bar.com", "wat@bar.com"); err != datastore.ErrNoSuchEntity {
 		t.Errorf("Expected to get datastore.ErrNoSuchEntity when changing emails, but got %s", err)
@@ -180,7 +257,7 @@ func TestSave(t *testing.T) {
 	var naiveAccount = Account{
 		Email: "foo@bar.com",
 	}
-	naiveAccount.SetPassword("foobar")
+	naiveAccount.SetPassword(ctx, "foobar")
 	if err := Save(ctx, &naiveAccount); err != ErrUnsaveableAccount {
 		t.Errorf("Expected to get ErrUnsaveableAccount when saving a naive account, but got %s", err)
 	}
@@ -239,3 +316,149 @@ func TestRemove(t *testing.T) {
 	}
 
 }
+
+func TestRemoveBatch(t *testing.T) {
+
+	var acct Account
+
+	New(ctx, "batched@bar.com", "foobar")
+	if err := Get(ctx, "batched@bar.com", &acct); err != nil {
+		t.Fatalf("Unexpected error %s on get", err)
+	}
+
+	keys := make([]*datastore.Key, 5)
+	widgets := make([]widget, 5)
+	for i := range keys {
+		keys[i] = datastore.NewKey(ctx, "Widget", "", int64(i+1), acct.Key(ctx))
+		widgets[i] = widget{Cost: float64(i)}
+	}
+	if _, err := nds.PutMulti(ctx, keys, widgets); err != nil {
+		t.Fatalf("Unexpected error %s on PutMulti", err)
+	}
+
+	if _, err := RemoveBatch(ctx, &acct, 2); err != ErrNotMarkedDeleted {
+		t.Errorf("Expected ErrNotMarkedDeleted before the account was marked deleted, got %v", err)
+	}
+
+	acct.MarkDeleted()
+	if err := Save(ctx, &acct); err != nil {
+		t.Fatalf("Unexpected error %s on Save", err)
+	} else if !acct.Deleted() || !acct.Disabled {
+		t.Errorf("Expected the account to be marked deleted and disabled, got %+v", acct)
+	}
+
+	deleted := []int{}
+	for i := 0; i < 10; i++ {
+		if progress, err := RemoveBatch(ctx, &acct, 2); err != nil {
+			t.Fatalf("Unexpected error %s on RemoveBatch", err)
+		} else if progress.Done {
+			break
+		} else {
+			deleted = append(deleted, progress.Deleted)
+		}
+	}
+
+	if !reflect.DeepEqual(deleted, []int{2, 2, 1}) {
+		t.Errorf("Expected batches of 2, 2 and 1 widgets, got %v", deleted)
+	}
+
+	if err := Get(ctx, "batched@bar.com", &Account{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected the account to be gone, got %v", err)
+	}
+
+}
+
+func TestOrgs(t *testing.T) {
+
+	var org Organization
+	var membership Membership
+
+	if _, err := NewOrg(ctx, "acme", "Acme Inc."); err != nil {
+		t.Fatalf("Unexpected error creating organization: %s", err)
+	} else if _, err := NewOrg(ctx, "acme", "Acme Again"); err != ErrOrgExists {
+		t.Errorf("Expected ErrOrgExists creating a duplicate organization, got %v", err)
+	} else if err := GetOrg(ctx, "acme", &org); err != nil || org.ID != "acme" || org.Name != "Acme Inc." {
+		t.Errorf("Unexpected organization %+v, error %v", org, err)
+	}
+
+	New(ctx, "orgmember@bar.com", "foobar")
+	if _, err := SetMembership(ctx, "acme", "orgmember@bar.com", []string{"admin"}); err != nil {
+		t.Fatalf("Unexpected error adding member: %s", err)
+	} else if _, err := SetMembership(ctx, "nope", "orgmember@bar.com", nil); err != ErrNoSuchOrg {
+		t.Errorf("Expected ErrNoSuchOrg joining a missing organization, got %v", err)
+	}
+
+	// memberships follow the account to its new email address
+	if err := ChangeEmail(ctx, "orgmember@bar.com", "orgmember2@bar.com"); err != nil {
+		t.Fatalf("Unexpected error changing email: %s", err)
+	} else if err := GetMembership(ctx, "acme", "orgmember@bar.com", &membership); err != ErrNotMember {
+		t.Errorf("Expected the old address to have no membership, got %v", err)
+	} else if err := GetMembership(ctx, "acme", "orgmember2@bar.com", &membership); err != nil {
+		t.Errorf("Unexpected error getting membership: %s", err)
+	} else if membership.Email != "orgmember2@bar.com" || len(membership.Roles) != 1 || membership.Roles[0] != "admin" {
+		t.Errorf("Unexpected membership %+v", membership)
+	}
+
+	if memberships, err := Memberships(ctx, "orgmember2@bar.com"); err != nil || len(memberships) != 1 {
+		t.Errorf("Expected 1 membership, got %+v, error %v", memberships, err)
+	}
+
+	if err := RemoveMembership(ctx, "acme", "orgmember2@bar.com"); err != nil {
+		t.Errorf("Unexpected error removing member: %s", err)
+	} else if err := GetMembership(ctx, "acme", "orgmember2@bar.com", &membership); err != ErrNotMember {
+		t.Errorf("Expected ErrNotMember after removing member, got %v", err)
+	}
+
+	if err := RemoveOrg(ctx, "acme"); err != nil {
+		t.Errorf("Unexpected error removing organization: %s", err)
+	} else if err := GetOrg(ctx, "acme", &org); err != ErrNoSuchOrg {
+		t.Errorf("Expected ErrNoSuchOrg after removing organization, got %v", err)
+	}
+
+	// a membership left behind by a removed organization doesn't carry over to a new
+	// one with the same ID
+	NewOrg(ctx, "globex", "Globex")
+	SetMembership(ctx, "globex", "orgmember2@bar.com", []string{"admin"})
+	nds.Delete(ctx, OrgKey(ctx, "globex"))
+	NewOrg(ctx, "globex", "Globex Again")
+	if err := GetMembership(ctx, "globex", "orgmember2@bar.com", &membership); err != ErrNotMember {
+		t.Errorf("Expected ErrNotMember for a membership of the old organization, got %v", err)
+	} else if memberships, err := Memberships(ctx, "orgmember2@bar.com"); err != nil || len(memberships) != 0 {
+		t.Errorf("Expected no memberships, got %+v, error %v", memberships, err)
+	}
+
+}
+
+func TestIdentities(t *testing.T) {
+
+	if _, err := NewWithoutPassword(ctx, "federated@bar.com"); err != nil {
+		t.Fatalf("Unexpected error creating account: %s", err)
+	}
+
+	var acct Account
+	if err := Get(ctx, "federated@bar.com", &acct); err != nil {
+		t.Fatalf("Unexpected error getting account: %s", err)
+	} else if err := acct.CheckPassword(""); err == nil {
+		t.Errorf("An account without a password shouldn't accept an empty one")
+	}
+
+	if err := LinkIdentity(ctx, "federated@bar.com", "https://login.acme.com", "user-1"); err != nil {
+		t.Fatalf("Unexpected error linking identity: %s", err)
+	} else if err := LinkIdentity(ctx, "nobody@bar.com", "https://login.acme.com", "user-2"); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected datastore.ErrNoSuchEntity linking an identity to a missing account, got %v", err)
+	}
+
+	// identities follow the account to its new email address
+	if err := ChangeEmail(ctx, "federated@bar.com", "federated2@bar.com"); err != nil {
+		t.Fatalf("Unexpected error changing email: %s", err)
+	} else if identities, err := Identities(ctx, "federated2@bar.com"); err != nil || len(identities) != 1 || identities[0].Subject != "user-1" {
+		t.Errorf("Expected the identity to have moved, got %+v, error %v", identities, err)
+	}
+
+	if err := UnlinkIdentity(ctx, "federated2@bar.com", "https://login.acme.com", "user-1"); err != nil {
+		t.Errorf("Unexpected error unlinking identity: %s", err)
+	} else if identities, err := Identities(ctx, "federated2@bar.com"); err != nil || len(identities) != 0 {
+		t.Errorf("Expected no identities after unlinking, got %+v, error %v", identities, err)
+	}
+
+}
@@ -0,0 +1,346 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/qedus/nds"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/internal"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIKeyEntity is the name of the Datastore entity used to store API keys. Keys are
+// stored as descendants of their account's key, so Remove deletes them along with
+// the account.
+const APIKeyEntity = "APIKey"
+
+// APIKeyIndexEntity is the name of the Datastore entity used to record which account
+// each API key belongs to, so LookupAPIKey can get a key from its ID alone. Entries are
+// keyed by key ID under a single parent, so that account.ChangeEmail can update all of
+// an account's entries in its transaction. Entries left behind by removed accounts point
+// at keys that are gone, so LookupAPIKey rejects them all the same.
+const APIKeyIndexEntity = "APIKeyIndex"
+
+// APIKeyHeader is the header auth.Middleware reads API keys from. Keys are
+// also accepted in the Authorization header as "Key <key>".
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyClaim is the private claim holding the ID of the API key a request was
+// authorized with.
+const APIKeyClaim = "apikey"
+
+const apiKeyPrefix = "ori_"
+
+// keys and their index entries are in different entity groups
+var xgTransaction = &datastore.TransactionOptions{
+	XG: true,
+}
+
+var (
+	InvalidAPIKeyError = Error("Not a valid API key, or the key has been revoked")
+
+	ErrAPIKeyRole = errors.New(http.StatusBadRequest, "An API key can't carry a role its account doesn't have")
+)
+
+// APIKey is a long-lived credential for machine clients. It acts on behalf of the
+// account it belongs to, but only with the roles it carries. Only a hash of the
+// key itself is stored, so a lost key can't be recovered, only revoked.
+type APIKey struct {
+	// ID identifies the key. It is also the first part of the key itself,
+	// so it is safe to show to people but not secret.
+	ID string `json:"id" datastore:",noindex"`
+	// Owner is the email address of the account the key belongs to.
+	Owner string `json:"owner" datastore:"-"`
+	// Name is a label to help people tell their keys apart.
+	Name string `json:"name,omitempty" datastore:",noindex"`
+	// Roles is the scope of the key. The key passes auth.HasRole for a role
+	// only if both it and its account have that role.
+	Roles []string `json:"roles" datastore:",noindex"`
+	// Hash is the SHA-256 hash of the key.
+	Hash []byte `json:"-" datastore:",noindex"`
+	// CreatedAt is the time at which the key was created.
+	CreatedAt time.Time `json:"createdAt" datastore:",noindex"`
+}
+
+// apiKeyIndex is an entry in the index of API keys by ID.
+type apiKeyIndex struct {
+	// Owner is the email address of the account the key belongs to.
+	Owner string `datastore:",noindex"`
+}
+
+// NewAPIKey creates an API key owned by acct, carrying roles, and saves it to the
+// datastore. It returns the stored APIKey along with the key itself, which is
+// never available again.
+func NewAPIKey(ctx context.Context, acct *account.Account, name string, roles []string) (*APIKey, string, error) {
+
+	for _, role := range roles {
+		if !acct.HasRole(ctx, role) {
+			return nil, "", ErrAPIKeyRole
+		}
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", err
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+
+	if roles == nil {
+		roles = []string{}
+	}
+
+	apiKey := &APIKey{
+		ID:        hex.EncodeToString(idBytes),
+		Owner:     acct.Email,
+		Name:      name,
+		Roles:     roles,
+		CreatedAt: time.Now(),
+	}
+
+	plaintext := apiKeyPrefix + apiKey.ID + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+	hash := sha256.Sum256([]byte(plaintext))
+	apiKey.Hash = hash[:]
+
+	err := nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		if _, err := nds.Put(txCtx, apiKeyKey(txCtx, acct.Email, apiKey.ID), apiKey); err != nil {
+			return err
+		}
+		_, err := nds.Put(txCtx, apiKeyIndexKey(txCtx, apiKey.ID), &apiKeyIndex{Owner: acct.Email})
+		return err
+
+	}, xgTransaction)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return apiKey, plaintext, nil
+
+}
+
+func apiKeyKey(ctx context.Context, email, id string) *datastore.Key {
+	return datastore.NewKey(ctx, APIKeyEntity, id, 0, datastore.NewKey(ctx, account.Entity, email, 0, nil))
+}
+
+func apiKeyIndexKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, APIKeyIndexEntity, id, 0, datastore.NewKey(ctx, APIKeyIndexEntity, "root", 0, nil))
+}
+
+// GetAPIKey retrieves the API key with ID id belonging to the account with email address
+// email and stores it in apiKey.
+func GetAPIKey(ctx context.Context, email, id string, apiKey *APIKey) error {
+
+	if err := nds.Get(ctx, apiKeyKey(ctx, email, id), apiKey); err != nil {
+		return err
+	}
+
+	apiKey.ID = id
+	apiKey.Owner = email
+	return nil
+
+}
+
+// ListAPIKeys returns every API key owned by the account with email address email.
+func ListAPIKeys(ctx context.Context, email string) ([]APIKey, error) {
+
+	apiKeys := []APIKey{}
+	keys, err := datastore.NewQuery(APIKeyEntity).
+		Ancestor(datastore.NewKey(ctx, account.Entity, email, 0, nil)).
+		GetAll(ctx, &apiKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		apiKeys[i].ID = key.StringID()
+		apiKeys[i].Owner = email
+	}
+
+	return apiKeys, nil
+
+}
+
+// RevokeAPIKey deletes the API key with ID id belonging to the account with email address
+// email, so auth.Middleware will no longer accept it.
+func RevokeAPIKey(ctx context.Context, email, id string) error {
+
+	return nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		// only drop the index entry if it is this key's, so a wrong email can't break someone else's key
+		var index apiKeyIndex
+		if err := nds.Get(txCtx, apiKeyIndexKey(txCtx, id), &index); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		} else if err == nil && index.Owner == email {
+			if err := nds.Delete(txCtx, apiKeyIndexKey(txCtx, id)); err != nil {
+				return err
+			}
+		}
+
+		return nds.Delete(txCtx, apiKeyKey(txCtx, email, id))
+
+	}, xgTransaction)
+
+}
+
+// moveAPIKeys moves the API keys of the account at oldEmail to newEmail, along with
+// their index entries, for account.ChangeEmail.
+func moveAPIKeys(ctx context.Context, oldEmail, newEmail string) error {
+
+	var apiKeys []APIKey
+	keys, err := datastore.NewQuery(APIKeyEntity).
+		Ancestor(datastore.NewKey(ctx, account.Entity, oldEmail, 0, nil)).
+		GetAll(ctx, &apiKeys)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	newKeys := make([]*datastore.Key, len(keys))
+	indexKeys := make([]*datastore.Key, len(keys))
+	entries := make([]apiKeyIndex, len(keys))
+	for i, key := range keys {
+		newKeys[i] = apiKeyKey(ctx, newEmail, key.StringID())
+		indexKeys[i] = apiKeyIndexKey(ctx, key.StringID())
+		entries[i].Owner = newEmail
+	}
+
+	if _, err := nds.PutMulti(ctx, newKeys, apiKeys); err != nil {
+		return err
+	} else if _, err := nds.PutMulti(ctx, indexKeys, entries); err != nil {
+		return err
+	}
+	return nds.DeleteMulti(ctx, keys)
+
+}
+
+// LookupAPIKey finds the stored APIKey for the key plaintext. It returns
+// InvalidAPIKeyError if there is no such key, or it has been revoked.
+func LookupAPIKey(ctx context.Context, plaintext string) (*APIKey, error) {
+
+	var apiKey APIKey
+
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) {
+		return nil, InvalidAPIKeyError
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(plaintext, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, InvalidAPIKeyError
+	}
+
+	var index apiKeyIndex
+	if err := nds.Get(ctx, apiKeyIndexKey(ctx, parts[0]), &index); err == datastore.ErrNoSuchEntity {
+		return nil, InvalidAPIKeyError
+	} else if err != nil {
+		return nil, err
+	} else if err := GetAPIKey(ctx, index.Owner, parts[0], &apiKey); err == datastore.ErrNoSuchEntity {
+		return nil, InvalidAPIKeyError
+	} else if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+	if !hmac.Equal(hash[:], apiKey.Hash) {
+		return nil, InvalidAPIKeyError
+	}
+
+	return &apiKey, nil
+
+}
+
+// ClaimSet returns the claim set that stands in for a JWT when a request is
+// authorized with apiKey, so AuthChecks can treat both the same way.
+func (apiKey *APIKey) ClaimSet() *jws.ClaimSet {
+
+	return &jws.ClaimSet{
+		Sub:           apiKey.Owner,
+		Scope:         strings.Join(apiKey.Roles, ","),
+		Iat:           apiKey.CreatedAt.Unix(),
+		Exp:           time.Now().AddDate(10, 0, 0).Unix(),
+		PrivateClaims: map[string]interface{}{APIKeyClaim: apiKey.ID},
+	}
+
+}
+
+// apiKeyFromRequest returns the API key presented with r, or the empty string.
+func apiKeyFromRequest(r *http.Request) string {
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	} else if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Key ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Key "))
+	} else {
+		return ""
+	}
+
+}
+
+// apiKeyContext sets up ctx for a request authorized with the API key plaintext,
+// as Middleware does for JWTs.
+func apiKeyContext(ctx context.Context, plaintext string) (context.Context, error) {
+
+	var acct account.Account
+
+	apiKey, err := LookupAPIKey(ctx, plaintext)
+	if err != nil {
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, err)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, err)
+		return context.WithValue(ctx, internal.AuthContextKey, err), nil
+	}
+
+	if err := account.Get(ctx, apiKey.Owner, &acct); err != nil {
+		return nil, err
+	} else if acct.Deleted() {
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, DeletedAccountError)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, DeletedAccountError)
+		return context.WithValue(ctx, internal.AuthContextKey, DeletedAccountError), nil
+	} else if acct.Disabled {
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, DisabledAccountError)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, DisabledAccountError)
+		return context.WithValue(ctx, internal.AuthContextKey, DisabledAccountError), nil
+	}
+
+	claimSet := apiKey.ClaimSet()
+	if revoked, err := IsRevoked(ctx, claimSet); err != nil {
+		return nil, err
+	} else if revoked {
+		// every token the account had when its tokens were revoked goes, keys included
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, InvalidAPIKeyError)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, InvalidAPIKeyError)
+		return context.WithValue(ctx, internal.AuthContextKey, InvalidAPIKeyError), nil
+	}
+
+	// jws.ClaimSet doesn't marshal its private claims, so merge them in by hand
+	claims := map[string]interface{}{}
+	for k, v := range claimSet.PrivateClaims {
+		claims[k] = v
+	}
+	claims["sub"] = claimSet.Sub
+	claims["scope"] = claimSet.Scope
+	claims["iat"] = claimSet.Iat
+	claims["exp"] = claimSet.Exp
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, internal.ClaimsContextKey, payload)
+	ctx = context.WithValue(ctx, internal.ClaimSetContextKey, claimSet)
+	return context.WithValue(ctx, internal.AuthContextKey, &acct), nil
+
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/test"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKey(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	acct, _ := account.New(ctx, "foo@bar.com", "foobar")
+	acct.Roles = []string{"viewer", "editor"}
+	account.Save(ctx, acct)
+
+	if _, _, err := NewAPIKey(ctx, acct, "ci", []string{"admin"}); err != ErrAPIKeyRole {
+		t.Errorf("Expected ErrAPIKeyRole for a role the account lacks, but got %s", err)
+	}
+
+	apiKey, plaintext, err := NewAPIKey(ctx, acct, "ci", []string{"viewer"})
+	if err != nil {
+		t.Fatalf("Unexpected error %s from NewAPIKey", err)
+	}
+
+	if found, err := LookupAPIKey(ctx, plaintext); err != nil {
+		t.Errorf("Unexpected error %s from LookupAPIKey", err)
+	} else if found.ID != apiKey.ID || found.Owner != "foo@bar.com" {
+		t.Errorf("Unexpected API key %+v", found)
+	}
+
+	if _, err := LookupAPIKey(ctx, plaintext+"x"); err != InvalidAPIKeyError {
+		t.Errorf("Expected InvalidAPIKeyError for a wrong key, but got %s", err)
+	}
+	if _, err := LookupAPIKey(ctx, "wat"); err != InvalidAPIKeyError {
+		t.Errorf("Expected InvalidAPIKeyError for a malformed key, but got %s", err)
+	}
+
+	if apiKeys, err := ListAPIKeys(ctx, "foo@bar.com"); err != nil {
+		t.Errorf("Unexpected error %s from ListAPIKeys", err)
+	} else if len(apiKeys) != 1 || apiKeys[0].ID != apiKey.ID || apiKeys[0].Name != "ci" {
+		t.Errorf("Unexpected API keys %+v", apiKeys)
+	}
+
+	if err := RevokeAPIKey(ctx, "foo@bar.com", apiKey.ID); err != nil {
+		t.Errorf("Unexpected error %s from RevokeAPIKey", err)
+	} else if _, err := LookupAPIKey(ctx, plaintext); err != InvalidAPIKeyError {
+		t.Errorf("Expected InvalidAPIKeyError for a revoked key, but got %s", err)
+	}
+
+	// keys go with their account, to a new email address
+	apiKey, plaintext, _ = NewAPIKey(ctx, acct, "ci", []string{"viewer"})
+	if err := account.ChangeEmail(ctx, "foo@bar.com", "moved@bar.com"); err != nil {
+		t.Fatalf("Unexpected error %s changing email", err)
+	}
+
+	var moved APIKey
+	account.Get(ctx, "moved@bar.com", acct)
+	if err := GetAPIKey(ctx, "moved@bar.com", apiKey.ID, &moved); err != nil || moved.Owner != "moved@bar.com" {
+		t.Errorf("Expected the key to belong to moved@bar.com, got %+v, error %v", moved, err)
+	} else if err := GetAPIKey(ctx, "foo@bar.com", apiKey.ID, &moved); err == nil {
+		t.Errorf("Expected the key to be gone from foo@bar.com")
+	} else if found, err := LookupAPIKey(ctx, plaintext); err != nil || found.Owner != "moved@bar.com" {
+		t.Errorf("Expected to look the key up as moved@bar.com's, got %+v, error %v", found, err)
+	}
+
+	// revoking a key under the wrong account doesn't touch it
+	if err := RevokeAPIKey(ctx, "foo@bar.com", apiKey.ID); err != nil {
+		t.Errorf("Unexpected error %s from RevokeAPIKey", err)
+	} else if _, err := LookupAPIKey(ctx, plaintext); err != nil {
+		t.Errorf("Unexpected error %s looking up a key revoked under the wrong account", err)
+	}
+
+	// and are removed with it
+	if err := account.Remove(ctx, acct); err != nil {
+		t.Fatalf("Unexpected error %s removing account", err)
+	} else if _, err := LookupAPIKey(ctx, plaintext); err != InvalidAPIKeyError {
+		t.Errorf("Expected InvalidAPIKeyError for a key of a removed account, but got %s", err)
+	}
+
+}
+
+func TestMiddlewareAPIKey(t *testing.T) {
+
+	var acct account.Account
+	var claimSet jws.ClaimSet
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	owner, _ := account.New(ctx, "foo@bar.com", "foobar")
+	owner.Roles = []string{"viewer", "editor"}
+	account.Save(ctx, owner)
+	_, plaintext, _ := NewAPIKey(ctx, owner, "ci", []string{"viewer"})
+
+	ctx = test.WithConfig(ctx, map[string]interface{}{"AuthSecret": "foo"})
+
+	for _, header := range []string{APIKeyHeader, "Authorization"} {
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if header == "Authorization" {
+			r.Header.Set(header, "Key "+plaintext)
+		} else {
+			r.Header.Set(header, plaintext)
+		}
+
+		resultCtx := Middleware(ctx, w, r)
+		if err := GetAccount(resultCtx, &acct); err != nil {
+			t.Errorf("%s: unexpected error %s", header, err)
+		} else if acct.Email != "foo@bar.com" {
+			t.Errorf("%s: expected the key's owner, but got %+v", header, acct)
+		} else if err := GetClaimSet(resultCtx, &claimSet); err != nil || claimSet.Scope != "viewer" {
+			t.Errorf("%s: expected the key's scope, but got %+v, %s", header, claimSet, err)
+		}
+
+		// the key only carries the roles it was created with
+		if err := HasRole("viewer")(resultCtx, w, r); err != nil {
+			t.Errorf("%s: unexpected error %s checking viewer", header, err)
+		} else if err := HasRole("editor")(resultCtx, w, r); err != ErrRoleNotInScope {
+			t.Errorf("%s: expected ErrRoleNotInScope checking editor, but got %s", header, err)
+		}
+
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set(APIKeyHeader, "ori_nope_nope")
+	if err := GetAccount(Middleware(ctx, w, r), &acct); err != InvalidAPIKeyError {
+		t.Errorf("Expected InvalidAPIKeyError, but got %s", err)
+	}
+
+	// revoking every token of the account revokes its keys too
+	RevokeSubject(ctx, "foo@bar.com")
+	r.Header.Set(APIKeyHeader, plaintext)
+	if err := GetAccount(Middleware(ctx, w, r), &acct); err != InvalidAPIKeyError {
+		t.Errorf("Expected InvalidAPIKeyError after the account's tokens were revoked, but got %s", err)
+	}
+
+}
@@ -2,14 +2,27 @@ package auth
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/hmac"
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
 	"golang.org/x/oauth2/jws"
+	"math/big"
 	"time"
 )
 
+func init() {
+	// the entities package auth keeps under an account follow it to a new email address
+	account.OnChangeEmail(moveAPIKeys)
+	account.OnChangeEmail(moveLoginLockout)
+	account.OnChangeEmail(removeSessions)
+}
+
 // AllScope is the auth scope set when a token is valid for all
 // of a user's roles.
 var AllScope = "__ALL"
@@ -35,7 +48,15 @@ var (
 	InvalidJWTError       = Error("Not a valid JWT")
 	BadSignatureError     = Error("Signatures don't match")
 	InvalidHeaderError    = Error("Header isn't type JWT")
-	InvalidAlgorithmError = Error("Algorithm isn't HS256")
+	InvalidAlgorithmError = Error("Algorithm isn't HS256, RS256 or ES256")
+	UnknownKeyError       = Error("Key ID isn't in the key ring, or has been retired")
+	InvalidIssuerError    = Error("JWT wasn't issued by the expected issuer")
+	InvalidAudienceError  = Error("JWT isn't intended for this audience")
+	PrematureJWTError     = Error("JWT isn't valid yet")
+	FutureJWTError        = Error("JWT was issued in the future")
+	DisabledAccountError  = Error("The account has been disabled")
+	DeletedAccountError   = Error("The account has been deleted")
+	InvalidNonceError     = Error("JWT doesn't carry the expected nonce")
 
 	// SuperClaimSet is a special jws.ClaimSet returned when
 	// the JWT supplied to a Decode call is actually just the
@@ -59,10 +80,15 @@ var (
 // Encode converts claimSet into a JWT and signs it with HMAC-256
 // using secret.
 func Encode(claimSet *jws.ClaimSet, secret []byte) ([]byte, error) {
+	return encodeHS256(claimSet, secret, "")
+}
+
+func encodeHS256(claimSet *jws.ClaimSet, secret []byte, kid string) ([]byte, error) {
 
 	result, err := jws.EncodeWithSigner(&jws.Header{
 		Typ:       "JWT",
 		Algorithm: "HS256",
+		KeyID:     kid,
 	}, claimSet, func(data []byte) ([]byte, error) {
 
 		sig := make([]byte, 0, 32)
@@ -75,32 +101,279 @@ func Encode(claimSet *jws.ClaimSet, secret []byte) ([]byte, error) {
 	return []byte(result), err
 }
 
-// Decode checks jwt's signature against secret. If it matches
-// and jwt has not expired, Decode returns a jws.ClaimSet containing
-// jwt's claims.
+// Decode checks jwt's signature against secret, or, for RS256 and ES256 JWTs,
+// against publicKeys. If it matches, jwt has not expired, and jwt's nbf and iat
+// claims aren't in the future, Decode returns a jws.ClaimSet containing jwt's claims.
+// Use a Verifier to also check the iss and aud claims or to allow for clock skew.
 //
 // There are two special cases:
 //
 // - If jwt is equal to secret, SuperClaimSet is returned.
 //
 // - If jwt is the empty string, NobodyClaimSet is returned.
-func Decode(jwt []byte, secret []byte) (*jws.ClaimSet, error) {
+func Decode(jwt []byte, secret []byte, publicKeys ...crypto.PublicKey) (*jws.ClaimSet, error) {
+	v := Verifier{Secret: secret, PublicKeys: publicKeys}
+	return v.Decode(jwt)
+}
+
+// A Verifier holds everything needed to check the signature and registered
+// claims of a JWT.
+type Verifier struct {
+	// Secret is the auth secret. It verifies HS256 JWTs without a kid until it
+	// retires from KeyRing, and is also the token that identifies the Super account.
+	Secret []byte
+	// KeyRing, if not nil, verifies HS256 JWTs that carry a kid.
+	KeyRing *KeyRing
+	// PublicKeys verify RS256 and ES256 JWTs.
+	PublicKeys []crypto.PublicKey
+	// Issuer, if not empty, is the only iss claim accepted.
+	Issuer string
+	// Audience, if not empty, is the only aud claim accepted.
+	Audience string
+	// Leeway is how far the exp, nbf and iat claims may be off to allow for clock skew.
+	Leeway time.Duration
+}
+
+// NewVerifier returns a Verifier for the AuthSecret, AuthKeys, SigningKey, TokenIssuer,
+// TokenAudience and ClockSkew in conf.
+func NewVerifier(conf *config.Global) (*Verifier, error) {
+
+	v := &Verifier{
+		Secret:   []byte(conf.AuthSecret),
+		Issuer:   conf.TokenIssuer,
+		Audience: conf.TokenAudience,
+	}
+
+	if conf.ClockSkew != "" {
+		if d, err := time.ParseDuration(conf.ClockSkew); err != nil || d < 0 {
+			return nil, ErrBadTokenConfig
+		} else {
+			v.Leeway = d
+		}
+	}
+
+	if ring, err := ParseKeyRing(conf.AuthKeys); err != nil {
+		return nil, err
+	} else {
+		v.KeyRing = ring
+	}
+
+	if key, err := SigningKey(conf); err != nil {
+		return nil, err
+	} else if key != nil {
+		v.PublicKeys = append(v.PublicKeys, key.Public())
+	}
+
+	return v, nil
+
+}
+
+// Decode works like the package-level Decode, except that HS256 JWTs carrying a kid
+// are checked against the matching key in v.KeyRing.
+func (v *Verifier) Decode(jwt []byte) (*jws.ClaimSet, error) {
+
+	claims, special, err := v.decode(jwt)
+	if err != nil {
+		return nil, err
+	} else if special != nil {
+		return special, nil
+	}
+
+	return claims.claimSet()
 
-	var theirSignature [32]byte
-	var ourSignature [32]byte
+}
+
+// DecodeInto works like Decode, except that rather than building a jws.ClaimSet it
+// unmarshals the JWT's payload into claims, which should be a pointer to a struct
+// with a json tag for every claim the caller is interested in. This is much cheaper
+// than decoding the private claims into a map.
+//
+// If jwt is equal to secret or is the empty string, claims receives the registered
+// claims of SuperClaimSet or NobodyClaimSet respectively.
+func DecodeInto(jwt []byte, secret []byte, claims interface{}, publicKeys ...crypto.PublicKey) error {
+	v := Verifier{Secret: secret, PublicKeys: publicKeys}
+	return v.DecodeInto(jwt, claims)
+}
+
+// DecodeInto works like the package-level DecodeInto, except that HS256 JWTs carrying
+// a kid are checked against the matching key in v.KeyRing.
+func (v *Verifier) DecodeInto(jwt []byte, claims interface{}) error {
+
+	if decoded, _, err := v.decode(jwt); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(decoded.payload, claims)
+	}
+
+}
+
+// tokenClaims are the claims auth.Middleware and the AuthChecks work with. Decoding a
+// JWT straight into them spares building a map of its private claims on every request;
+// claimSet puts the full jws.ClaimSet together for the callers that need one.
+type tokenClaims struct {
+	Iss     string   `json:"iss"`
+	Sub     string   `json:"sub"`
+	Aud     audience `json:"aud"`
+	Scope   string   `json:"scope"`
+	Exp     int64    `json:"exp"`
+	Nbf     int64    `json:"nbf"`
+	Iat     int64    `json:"iat"`
+	JTI     string   `json:"jti"`
+	Session string   `json:"sid"`
+	Purpose *string  `json:"pur"`
+	Uses    *float64 `json:"u"`
+
+	// payload is the JSON the claims were decoded from
+	payload []byte
+}
+
+// claimsFromClaimSet gets the tokenClaims of claimSet, for claim sets that weren't
+// decoded from a JWT, like those of API keys. A u claim that isn't a number counts
+// as no uses at all.
+func claimsFromClaimSet(claimSet *jws.ClaimSet) *tokenClaims {
+
+	claims := &tokenClaims{
+		Iss:   claimSet.Iss,
+		Sub:   claimSet.Sub,
+		Scope: claimSet.Scope,
+		Exp:   claimSet.Exp,
+		Iat:   claimSet.Iat,
+	}
+
+	if claimSet.Aud != "" {
+		claims.Aud = audience{claimSet.Aud}
+	}
+
+	claims.JTI, _ = claimSet.PrivateClaims["jti"].(string)
+	claims.Session, _ = claimSet.PrivateClaims[SessionClaim].(string)
+
+	if purpose, ok := claimSet.PrivateClaims[PurposeClaim]; ok {
+		p, _ := purpose.(string)
+		claims.Purpose = &p
+	}
+
+	if u, ok := claimSet.PrivateClaims["u"]; ok {
+		var uses float64
+		switch n := u.(type) {
+		case float64:
+			uses = n
+		case int:
+			uses = float64(n)
+		case int64:
+			uses = float64(n)
+		}
+		claims.Uses = &uses
+	}
+
+	return claims
+
+}
+
+// claimSet builds the full jws.ClaimSet for the JWT c was decoded from. Since
+// jws.ClaimSet can only hold a single aud, an array of them is left in its
+// private claims.
+func (c *tokenClaims) claimSet() (*jws.ClaimSet, error) {
+
+	claimSet := &jws.ClaimSet{
+		Iss:           c.Iss,
+		Sub:           c.Sub,
+		Scope:         c.Scope,
+		Exp:           c.Exp,
+		Iat:           c.Iat,
+		PrivateClaims: map[string]interface{}{},
+	}
+
+	if err := json.Unmarshal(c.payload, &claimSet.PrivateClaims); err != nil {
+		return nil, err
+	}
+
+	if len(c.Aud) <= 1 {
+		if len(c.Aud) == 1 {
+			claimSet.Aud = c.Aud[0]
+		}
+		delete(claimSet.PrivateClaims, "aud")
+	}
+
+	delete(claimSet.PrivateClaims, "iss")
+	delete(claimSet.PrivateClaims, "sub")
+	delete(claimSet.PrivateClaims, "iat")
+	delete(claimSet.PrivateClaims, "exp")
+	delete(claimSet.PrivateClaims, "scope")
+
+	return claimSet, nil
+
+}
+
+// decode verifies jwt and decodes its claims. If jwt is one of the special cases
+// described in Decode, decode also returns the special claim set, and the claims
+// hold its registered claims.
+func (v *Verifier) decode(jwt []byte) (*tokenClaims, *jws.ClaimSet, error) {
+
+	payload, special, err := v.verify(jwt)
+	if err != nil {
+		return nil, nil, err
+	} else if special != nil {
+		if payload, err = json.Marshal(special); err != nil {
+			return nil, nil, err
+		}
+		claims := claimsFromClaimSet(special)
+		claims.payload = payload
+		return claims, special, nil
+	}
+
+	claims := &tokenClaims{payload: payload}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, nil, err
+	} else if err := v.validate(claims); err != nil {
+		return nil, nil, err
+	}
+
+	return claims, nil, nil
+
+}
+
+// validate checks the registered claims: the JWT must not have expired, must not be
+// used before its nbf or claim to have been issued in the future, and must carry the
+// expected iss, if v expects one, and list the expected aud among its audiences. The
+// time checks allow v.Leeway for clock skew.
+func (v *Verifier) validate(claims *tokenClaims) error {
+
+	now := time.Now()
+	leeway := int64(v.Leeway / time.Second)
+
+	if claims.Exp+leeway <= now.Unix() {
+		return ExpiredJWTError
+	} else if claims.Nbf != 0 && claims.Nbf-leeway > now.Unix() {
+		return PrematureJWTError
+	} else if claims.Iat-leeway > now.Unix() {
+		return FutureJWTError
+	} else if v.Issuer != "" && claims.Iss != v.Issuer {
+		return InvalidIssuerError
+	} else if v.Audience != "" && !claims.Aud.contains(v.Audience) {
+		return InvalidAudienceError
+	}
+
+	return nil
+
+}
+
+// verify checks the signature on jwt and returns its decoded JSON payload. If jwt is
+// one of the special cases described in Decode, verify returns the special claim set
+// instead of a payload.
+func (v *Verifier) verify(jwt []byte) ([]byte, *jws.ClaimSet, error) {
 
 	sepCount := bytes.Count(jwt, separator)
 
-	if sepCount == 0 && hmac.Equal(jwt, secret) {
+	if sepCount == 0 && hmac.Equal(jwt, v.Secret) {
 		// in the special case where the "JWT" is actually just the
 		// auth secret itself, the claim is authorized as the SuperClaimSet
-		return SuperClaimSet, nil
+		return nil, SuperClaimSet, nil
 	} else if len(jwt) == 0 {
 		// in the special case where the JWT is nothing, the claim is
 		// authorized as the NobodyClaimSet
-		return NobodyClaimSet, nil
+		return nil, NobodyClaimSet, nil
 	} else if sepCount != 2 {
-		return nil, InvalidJWTError
+		return nil, nil, InvalidJWTError
 	}
 
 	firstSeparatorIndex := bytes.Index(jwt, separator)
@@ -113,58 +386,91 @@ func Decode(jwt []byte, secret []byte) (*jws.ClaimSet, error) {
 	var decodedHeader jws.Header
 
 	if err := readHeader(header, &decodedHeader); err != nil {
-		return nil, err
-	} else if decodedHeader.Algorithm != "HS256" {
-		return nil, InvalidAlgorithmError
+		return nil, nil, err
+	} else if decodedHeader.Algorithm != "HS256" && decodedHeader.Algorithm != "RS256" && decodedHeader.Algorithm != "ES256" {
+		return nil, nil, InvalidAlgorithmError
 	} else if decodedHeader.Typ != "JWT" {
-		return nil, InvalidHeaderError
+		return nil, nil, InvalidHeaderError
 	}
 
-	_, err := base64.RawURLEncoding.Decode(theirSignature[0:], sig)
+	theirSignature, err := base64.RawURLEncoding.DecodeString(string(sig))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	mac := hmac.New(sha256.New, secret)
-	mac.Write(header)
-	mac.Write(separator)
-	mac.Write(payload)
-	mac.Sum(ourSignature[:0])
-
-	if !hmac.Equal(theirSignature[0:], ourSignature[0:]) {
-		return nil, BadSignatureError
+	secret := v.Secret
+	if decodedHeader.Algorithm == "HS256" && decodedHeader.KeyID != "" {
+		// the JWT was signed with a key from the key ring
+		if key := v.KeyRing.Find(decodedHeader.KeyID, time.Now()); key == nil || key.Secret == "" {
+			return nil, nil, UnknownKeyError
+		} else {
+			secret = []byte(key.Secret)
+		}
+	} else if decodedHeader.Algorithm == "HS256" && v.KeyRing != nil && len(v.KeyRing.Keys) > 0 && v.KeyRing.Find(LegacyKeyID, time.Now()) == nil {
+		// the JWT was signed with the auth secret, which has been rotated out and retired
+		return nil, nil, UnknownKeyError
 	}
 
-	// decode the claim set and ensure it hasn't expired
-	now := time.Now().Unix()
-	claimSet, err := jws.Decode(string(jwt))
-	if err != nil {
-		return nil, err
-	} else if claimSet.Exp <= now {
-		return nil, ExpiredJWTError
+	signed := jwt[0 : firstSeparatorIndex+1+secondSeparatorIndex]
+	if err := verifySignature(decodedHeader.Algorithm, signed, theirSignature, secret, v.PublicKeys); err != nil {
+		return nil, nil, err
 	}
+
 	payloadBytes, err := base64.RawURLEncoding.DecodeString(string(payload))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// TODO(goldibex): This operation is likely to be quite slow due to reflection
-	// Ideally, what we want is to accept an interface{} to decode the private claims
-	// of the JWT into for the client
-	claimSet.PrivateClaims = map[string]interface{}{}
-	err = json.Unmarshal(payloadBytes, &claimSet.PrivateClaims)
-	if err != nil {
-		return nil, err
+	return payloadBytes, nil, nil
+
+}
+
+// verifySignature checks sig against signed using the algorithm alg. HS256
+// signatures are checked against secret; RS256 and ES256 signatures are checked
+// against every public key of the right type until one of them matches.
+func verifySignature(alg string, signed, sig, secret []byte, publicKeys []crypto.PublicKey) error {
+
+	if alg == "HS256" {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return BadSignatureError
+		}
+		return nil
 	}
 
-	delete(claimSet.PrivateClaims, "iss")
-	delete(claimSet.PrivateClaims, "sub")
-	delete(claimSet.PrivateClaims, "iat")
-	delete(claimSet.PrivateClaims, "exp")
-	delete(claimSet.PrivateClaims, "aud")
-	delete(claimSet.PrivateClaims, "scope")
+	hashed := sha256.Sum256(signed)
+	haveKey := false
+
+	for _, publicKey := range publicKeys {
+
+		switch t := publicKey.(type) {
+		case *rsa.PublicKey:
+			if alg != "RS256" {
+				continue
+			}
+			haveKey = true
+			if rsa.VerifyPKCS1v15(t, crypto.SHA256, hashed[:], sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if alg != "ES256" {
+				continue
+			}
+			haveKey = true
+			if len(sig) == 64 && ecdsa.Verify(t, hashed[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return nil
+			}
+		}
 
-	return claimSet, nil
+	}
+
+	if !haveKey {
+		// we weren't given any key that could have produced this signature
+		return InvalidAlgorithmError
+	}
+
+	return BadSignatureError
 
 }
 
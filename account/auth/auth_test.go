@@ -136,3 +136,124 @@ func TestEncode(t *testing.T) {
 	}
 
 }
+
+func TestDecodeInto(t *testing.T) {
+
+	var claims struct {
+		Sub    string `json:"sub"`
+		UserID int64  `json:"u"`
+	}
+
+	claimSet := &jws.ClaimSet{
+		Sub:           "foo@bar.com",
+		Exp:           time.Now().Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"u": 42},
+	}
+
+	if jwt, err := Encode(claimSet, secret); err != nil {
+		t.Errorf("Expected no error from Encode, but got %s", err)
+	} else if err := DecodeInto(jwt, secret, &claims); err != nil {
+		t.Errorf("Expected no error from DecodeInto, but got %s", err)
+	} else if claims.Sub != "foo@bar.com" || claims.UserID != 42 {
+		t.Errorf("Bad claims from DecodeInto: %+v", claims)
+	}
+
+	jwt, _ := makeFakeJWT("", `{"exp": 0}`, "")
+	if err := DecodeInto(jwt, secret, &claims); err != ExpiredJWTError {
+		t.Errorf("Expected ExpiredJWTError, but got %s", err)
+	}
+
+	jwt, _ = makeFakeJWT("", "", "wrong")
+	if err := DecodeInto(jwt, secret, &claims); err != BadSignatureError {
+		t.Errorf("Expected BadSignatureError, but got %s", err)
+	}
+
+	if err := DecodeInto(secret, secret, &claims); err != nil {
+		t.Errorf("Expected no error from DecodeInto with the auth secret, but got %s", err)
+	} else if claims.Sub != SuperClaimSet.Sub {
+		t.Errorf("Expected the Super sub, but got %+v", claims)
+	}
+
+}
+
+func TestRegisteredClaims(t *testing.T) {
+
+	now := time.Now()
+	v := Verifier{Secret: secret, Issuer: "ori", Audience: "app", Leeway: time.Minute}
+
+	cases := []struct {
+		name     string
+		claimSet jws.ClaimSet
+		err      error
+	}{
+		{"valid", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Unix(), Exp: now.Add(time.Hour).Unix()}, nil},
+		{"wrong issuer", jws.ClaimSet{Iss: "other", Aud: "app", Iat: now.Unix(), Exp: now.Add(time.Hour).Unix()}, InvalidIssuerError},
+		{"wrong audience", jws.ClaimSet{Iss: "ori", Aud: "other", Iat: now.Unix(), Exp: now.Add(time.Hour).Unix()}, InvalidAudienceError},
+		{"expired within leeway", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Add(-time.Hour).Unix(), Exp: now.Add(-30 * time.Second).Unix()}, nil},
+		{"expired", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Add(-time.Hour).Unix(), Exp: now.Add(-2 * time.Minute).Unix()}, ExpiredJWTError},
+		{"issued in the future within leeway", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Add(30 * time.Second).Unix(), Exp: now.Add(time.Hour).Unix()}, nil},
+		{"issued in the future", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Add(2 * time.Minute).Unix(), Exp: now.Add(time.Hour).Unix()}, FutureJWTError},
+		{"not yet valid within leeway", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Unix(), Exp: now.Add(time.Hour).Unix(), PrivateClaims: map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}}, nil},
+		{"not yet valid", jws.ClaimSet{Iss: "ori", Aud: "app", Iat: now.Unix(), Exp: now.Add(time.Hour).Unix(), PrivateClaims: map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}}, PrematureJWTError},
+	}
+
+	for _, c := range cases {
+		if jwt, err := Encode(&c.claimSet, secret); err != nil {
+			t.Errorf("%s: unexpected error %s from Encode", c.name, err)
+		} else if _, err := v.Decode(jwt); err != c.err {
+			t.Errorf("%s: expected %v from Decode, but got %v", c.name, c.err, err)
+		}
+	}
+
+	// aud may also be an array, which must include the expected audience
+	exp := now.Add(time.Hour).Unix()
+	jwt, _ := makeFakeJWT("", fmt.Sprintf(`{"iss":"ori","aud":["other","app"],"exp":%d}`, exp), "wat")
+	if claimSet, err := v.Decode(jwt); err != nil {
+		t.Errorf("Unexpected error %s decoding JWT with an array aud", err)
+	} else if claimSet.Aud != "" || claimSet.PrivateClaims["aud"] == nil {
+		t.Errorf("Expected the array aud to be left in the private claims, got %+v", claimSet)
+	}
+
+	jwt, _ = makeFakeJWT("", fmt.Sprintf(`{"iss":"ori","aud":["other"],"exp":%d}`, exp), "wat")
+	if _, err := v.Decode(jwt); err != InvalidAudienceError {
+		t.Errorf("Expected InvalidAudienceError for an array aud without the audience, but got %v", err)
+	}
+
+	// without an expected issuer or audience, any will do
+	jwt, _ = Encode(&jws.ClaimSet{Iss: "other", Aud: "other", Exp: now.Add(time.Hour).Unix()}, secret)
+	if _, err := Decode(jwt, secret); err != nil {
+		t.Errorf("Unexpected error %s decoding JWT without expected issuer or audience", err)
+	}
+
+}
+
+func Test_decode(t *testing.T) {
+
+	v := Verifier{Secret: secret}
+	claimSet := &jws.ClaimSet{
+		Sub:           "foo@bar.com",
+		Scope:         "viewer",
+		Exp:           time.Now().Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"jti": "abc", SessionClaim: "abc", "u": 2, "admin": true},
+	}
+
+	jwt, _ := Encode(claimSet, secret)
+	if claims, special, err := v.decode(jwt); err != nil {
+		t.Fatalf("Unexpected error %s from decode", err)
+	} else if special != nil {
+		t.Errorf("Expected no special claim set, got %+v", special)
+	} else if claims.Sub != "foo@bar.com" || claims.Scope != "viewer" || claims.JTI != "abc" || claims.Session != "abc" || claims.Uses == nil || *claims.Uses != 2 || claims.Purpose != nil {
+		t.Errorf("Unexpected claims %+v", claims)
+	} else if full, err := claims.claimSet(); err != nil {
+		t.Errorf("Unexpected error %s building the claim set", err)
+	} else if full.Sub != "foo@bar.com" || full.PrivateClaims["admin"] != true || full.PrivateClaims["jti"] != "abc" {
+		t.Errorf("Unexpected claim set %+v", full)
+	} else if _, ok := full.PrivateClaims["sub"]; ok {
+		t.Errorf("Expected registered claims to be left out of the private claims, got %+v", full.PrivateClaims)
+	}
+
+	if claims, special, err := v.decode(secret); err != nil || special != SuperClaimSet || claims.Sub != SuperClaimSet.Sub {
+		t.Errorf("Expected the SuperClaimSet, got %+v, %+v, %v", claims, special, err)
+	}
+
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrChildTokenNotLoggedIn    = errors.New(http.StatusUnauthorized, "Only a logged-in account can mint a child token")
+	ErrChildTokenRole           = errors.New(http.StatusForbidden, "A child token can't carry a role its parent token doesn't have")
+	ErrChildTokenFromLimitedUse = errors.New(http.StatusForbidden, "A child token can't be minted from a limited-use token")
+	ErrChildTokenFromAPIKey     = errors.New(http.StatusForbidden, "A child token can't be minted from an API key")
+	ErrBadChildTokenRequest     = errors.New(http.StatusBadRequest, "The lifetime or number of uses requested for the child token is invalid")
+)
+
+// DefaultChildTokenLifetime is the lifetime of a child token when none is requested.
+// A child token never outlives its parent, whatever lifetime is requested.
+var DefaultChildTokenLifetime = time.Hour
+
+// ChildTokenClaims are the private claims a child token inherits from its parent. The
+// others, like the parent's amr, don't carry over. Applications that put claims of
+// their own in their tokens can add them here.
+var ChildTokenClaims = []string{SessionClaim}
+
+// ChildTokenRequest is the request body accepted by ChildTokenHandler.
+type ChildTokenRequest struct {
+	// Roles is the scope of the child token. Every role must be held by the account
+	// and in scope for the parent token. If it is empty, the child token has the
+	// parent token's scope.
+	Roles []string `json:"roles"`
+	// Lifetime is how long the child token remains valid, written in a form
+	// time.ParseDuration understands (e.g., "15m").
+	Lifetime string `json:"lifetime"`
+	// Uses, if greater than zero, is the number of times the child token can
+	// pass auth.HasRole before it is used up.
+	Uses int `json:"uses"`
+}
+
+// NewChildClaimSet builds the claim set for a child of the token parent, which identifies acct.
+// The child carries a subset of the parent's roles, resolved with the RoleGraph configured for
+// ctx, expires after lifetime or when the parent does, whichever comes first, and, if uses is
+// greater than zero, can only be used that many times.
+// It gets a jti of its own, so it can be revoked without revoking its parent, and of the
+// parent's private claims only inherits those in ChildTokenClaims. Children can't be minted
+// from API keys.
+func NewChildClaimSet(ctx context.Context, parent *jws.ClaimSet, acct *account.Account, roles []string, lifetime time.Duration, uses int) (*jws.ClaimSet, error) {
+
+	if acct.Super() || acct.Nobody() {
+		return nil, ErrChildTokenNotLoggedIn
+	} else if _, ok := parent.PrivateClaims["u"]; ok {
+		// otherwise a limited-use token could mint itself unlimited children
+		return nil, ErrChildTokenFromLimitedUse
+	} else if _, ok := parent.PrivateClaims[APIKeyClaim]; ok {
+		// API keys are meant for machines, which can be issued keys of their own
+		return nil, ErrChildTokenFromAPIKey
+	} else if lifetime <= 0 || uses < 0 {
+		return nil, ErrBadChildTokenRequest
+	}
+
+	scope := parent.Scope
+	if len(roles) > 0 {
+		graph, err := account.GetRoleGraph(ctx)
+		if err != nil {
+			return nil, err
+		}
+		parentScope := strings.Split(parent.Scope, ",")
+		for _, role := range roles {
+			if !graph.Implies(acct.Roles, role) || !scopeIncludes(graph, parentScope, role) {
+				return nil, ErrChildTokenRole
+			}
+		}
+		scope = strings.Join(roles, ",")
+	}
+
+	privateClaims := make(map[string]interface{}, len(ChildTokenClaims)+2)
+	for _, k := range ChildTokenClaims {
+		if v, ok := parent.PrivateClaims[k]; ok {
+			privateClaims[k] = v
+		}
+	}
+
+	if jti, err := NewJTI(); err != nil {
+		return nil, err
+	} else {
+		privateClaims["jti"] = jti
+	}
+
+	if uses > 0 {
+		privateClaims["u"] = uses
+	}
+
+	now := time.Now()
+	exp := now.Add(lifetime).Unix()
+	if exp > parent.Exp {
+		exp = parent.Exp
+	}
+
+	return &jws.ClaimSet{
+		Iss:           parent.Iss,
+		Aud:           parent.Aud,
+		Sub:           parent.Sub,
+		Scope:         scope,
+		Iat:           now.Unix(),
+		Exp:           exp,
+		PrivateClaims: privateClaims,
+	}, nil
+
+}
+
+// scopeIncludes checks whether role, or a role that implies it according to graph, is in scope.
+func scopeIncludes(graph account.RoleGraph, scope []string, role string) bool {
+
+	for _, s := range scope {
+		if s == AllScope {
+			return true
+		}
+	}
+
+	return graph.Implies(scope, role)
+
+}
+
+// IssueChild generates a signed child of the JWT that authorized ctx, as described in
+// NewChildClaimSet, using the application configuration in ctx.
+func IssueChild(ctx context.Context, roles []string, lifetime time.Duration, uses int) (*Token, error) {
+
+	var conf config.Global
+	var acct account.Account
+	var parent jws.ClaimSet
+
+	if err := config.Get(ctx, &conf); err != nil {
+		return nil, err
+	} else if err := GetAccount(ctx, &acct); err != nil {
+		return nil, err
+	} else if err := GetClaimSet(ctx, &parent); err != nil {
+		return nil, err
+	}
+
+	claimSet, err := NewChildClaimSet(ctx, &parent, &acct, roles, lifetime, uses)
+	if err != nil {
+		return nil, err
+	}
+
+	jwt, err := Sign(claimSet, &conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{Token: string(jwt), ExpiresAt: claimSet.Exp}, nil
+
+}
+
+// ChildTokenHandler is a kami.HandlerFunc that lets a logged-in account mint a child of
+// the token it authenticated with, for handing to third-party integrations or putting in
+// single-use links. It expects a JSON body shaped like ChildTokenRequest and responds
+// with a Token. Install it on whatever route you like:
+//	kami.Post("/tokens", auth.ChildTokenHandler)
+func ChildTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var req ChildTokenRequest
+	lifetime := DefaultChildTokenLifetime
+
+	if err := rest.ReadJSON(r, &req); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if req.Lifetime != "" {
+		if d, err := time.ParseDuration(req.Lifetime); err != nil {
+			rest.WriteJSON(w, ErrBadChildTokenRequest)
+			return
+		} else {
+			lifetime = d
+		}
+	}
+
+	if token, err := IssueChild(ctx, req.Roles, lifetime, req.Uses); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, token)
+	}
+
+}
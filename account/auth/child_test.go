@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewChildClaimSet(t *testing.T) {
+
+	defer func(claims []string) { ChildTokenClaims = claims }(ChildTokenClaims)
+	ChildTokenClaims = []string{SessionClaim, "n"}
+
+	ctx := test.WithConfig(context.Background(), map[string]interface{}{"RoleGraph": `{"admin":["viewer"]}`})
+	acct := account.Account{Email: "foo@bar.com", Roles: []string{"viewer", "editor"}}
+	parent := &jws.ClaimSet{
+		Iss:           "ori",
+		Sub:           "foo@bar.com",
+		Scope:         AllScope,
+		Exp:           time.Now().Add(2 * time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"jti": "parent", SessionClaim: "parent", AMRClaim: []string{AMRPassword}, "n": "Foo"},
+	}
+
+	child, err := NewChildClaimSet(ctx, parent, &acct, []string{"viewer"}, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error %s from NewChildClaimSet", err)
+	} else if child.Sub != "foo@bar.com" || child.Iss != "ori" || child.Scope != "viewer" {
+		t.Errorf("Unexpected child claim set %+v", child)
+	} else if child.PrivateClaims["jti"] == "parent" || child.PrivateClaims["u"] != 1 || child.PrivateClaims["n"] != "Foo" || child.PrivateClaims[SessionClaim] != "parent" {
+		t.Errorf("Unexpected child private claims %+v", child.PrivateClaims)
+	} else if _, ok := child.PrivateClaims[AMRClaim]; ok {
+		t.Errorf("Expected the child not to inherit its parent's amr, but got %+v", child.PrivateClaims)
+	} else if child.Exp >= parent.Exp {
+		t.Errorf("Expected the child to expire before its parent")
+	}
+
+	// a child never outlives its parent
+	if child, err := NewChildClaimSet(ctx, parent, &acct, nil, 24*time.Hour, 0); err != nil {
+		t.Errorf("Unexpected error %s from NewChildClaimSet", err)
+	} else if child.Exp != parent.Exp || child.Scope != AllScope {
+		t.Errorf("Expected the child to share its parent's expiry and scope, but got %+v", child)
+	} else if _, ok := child.PrivateClaims["u"]; ok {
+		t.Errorf("Expected the child to have unlimited uses, but got %+v", child.PrivateClaims)
+	}
+
+	// a child can't gain roles the account doesn't have...
+	if _, err := NewChildClaimSet(ctx, parent, &acct, []string{"admin"}, time.Hour, 0); err != ErrChildTokenRole {
+		t.Errorf("Expected ErrChildTokenRole for a role the account lacks, but got %s", err)
+	}
+
+	// ... or that aren't in its parent's scope
+	narrow := *parent
+	narrow.Scope = "viewer"
+	if _, err := NewChildClaimSet(ctx, &narrow, &acct, []string{"editor"}, time.Hour, 0); err != ErrChildTokenRole {
+		t.Errorf("Expected ErrChildTokenRole for a role out of scope, but got %s", err)
+	}
+
+	limited := *parent
+	limited.PrivateClaims = map[string]interface{}{"jti": "parent", "u": float64(1)}
+	if _, err := NewChildClaimSet(ctx, &limited, &acct, nil, time.Hour, 0); err != ErrChildTokenFromLimitedUse {
+		t.Errorf("Expected ErrChildTokenFromLimitedUse, but got %s", err)
+	}
+
+	key := (&APIKey{ID: "key", Owner: "foo@bar.com", Roles: []string{"viewer"}}).ClaimSet()
+	if _, err := NewChildClaimSet(ctx, key, &acct, nil, time.Hour, 0); err != ErrChildTokenFromAPIKey {
+		t.Errorf("Expected ErrChildTokenFromAPIKey, but got %s", err)
+	}
+
+	if _, err := NewChildClaimSet(ctx, parent, &acct, nil, time.Hour, -1); err != ErrBadChildTokenRequest {
+		t.Errorf("Expected ErrBadChildTokenRequest for negative uses, but got %s", err)
+	}
+
+	// roles implied by the parent's scope are fine
+	admin := account.Account{Email: "foo@bar.com", Roles: []string{"admin"}}
+	narrow.Scope = "admin"
+	if child, err := NewChildClaimSet(ctx, &narrow, &admin, []string{"viewer"}, time.Hour, 0); err != nil {
+		t.Errorf("Unexpected error %s for a role implied by the parent's scope", err)
+	} else if child.Scope != "viewer" {
+		t.Errorf("Expected the child to be scoped to viewer, but got %s", child.Scope)
+	}
+
+	if _, err := NewChildClaimSet(ctx, parent, &account.Nobody, nil, time.Hour, 0); err != ErrChildTokenNotLoggedIn {
+		t.Errorf("Expected ErrChildTokenNotLoggedIn for Nobody, but got %s", err)
+	}
+
+}
+
+func TestChildTokenHandler(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	acct := account.Account{Email: "foo@bar.com", Roles: []string{"viewer", "editor"}}
+	conf := config.Global{AuthSecret: "foo"}
+
+	var token Token
+	w := test.NewState().
+		Config(&conf).
+		Account(&acct).
+		Body(&ChildTokenRequest{Roles: []string{"viewer"}, Lifetime: "15m", Uses: 1}).
+		Run(ctx, ChildTokenHandler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http.StatusOK, got %d: error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("Unexpected error %s reading body of response", err)
+	}
+
+	if claimSet, err := Decode([]byte(token.Token), []byte("foo")); err != nil {
+		t.Errorf("Unexpected error %s decoding child token", err)
+	} else if claimSet.Scope != "viewer" || claimSet.PrivateClaims["u"] != float64(1) {
+		t.Errorf("Unexpected claim set %+v for child token", claimSet)
+	} else if claimSet.Exp > time.Now().Add(15*time.Minute).Unix() {
+		t.Errorf("Expected the child token to expire within 15 minutes")
+	}
+
+	w = test.NewState().
+		Config(&conf).
+		Body(&ChildTokenRequest{}).
+		Run(ctx, ChildTokenHandler)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized for Nobody, got %d", w.Code)
+	}
+
+	w = test.NewState().
+		Config(&conf).
+		Account(&acct).
+		Body(&ChildTokenRequest{Lifetime: "forever"}).
+		Run(ctx, ChildTokenHandler)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected http.StatusBadRequest for a bad lifetime, got %d", w.Code)
+	}
+
+}
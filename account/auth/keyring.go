@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/oauth2/jws"
+	"time"
+)
+
+// DefaultGracePeriod is how long a key that has been rotated out of the key ring
+// keeps verifying JWTs, when no other grace period is given to Rotate.
+var DefaultGracePeriod = 30 * 24 * time.Hour
+
+// LegacyKeyID is the ID of the entry the first Rotate adds to a KeyRing for
+// config.Global.AuthSecret, which signed every JWT before the ring existed. The
+// entry holds no secret; it only records when JWTs without a kid stop verifying.
+const LegacyKeyID = ""
+
+// Key is an HMAC-256 secret in a KeyRing.
+type Key struct {
+	// ID is the key's kid, which Encode stamps into the header of every JWT it signs.
+	ID string `json:"kid"`
+	// Secret is the secret itself.
+	Secret string `json:"secret,omitempty"`
+	// CreatedAt is the Unix time at which the key was generated.
+	CreatedAt int64 `json:"createdAt"`
+	// RetiresAt is the Unix time after which JWTs signed with the key are rejected.
+	// It is zero for keys that have not been rotated out.
+	RetiresAt int64 `json:"retiresAt,omitempty"`
+}
+
+// KeyRing is the set of secrets an app signs and verifies its HS256 JWTs with.
+// It is stored in config.Global.AuthKeys as JSON. JWTs are signed with the active
+// key; JWTs signed with any other key in the ring remain valid until that key retires.
+type KeyRing struct {
+	// Active is the ID of the key new JWTs are signed with.
+	Active string `json:"active"`
+	// Keys holds every key in the ring, including the active one.
+	Keys []Key `json:"keys"`
+}
+
+// ParseKeyRing decodes a KeyRing from its JSON representation. The empty string
+// is an empty key ring.
+func ParseKeyRing(data string) (*KeyRing, error) {
+
+	ring := &KeyRing{Keys: []Key{}}
+
+	if data == "" {
+		return ring, nil
+	} else if err := json.Unmarshal([]byte(data), ring); err != nil {
+		return nil, err
+	} else {
+		return ring, nil
+	}
+
+}
+
+// String returns the JSON representation of ring, suitable for storing in config.Global.AuthKeys.
+func (ring *KeyRing) String() string {
+	data, _ := json.Marshal(ring)
+	return string(data)
+}
+
+// Find returns the key in ring with ID kid, or nil if there is no such key or
+// the key retired before now.
+func (ring *KeyRing) Find(kid string, now time.Time) *Key {
+
+	if ring == nil {
+		return nil
+	}
+
+	for i := range ring.Keys {
+		if ring.Keys[i].ID != kid {
+			continue
+		} else if ring.Keys[i].RetiresAt != 0 && ring.Keys[i].RetiresAt <= now.Unix() {
+			return nil
+		} else {
+			return &ring.Keys[i]
+		}
+	}
+
+	return nil
+
+}
+
+// ActiveKey returns the key new JWTs should be signed with, or nil if the ring is empty.
+func (ring *KeyRing) ActiveKey() *Key {
+
+	if ring == nil || ring.Active == "" {
+		return nil
+	}
+
+	return ring.Find(ring.Active, time.Now())
+
+}
+
+// Rotate generates a new key and makes it the active one. The previously active key
+// retires once gracePeriod has elapsed, and keys that have already retired are
+// removed from the ring. The first rotation retires the legacy AuthSecret the same way,
+// by adding an entry for it with ID LegacyKeyID.
+func (ring *KeyRing) Rotate(now time.Time, gracePeriod time.Duration) (*Key, error) {
+
+	randomBytes := make([]byte, 48)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	previous := ring.Keys
+	if len(previous) == 0 {
+		previous = []Key{{ID: LegacyKeyID}}
+	}
+
+	keys := make([]Key, 0, len(previous)+1)
+	for _, key := range previous {
+		if key.RetiresAt != 0 && key.RetiresAt <= now.Unix() {
+			// this key has already retired, so drop it
+			continue
+		} else if key.RetiresAt == 0 {
+			key.RetiresAt = now.Add(gracePeriod).Unix()
+		}
+		keys = append(keys, key)
+	}
+
+	newKey := Key{
+		ID:        hex.EncodeToString(idBytes),
+		Secret:    base64.RawURLEncoding.EncodeToString(randomBytes),
+		CreatedAt: now.Unix(),
+	}
+
+	ring.Keys = append(keys, newKey)
+	ring.Active = newKey.ID
+
+	return &newKey, nil
+
+}
+
+// Redacted returns a copy of ring with every secret removed, which is safe to show to people.
+func (ring *KeyRing) Redacted() *KeyRing {
+
+	redacted := &KeyRing{Active: ring.Active, Keys: make([]Key, len(ring.Keys))}
+	for i, key := range ring.Keys {
+		key.Secret = ""
+		redacted.Keys[i] = key
+	}
+
+	return redacted
+
+}
+
+// Encode converts claimSet into a JWT, signs it with HMAC-256 using ring's active key,
+// and stamps the key's ID into the JWT header so Verifier.Decode can find it again.
+func (ring *KeyRing) Encode(claimSet *jws.ClaimSet) ([]byte, error) {
+
+	key := ring.ActiveKey()
+	if key == nil {
+		return nil, UnknownKeyError
+	}
+
+	return encodeHS256(claimSet, []byte(key.Secret), key.ID)
+
+}
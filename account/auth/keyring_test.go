@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"github.com/the-information/ori/config"
+	"golang.org/x/oauth2/jws"
+	"testing"
+	"time"
+)
+
+func TestParseKeyRing(t *testing.T) {
+
+	if ring, err := ParseKeyRing(""); err != nil {
+		t.Errorf("Unexpected error %s parsing an empty key ring", err)
+	} else if ring.ActiveKey() != nil {
+		t.Errorf("Expected an empty key ring to have no active key, but got %+v", ring.ActiveKey())
+	}
+
+	if _, err := ParseKeyRing("INVALIDJSON"); err == nil {
+		t.Errorf("Should have gotten an error parsing an invalid key ring")
+	}
+
+	ring := KeyRing{}
+	ring.Rotate(time.Now(), time.Hour)
+	if parsed, err := ParseKeyRing(ring.String()); err != nil {
+		t.Errorf("Unexpected error %s parsing a key ring", err)
+	} else if parsed.ActiveKey() == nil || parsed.ActiveKey().Secret != ring.ActiveKey().Secret {
+		t.Errorf("Key ring didn't survive a round trip: %+v", parsed)
+	}
+
+}
+
+func TestRotate(t *testing.T) {
+
+	ring := KeyRing{}
+	now := time.Now()
+
+	first, err := ring.Rotate(now, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error %s on Rotate", err)
+	} else if ring.Active != first.ID || first.RetiresAt != 0 {
+		t.Errorf("Expected the new key to be active and not retiring: %+v", ring)
+	} else if legacy := ring.Find(LegacyKeyID, now); legacy == nil || legacy.RetiresAt != now.Add(time.Hour).Unix() {
+		t.Errorf("Expected the first rotation to retire the auth secret after the grace period: %+v", ring)
+	}
+
+	second, _ := ring.Rotate(now, time.Hour)
+	if ring.Active != second.ID || len(ring.Keys) != 3 {
+		t.Errorf("Expected the ring to hold the legacy entry and two keys with the second active: %+v", ring)
+	} else if ring.Find(first.ID, now) == nil {
+		t.Errorf("Expected the first key to still be usable during its grace period")
+	} else if ring.Find(first.ID, now.Add(2*time.Hour)) != nil {
+		t.Errorf("Expected the first key to be retired after its grace period")
+	}
+
+	// rotating after the grace period drops the retired key
+	ring.Rotate(now.Add(2*time.Hour), time.Hour)
+	if len(ring.Keys) != 2 || ring.Keys[0].ID != second.ID {
+		t.Errorf("Expected the retired key to be dropped: %+v", ring)
+	}
+
+	for _, key := range ring.Redacted().Keys {
+		if key.Secret != "" {
+			t.Errorf("Expected redacted key ring to have no secrets, but got %+v", key)
+		}
+	}
+
+}
+
+func TestVerifierWithKeyRing(t *testing.T) {
+
+	ring := KeyRing{}
+	now := time.Now()
+	oldKey, _ := ring.Rotate(now.Add(-2*time.Hour), time.Hour)
+	ring.Rotate(now.Add(-2*time.Hour), time.Hour)
+
+	v, err := NewVerifier(&config.Global{AuthSecret: "wat", AuthKeys: ring.String()})
+	if err != nil {
+		t.Fatalf("Unexpected error %s from NewVerifier", err)
+	}
+
+	claimSet := &jws.ClaimSet{Sub: "foo@bar.com", Exp: now.Add(time.Hour).Unix()}
+
+	// signed with the active key
+	if jwt, err := Sign(claimSet, &config.Global{AuthSecret: "wat", AuthKeys: ring.String()}); err != nil {
+		t.Errorf("Unexpected error %s from Sign", err)
+	} else if newClaimSet, err := v.Decode(jwt); err != nil {
+		t.Errorf("Unexpected error %s decoding JWT signed with the active key", err)
+	} else if newClaimSet.Sub != claimSet.Sub {
+		t.Errorf("Bad sub on new token: wanted %s, got %s", claimSet.Sub, newClaimSet.Sub)
+	}
+
+	// signed with a key that has retired
+	if jwt, err := encodeHS256(claimSet, []byte(oldKey.Secret), oldKey.ID); err != nil {
+		t.Errorf("Unexpected error %s encoding JWT", err)
+	} else if _, err := v.Decode(jwt); err != UnknownKeyError {
+		t.Errorf("Expected UnknownKeyError decoding JWT signed with a retired key, but got %s", err)
+	}
+
+	// signed with the auth secret before the key ring existed, which has since retired
+	legacyJWT, _ := Encode(claimSet, []byte("wat"))
+	if _, err := v.Decode(legacyJWT); err != UnknownKeyError {
+		t.Errorf("Expected UnknownKeyError decoding JWT signed with the retired auth secret, but got %v", err)
+	}
+
+	// during the grace period of the first rotation, the auth secret still verifies
+	freshRing := KeyRing{}
+	freshRing.Rotate(now, time.Hour)
+	if fresh, err := NewVerifier(&config.Global{AuthSecret: "wat", AuthKeys: freshRing.String()}); err != nil {
+		t.Fatalf("Unexpected error %s from NewVerifier", err)
+	} else if _, err := fresh.Decode(legacyJWT); err != nil {
+		t.Errorf("Unexpected error %s decoding JWT signed with the auth secret during its grace period", err)
+	}
+
+	// the legacy entry has no secret, so a JWT can't claim it by kid
+	if jwt, err := encodeHS256(claimSet, []byte(""), "x"); err != nil {
+		t.Errorf("Unexpected error %s encoding JWT", err)
+	} else if _, err := v.Decode(jwt); err != UnknownKeyError {
+		t.Errorf("Expected UnknownKeyError, but got %v", err)
+	}
+
+	// the auth secret is still Super
+	if claimSet, err := v.Decode([]byte("wat")); err != nil || claimSet != SuperClaimSet {
+		t.Errorf("Expected SuperClaimSet, but got %+v, %s", claimSet, err)
+	}
+
+}
+
+func TestNewVerifier(t *testing.T) {
+
+	if v, err := NewVerifier(&config.Global{AuthSecret: "wat", TokenIssuer: "ori", TokenAudience: "app", ClockSkew: "30s"}); err != nil {
+		t.Errorf("Unexpected error %s from NewVerifier", err)
+	} else if v.Issuer != "ori" || v.Audience != "app" || v.Leeway != 30*time.Second {
+		t.Errorf("Bad verifier from NewVerifier: %+v", v)
+	}
+
+	if _, err := NewVerifier(&config.Global{AuthSecret: "wat", ClockSkew: "wat"}); err != ErrBadTokenConfig {
+		t.Errorf("Expected ErrBadTokenConfig with a bad ClockSkew, but got %s", err)
+	}
+
+}
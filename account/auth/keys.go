@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"math/big"
+	"net/http"
+	"sync"
+)
+
+var (
+	InvalidKeyError = Error("Key isn't an RSA or P-256 ECDSA key")
+)
+
+// JWK is the JSON Web Key representation of a public key, as described in RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set, the document served by JWKSHandler.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// ParsePrivateKey reads a PEM-encoded RSA or P-256 ECDSA private key, in either
+// PKCS #1, SEC 1 or PKCS #8 form.
+func ParsePrivateKey(pemData []byte) (crypto.Signer, error) {
+
+	var key interface{}
+	var err error
+
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, InvalidKeyError
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, InvalidKeyError
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := key.(type) {
+	case *rsa.PrivateKey:
+		return t, nil
+	case *ecdsa.PrivateKey:
+		if t.Curve != elliptic.P256() {
+			return nil, InvalidKeyError
+		}
+		return t, nil
+	default:
+		return nil, InvalidKeyError
+	}
+
+}
+
+// Algorithm returns the JWS algorithm used to sign with the private half of pub:
+// RS256 for RSA keys and ES256 for P-256 ECDSA keys.
+func Algorithm(pub crypto.PublicKey) (string, error) {
+
+	switch t := pub.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		if t.Curve == elliptic.P256() {
+			return "ES256", nil
+		}
+	}
+
+	return "", InvalidKeyError
+
+}
+
+// NewJWK converts pub into a JWK. The key ID is the RFC 7638 thumbprint of the key,
+// which is also the kid that EncodeWithKey stamps into JWT headers.
+func NewJWK(pub crypto.PublicKey) (*JWK, error) {
+
+	alg, err := Algorithm(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := &JWK{Use: "sig", Alg: alg}
+	var thumbprintInput string
+
+	switch t := pub.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(t.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(t.E)).Bytes())
+		thumbprintInput = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(padTo(t.X.Bytes(), 32))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padTo(t.Y.Bytes(), 32))
+		thumbprintInput = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, jwk.X, jwk.Y)
+	}
+
+	thumbprint := sha256.Sum256([]byte(thumbprintInput))
+	jwk.Kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+
+	return jwk, nil
+
+}
+
+// PublicKey converts the JWK back into the RSA or P-256 ECDSA public key it describes.
+func (jwk *JWK) PublicKey() (crypto.PublicKey, error) {
+
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		if n, err := decode(jwk.N); err != nil {
+			return nil, err
+		} else if e, err := decode(jwk.E); err != nil {
+			return nil, err
+		} else if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, InvalidKeyError
+		} else {
+			return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+		}
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, InvalidKeyError
+		} else if x, err := decode(jwk.X); err != nil {
+			return nil, err
+		} else if y, err := decode(jwk.Y); err != nil {
+			return nil, err
+		} else if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, InvalidKeyError
+		} else {
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+		}
+	default:
+		return nil, InvalidKeyError
+	}
+
+}
+
+// EncodeWithKey converts claimSet into a JWT and signs it with key, using
+// RS256 for RSA keys and ES256 for P-256 ECDSA keys.
+func EncodeWithKey(claimSet *jws.ClaimSet, key crypto.Signer) ([]byte, error) {
+
+	jwk, err := NewJWK(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := jws.EncodeWithSigner(&jws.Header{
+		Typ:       "JWT",
+		Algorithm: jwk.Alg,
+		KeyID:     jwk.Kid,
+	}, claimSet, func(data []byte) ([]byte, error) {
+
+		hashed := sha256.Sum256(data)
+
+		switch t := key.(type) {
+		case *rsa.PrivateKey:
+			return rsa.SignPKCS1v15(rand.Reader, t, crypto.SHA256, hashed[:])
+		case *ecdsa.PrivateKey:
+			// JWS wants the raw concatenation of r and s rather than ASN.1
+			r, s, err := ecdsa.Sign(rand.Reader, t, hashed[:])
+			if err != nil {
+				return nil, err
+			}
+			return append(padTo(r.Bytes(), 32), padTo(s.Bytes(), 32)...), nil
+		default:
+			return nil, InvalidKeyError
+		}
+
+	})
+
+	return []byte(result), err
+
+}
+
+var signingKeyCache struct {
+	sync.Mutex
+	pem string
+	key crypto.Signer
+}
+
+// SigningKey returns the private key stored in conf.SigningKey, or nil if
+// the app signs its JWTs with AuthSecret instead.
+func SigningKey(conf *config.Global) (crypto.Signer, error) {
+
+	if conf.SigningKey == "" {
+		return nil, nil
+	}
+
+	signingKeyCache.Lock()
+	defer signingKeyCache.Unlock()
+
+	if signingKeyCache.pem != conf.SigningKey {
+		key, err := ParsePrivateKey([]byte(conf.SigningKey))
+		if err != nil {
+			return nil, err
+		}
+		signingKeyCache.pem = conf.SigningKey
+		signingKeyCache.key = key
+	}
+
+	return signingKeyCache.key, nil
+
+}
+
+// Sign converts claimSet into a JWT signed the way conf says it should be: with
+// SigningKey if it is set, or else with the active key in AuthKeys if there is one,
+// or else with AuthSecret.
+func Sign(claimSet *jws.ClaimSet, conf *config.Global) ([]byte, error) {
+
+	if key, err := SigningKey(conf); err != nil {
+		return nil, err
+	} else if key != nil {
+		return EncodeWithKey(claimSet, key)
+	} else if ring, err := ParseKeyRing(conf.AuthKeys); err != nil {
+		return nil, err
+	} else if ring.ActiveKey() != nil {
+		return ring.Encode(claimSet)
+	} else {
+		return Encode(claimSet, []byte(conf.AuthSecret))
+	}
+
+}
+
+// JWKSHandler is a kami.HandlerFunc that serves the public half of the app's
+// SigningKey as a JWKSet, so other services can verify the app's JWTs without
+// being able to mint them. The set is empty if the app has no SigningKey.
+func JWKSHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var conf config.Global
+	set := JWKSet{Keys: []JWK{}}
+
+	if err := config.Get(ctx, &conf); err != nil {
+		rest.WriteJSON(w, err)
+	} else if key, err := SigningKey(&conf); err != nil {
+		rest.WriteJSON(w, err)
+	} else if key == nil {
+		rest.WriteJSON(w, &set)
+	} else if jwk, err := NewJWK(key.Public()); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		set.Keys = append(set.Keys, *jwk)
+		rest.WriteJSON(w, &set)
+	}
+
+}
+
+// padTo left-pads b with zeroes to n bytes, as JWS wants the coordinates and
+// signature halves of P-256 keys written at their full length.
+func padTo(b []byte, n int) []byte {
+
+	if len(b) >= n {
+		return b
+	}
+
+	padded := make([]byte, n)
+	copy(padded[n-len(b):], b)
+	return padded
+
+}
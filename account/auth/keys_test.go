@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func makeKeys(t *testing.T) (rsaPEM, ecPEM []byte) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Unexpected error %s generating RSA key", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error %s generating ECDSA key", err)
+	}
+
+	ecBytes, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("Unexpected error %s marshaling ECDSA key", err)
+	}
+
+	rsaPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	ecPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes})
+	return
+
+}
+
+func TestParsePrivateKey(t *testing.T) {
+
+	rsaPEM, ecPEM := makeKeys(t)
+
+	if key, err := ParsePrivateKey(rsaPEM); err != nil {
+		t.Errorf("Unexpected error %s parsing RSA key", err)
+	} else if alg, _ := Algorithm(key.Public()); alg != "RS256" {
+		t.Errorf("Expected RSA key to use RS256, but got %s", alg)
+	}
+
+	if key, err := ParsePrivateKey(ecPEM); err != nil {
+		t.Errorf("Unexpected error %s parsing ECDSA key", err)
+	} else if alg, _ := Algorithm(key.Public()); alg != "ES256" {
+		t.Errorf("Expected ECDSA key to use ES256, but got %s", alg)
+	}
+
+	if _, err := ParsePrivateKey([]byte("wat")); err != InvalidKeyError {
+		t.Errorf("Expected InvalidKeyError, but got %s", err)
+	}
+
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p384Bytes, _ := x509.MarshalECPrivateKey(p384Key)
+	p384PEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: p384Bytes})
+	if _, err := ParsePrivateKey(p384PEM); err != InvalidKeyError {
+		t.Errorf("Expected InvalidKeyError for a P-384 key, but got %s", err)
+	}
+
+}
+
+func TestEncodeWithKey(t *testing.T) {
+
+	rsaPEM, ecPEM := makeKeys(t)
+	otherRSAPEM, otherECPEM := makeKeys(t)
+
+	claimSet := &jws.ClaimSet{
+		Sub: "foo@bar.com",
+		Exp: time.Now().Add(time.Hour).Unix(),
+	}
+
+	for _, pair := range [][2][]byte{{rsaPEM, otherRSAPEM}, {ecPEM, otherECPEM}} {
+
+		key, _ := ParsePrivateKey(pair[0])
+		otherKey, _ := ParsePrivateKey(pair[1])
+
+		jwt, err := EncodeWithKey(claimSet, key)
+		if err != nil {
+			t.Fatalf("Unexpected error %s from EncodeWithKey", err)
+		}
+
+		if newClaimSet, err := Decode(jwt, secret, key.Public()); err != nil {
+			t.Errorf("Expected no error decoding with the right key, but got %s", err)
+		} else if newClaimSet.Sub != claimSet.Sub {
+			t.Errorf("Bad sub on new token: wanted %s, got %s", claimSet.Sub, newClaimSet.Sub)
+		}
+
+		if _, err := Decode(jwt, secret, otherKey.Public(), key.Public()); err != nil {
+			t.Errorf("Expected no error decoding with several keys, but got %s", err)
+		}
+
+		if _, err := Decode(jwt, secret, otherKey.Public()); err != BadSignatureError {
+			t.Errorf("Expected BadSignatureError decoding with the wrong key, but got %s", err)
+		}
+
+		if _, err := Decode(jwt, secret); err != InvalidAlgorithmError {
+			t.Errorf("Expected InvalidAlgorithmError decoding without a key, but got %s", err)
+		}
+
+	}
+
+}
+
+func TestJWKPublicKey(t *testing.T) {
+
+	rsaPEM, ecPEM := makeKeys(t)
+
+	for _, pemData := range [][]byte{rsaPEM, ecPEM} {
+
+		key, _ := ParsePrivateKey(pemData)
+		jwk, _ := NewJWK(key.Public())
+
+		if pub, err := jwk.PublicKey(); err != nil {
+			t.Errorf("Unexpected error %s converting %s JWK back", err, jwk.Kty)
+		} else if roundTripped, _ := NewJWK(pub); *roundTripped != *jwk {
+			t.Errorf("Expected %+v after a round trip, got %+v", jwk, roundTripped)
+		}
+
+	}
+
+	if _, err := (&JWK{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}).PublicKey(); err != InvalidKeyError {
+		t.Errorf("Expected InvalidKeyError for a point off the curve, got %v", err)
+	}
+	if _, err := (&JWK{Kty: "oct"}).PublicKey(); err != InvalidKeyError {
+		t.Errorf("Expected InvalidKeyError for a symmetric key, got %v", err)
+	}
+
+}
+
+func TestJWKSHandler(t *testing.T) {
+
+	var set JWKSet
+	rsaPEM, ecPEM := makeKeys(t)
+
+	// no signing key, so no keys
+	w := test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Run(context.Background(), JWKSHandler)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http.StatusOK, got %d: error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatalf("Unexpected error %s reading body of response", err)
+	} else if len(set.Keys) != 0 {
+		t.Errorf("Expected no keys, but got %+v", set.Keys)
+	}
+
+	for _, keyPEM := range [][]byte{rsaPEM, ecPEM} {
+
+		var set JWKSet
+		key, _ := ParsePrivateKey(keyPEM)
+		expected, _ := NewJWK(key.Public())
+
+		w = test.NewState().
+			Config(&config.Global{AuthSecret: "foo", SigningKey: string(keyPEM)}).
+			Run(context.Background(), JWKSHandler)
+
+		if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+			t.Fatalf("Unexpected error %s reading body of response", err)
+		} else if len(set.Keys) != 1 || set.Keys[0] != *expected {
+			t.Errorf("Expected key set to hold %+v, but got %+v", expected, set.Keys)
+		}
+
+		jwt, _ := EncodeWithKey(&jws.ClaimSet{Exp: time.Now().Add(time.Hour).Unix()}, key)
+		header := jws.Header{}
+		readHeader(jwt[:bytes.IndexByte(jwt, '.')], &header)
+		if header.KeyID != expected.Kid {
+			t.Errorf("Expected JWT to carry kid %s, but got %s", expected.Kid, header.KeyID)
+		}
+		if _, err := Decode(jwt, secret, key.Public()); err != nil {
+			t.Errorf("Unexpected error %s decoding JWT", err)
+		}
+
+	}
+
+}
+
+func Test_padTo(t *testing.T) {
+
+	if padded := padTo([]byte{1, 2}, 4); !bytes.Equal(padded, []byte{0, 0, 1, 2}) {
+		t.Errorf("Expected a short value to be left-padded, got %v", padded)
+	} else if padded := padTo([]byte{1, 2, 3, 4}, 4); !bytes.Equal(padded, []byte{1, 2, 3, 4}) {
+		t.Errorf("Expected a full-length value to be left alone, got %v", padded)
+	}
+
+}
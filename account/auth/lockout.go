@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"github.com/qedus/nds"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LoginLockoutEntity is the name of the Datastore entity used to track failed logins.
+// There is at most one per account, stored as a descendant of the account's key.
+const LoginLockoutEntity = "APILoginLockout"
+
+// Defaults for the login lockout settings in config.Global.
+var (
+	DefaultLoginLockoutThreshold   = 5
+	DefaultLoginLockoutDuration    = time.Minute
+	DefaultLoginLockoutMaxDuration = 24 * time.Hour
+)
+
+var (
+	ErrLockedOut        = errors.New(http.StatusTooManyRequests, "Too many failed login attempts; the account is temporarily locked")
+	ErrBadLockoutConfig = errors.New(http.StatusInternalServerError, "The login lockout configuration for this app is invalid")
+	ErrAccountDisabled  = errors.New(http.StatusForbidden, "The account has been disabled")
+)
+
+// LoginLockout records the failed login attempts for an account.
+type LoginLockout struct {
+	// Failures is the number of failed attempts since the last successful login or lockout.
+	Failures int `json:"failures"`
+	// Lockouts is the number of times the account has been locked out since the last
+	// successful login. Each lockout lasts twice as long as the one before.
+	Lockouts int `json:"lockouts"`
+	// LastFailureAt is the time of the most recent failed attempt.
+	LastFailureAt time.Time `json:"lastFailureAt"`
+	// LockedUntil is the time at which the current lockout ends, if there is one.
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+}
+
+// Locked reports whether the account is locked out at time now.
+func (l *LoginLockout) Locked(now time.Time) bool {
+	return now.Before(l.LockedUntil)
+}
+
+type lockoutPolicy struct {
+	threshold   int
+	duration    time.Duration
+	maxDuration time.Duration
+}
+
+func newLockoutPolicy(conf *config.Global) (*lockoutPolicy, error) {
+
+	policy := &lockoutPolicy{
+		threshold:   DefaultLoginLockoutThreshold,
+		duration:    DefaultLoginLockoutDuration,
+		maxDuration: DefaultLoginLockoutMaxDuration,
+	}
+
+	if conf.LoginLockoutThreshold != "" {
+		if n, err := strconv.Atoi(conf.LoginLockoutThreshold); err != nil || n < 1 {
+			return nil, ErrBadLockoutConfig
+		} else {
+			policy.threshold = n
+		}
+	}
+
+	if conf.LoginLockoutDuration != "" {
+		if d, err := time.ParseDuration(conf.LoginLockoutDuration); err != nil || d <= 0 {
+			return nil, ErrBadLockoutConfig
+		} else {
+			policy.duration = d
+		}
+	}
+
+	if conf.LoginLockoutMaxDuration != "" {
+		if d, err := time.ParseDuration(conf.LoginLockoutMaxDuration); err != nil || d <= 0 {
+			return nil, ErrBadLockoutConfig
+		} else {
+			policy.maxDuration = d
+		}
+	}
+
+	return policy, nil
+
+}
+
+// lockoutFor returns how long the nth lockout lasts.
+func (p *lockoutPolicy) lockoutFor(n int) time.Duration {
+
+	d := p.duration
+	for i := 1; i < n && d < p.maxDuration; i++ {
+		d *= 2
+	}
+
+	if d > p.maxDuration {
+		d = p.maxDuration
+	}
+	return d
+
+}
+
+func loginLockoutKey(ctx context.Context, email string) *datastore.Key {
+	return datastore.NewKey(ctx, LoginLockoutEntity, "lockout", 0, datastore.NewKey(ctx, account.Entity, email, 0, nil))
+}
+
+// moveLoginLockout moves the failed login record of the account at oldEmail to newEmail,
+// for account.ChangeEmail, so changing the address doesn't end a lockout.
+func moveLoginLockout(ctx context.Context, oldEmail, newEmail string) error {
+
+	var lockout LoginLockout
+	if err := GetLoginLockout(ctx, oldEmail, &lockout); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	} else if _, err := nds.Put(ctx, loginLockoutKey(ctx, newEmail), &lockout); err != nil {
+		return err
+	}
+	return nds.Delete(ctx, loginLockoutKey(ctx, oldEmail))
+
+}
+
+// GetLoginLockout retrieves the failed login record for the account with email address
+// email and stores it in lockout. It returns datastore.ErrNoSuchEntity if there have been
+// no failures since the last successful login.
+func GetLoginLockout(ctx context.Context, email string, lockout *LoginLockout) error {
+	return nds.Get(ctx, loginLockoutKey(ctx, email), lockout)
+}
+
+// Unlock clears the failed login record for the account with email address email,
+// ending any lockout.
+func Unlock(ctx context.Context, email string) error {
+
+	if err := nds.Delete(ctx, loginLockoutKey(ctx, email)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+
+}
+
+// CheckLogin checks password against acct like Account.CheckPassword, along with code if
+// it isn't empty, which may be a TOTP code or a recovery code for accounts that have enabled
+// two-factor authentication. It returns the authentication methods used, for the amr claim
+// of the JWT the login earns.
+//
+// CheckLogin keeps track of failures. Once LoginLockoutThreshold attempts in a row have
+// failed, the account is locked out and CheckLogin returns ErrLockedOut without checking
+// anything until the lockout ends. A successful login clears the record. Other failures
+// return ErrInvalidCredentials or account.ErrInvalidTOTPCode, or ErrAccountDisabled if
+// the password is right but the account has been disabled.
+//
+// If the account's password hash was outdated, CheckLogin rehashes the password as described
+// in Account.NeedsRehash. If it did, or a code was used up, CheckLogin saves the account.
+func CheckLogin(ctx context.Context, acct *account.Account, password, code string) ([]string, error) {
+
+	var conf config.Global
+	var lockout LoginLockout
+
+	if err := config.Get(ctx, &conf); err != nil {
+		return nil, err
+	}
+
+	policy, err := newLockoutPolicy(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := true
+	if err := GetLoginLockout(ctx, acct.Email, &lockout); err == datastore.ErrNoSuchEntity {
+		exists = false
+	} else if err != nil {
+		return nil, err
+	}
+
+	if lockout.Locked(time.Now()) {
+		log.Warningf(ctx, "%s: login attempted while locked out until %s", acct.Email, lockout.LockedUntil)
+		return nil, ErrLockedOut
+	}
+
+	if err := acct.CheckPassword(password); err != nil {
+		return nil, recordLoginFailure(ctx, acct.Email, policy)
+	}
+
+	if acct.Deleted() {
+		// only tell people who know the password
+		return nil, account.ErrAccountDeleted
+	} else if acct.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	changed := false
+	if rehash, err := acct.NeedsRehash(ctx); err != nil {
+		log.Errorf(ctx, "%s: couldn't check whether password needs rehashing: %s", acct.Email, err.Error())
+	} else if rehash {
+		if err := acct.Rehash(ctx, password); err != nil {
+			log.Errorf(ctx, "%s: couldn't rehash password: %s", acct.Email, err.Error())
+		} else {
+			changed = true
+		}
+	}
+
+	amr := []string{AMRPassword}
+
+	if code != "" {
+		if !acct.TOTPEnabled {
+			return nil, account.ErrTOTPNotEnrolled
+		} else if err := acct.CheckTOTP(code, time.Now()); err == nil {
+			amr = append(amr, AMROTP, AMRMFA)
+		} else if err := acct.UseRecoveryCode(code); err == nil {
+			log.Infof(ctx, "%s: logged in with a recovery code; %d left", acct.Email, len(acct.RecoveryCodes))
+			amr = append(amr, AMRMFA)
+		} else if err := recordLoginFailure(ctx, acct.Email, policy); err == ErrInvalidCredentials {
+			return nil, account.ErrInvalidTOTPCode
+		} else {
+			return nil, err
+		}
+		changed = true
+	}
+
+	if changed {
+		if err := account.SaveLogin(ctx, acct); err != nil && code != "" {
+			// the code must be used up, or it could be replayed
+			return nil, err
+		} else if err != nil {
+			log.Errorf(ctx, "%s: couldn't save rehashed password: %s", acct.Email, err.Error())
+		}
+	}
+
+	if exists {
+		if err := Unlock(ctx, acct.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	return amr, nil
+
+}
+
+// recordLoginFailure counts a failed login attempt for the account with email address email,
+// locking it out if that makes too many. It returns ErrLockedOut if it does, and
+// ErrInvalidCredentials if not.
+func recordLoginFailure(ctx context.Context, email string, policy *lockoutPolicy) error {
+
+	result := ErrInvalidCredentials
+	err := nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		// start over, in case another attempt has been recorded since
+		var lockout LoginLockout
+		key := loginLockoutKey(txCtx, email)
+
+		if err := nds.Get(txCtx, key, &lockout); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		lockout.Failures++
+		lockout.LastFailureAt = now
+
+		if lockout.Failures >= policy.threshold {
+			lockout.Lockouts++
+			lockout.Failures = 0
+			lockout.LockedUntil = now.Add(policy.lockoutFor(lockout.Lockouts))
+			log.Warningf(ctx, "%s: locked out until %s after %d failed logins", email, lockout.LockedUntil, policy.threshold)
+			result = ErrLockedOut
+		}
+
+		_, err := nds.Put(txCtx, key, &lockout)
+		return err
+
+	}, nil)
+
+	if err != nil {
+		return err
+	}
+	return result
+
+}
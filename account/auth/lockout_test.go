@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"google.golang.org/appengine/aetest"
+	"testing"
+	"time"
+)
+
+func Test_lockoutPolicy(t *testing.T) {
+
+	policy, err := newLockoutPolicy(&config.Global{LoginLockoutDuration: "1m", LoginLockoutMaxDuration: "5m"})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	} else if policy.threshold != DefaultLoginLockoutThreshold {
+		t.Errorf("Expected the default threshold, got %d", policy.threshold)
+	}
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, d := range expected {
+		if got := policy.lockoutFor(i + 1); got != d {
+			t.Errorf("Expected lockout %d to last %s, got %s", i+1, d, got)
+		}
+	}
+
+	for _, conf := range []config.Global{
+		{LoginLockoutThreshold: "0"},
+		{LoginLockoutThreshold: "lots"},
+		{LoginLockoutDuration: "-1m"},
+		{LoginLockoutMaxDuration: "forever"},
+	} {
+		if _, err := newLockoutPolicy(&conf); err != ErrBadLockoutConfig {
+			t.Errorf("Expected ErrBadLockoutConfig for %+v, got %v", conf, err)
+		}
+	}
+
+}
+
+func TestCheckLogin(t *testing.T) {
+
+	var acct account.Account
+	var lockout LoginLockout
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	account.Get(ctx, "foo@bar.com", &acct)
+	ctx = test.WithConfig(ctx, map[string]interface{}{
+		"AuthSecret":            "foo",
+		"LoginLockoutThreshold": "2",
+	})
+
+	if _, err := CheckLogin(ctx, &acct, "wrong", ""); err != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %s", err)
+	}
+
+	if _, err := CheckLogin(ctx, &acct, "wrong", ""); err != ErrLockedOut {
+		t.Errorf("Expected ErrLockedOut after the threshold, got %s", err)
+	}
+
+	// the right password doesn't help while locked out
+	if _, err := CheckLogin(ctx, &acct, "foobar", ""); err != ErrLockedOut {
+		t.Errorf("Expected ErrLockedOut with the right password, got %s", err)
+	}
+
+	if err := GetLoginLockout(ctx, "foo@bar.com", &lockout); err != nil {
+		t.Fatalf("Unexpected error %s getting lockout", err)
+	} else if lockout.Lockouts != 1 || !lockout.Locked(time.Now()) {
+		t.Errorf("Expected one lockout in force, got %+v", lockout)
+	}
+
+	if err := Unlock(ctx, "foo@bar.com"); err != nil {
+		t.Fatalf("Unexpected error %s unlocking", err)
+	}
+
+	if _, err := CheckLogin(ctx, &acct, "foobar", ""); err != nil {
+		t.Errorf("Unexpected error %s logging in after unlock", err)
+	}
+
+	// accounts marked deleted can't log in, even with the right password
+	acct.MarkDeleted()
+	if _, err := CheckLogin(ctx, &acct, "foobar", ""); err != account.ErrAccountDeleted {
+		t.Errorf("Expected ErrAccountDeleted, got %v", err)
+	}
+
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New(http.StatusUnauthorized, "The email address or password is incorrect")
+	ErrBadTokenConfig     = errors.New(http.StatusInternalServerError, "The token configuration for this app is invalid")
+)
+
+// DefaultTokenLifetime is the lifetime of a JWT issued by Issue when
+// config.Global does not set TokenLifetime.
+var DefaultTokenLifetime = 24 * time.Hour
+
+// Credentials is the request body accepted by LoginHandler.
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Code is a TOTP code or recovery code, for accounts with two-factor authentication.
+	// Logging in without one is allowed, but the JWT won't pass auth.MFA.
+	Code string `json:"code,omitempty"`
+}
+
+// Token is a signed JWT along with the time at which it expires.
+type Token struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// NewClaimSet builds the claim set for a JWT identifying acct according to
+// the token lifetime, default scope, issuer, audience and extra claims set in conf.
+func NewClaimSet(acct *account.Account, conf *config.Global) (*jws.ClaimSet, error) {
+
+	lifetime := DefaultTokenLifetime
+	if conf.TokenLifetime != "" {
+		if d, err := time.ParseDuration(conf.TokenLifetime); err != nil || d <= 0 {
+			return nil, ErrBadTokenConfig
+		} else {
+			lifetime = d
+		}
+	}
+
+	scope := conf.DefaultScope
+	if scope == "" {
+		scope = AllScope
+	}
+
+	privateClaims := map[string]interface{}{}
+	if conf.TokenClaims != "" {
+		if err := json.Unmarshal([]byte(conf.TokenClaims), &privateClaims); err != nil {
+			return nil, ErrBadTokenConfig
+		}
+	}
+
+	// every token gets an ID so it can be revoked
+	if jti, err := NewJTI(); err != nil {
+		return nil, err
+	} else {
+		privateClaims["jti"] = jti
+	}
+
+	now := time.Now()
+	return &jws.ClaimSet{
+		Iss:           conf.TokenIssuer,
+		Aud:           conf.TokenAudience,
+		Sub:           acct.Email,
+		Scope:         scope,
+		Iat:           now.Unix(),
+		Exp:           now.Add(lifetime).Unix(),
+		PrivateClaims: privateClaims,
+	}, nil
+
+}
+
+// Issue generates a signed JWT for acct using the application configuration in ctx,
+// and records the Session it starts.
+func Issue(ctx context.Context, acct *account.Account) (*Token, error) {
+	return IssueWithAMR(ctx, acct, nil)
+}
+
+// IssueWithAMR is like Issue, but records the authentication methods acct used to log in,
+// such as AMRPassword, in the amr claim of the JWT.
+func IssueWithAMR(ctx context.Context, acct *account.Account, amr []string) (*Token, error) {
+
+	var conf config.Global
+
+	if err := config.Get(ctx, &conf); err != nil {
+		return nil, err
+	}
+
+	claimSet, err := NewClaimSet(acct, &conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(amr) > 0 {
+		claimSet.PrivateClaims[AMRClaim] = amr
+	}
+
+	// the token starts a session of its own, identified by its jti
+	claimSet.PrivateClaims[SessionClaim] = claimSet.PrivateClaims["jti"]
+
+	jwt, err := Sign(claimSet, &conf)
+	if err != nil {
+		return nil, err
+	} else if err := recordSession(ctx, acct, claimSet); err != nil {
+		return nil, err
+	}
+
+	return &Token{Token: string(jwt), ExpiresAt: claimSet.Exp}, nil
+
+}
+
+// LoginHandler is a kami.HandlerFunc that exchanges an email address and password
+// for a JWT. It expects a JSON body shaped like Credentials and responds with a Token.
+// Repeated failures lock the account out, as described in CheckLogin.
+// Install it on whatever route you like:
+//	kami.Post("/login", auth.LoginHandler)
+func LoginHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var creds Credentials
+	var acct account.Account
+
+	if err := rest.ReadJSON(r, &creds); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if creds.Email == "" {
+		rest.WriteJSON(w, ErrInvalidCredentials)
+	} else if err := account.Get(ctx, creds.Email, &acct); err == datastore.ErrNoSuchEntity {
+		// hash the password anyway, so that unknown addresses take as long as wrong
+		// passwords and the response time doesn't give away which accounts exist
+		acct.Rehash(ctx, creds.Password)
+		rest.WriteJSON(w, ErrInvalidCredentials)
+	} else if err != nil {
+		rest.WriteJSON(w, err)
+	} else if amr, err := CheckLogin(ctx, &acct, creds.Password, creds.Code); err != nil {
+		log.Warningf(ctx, "%s: failed login", creds.Email)
+		rest.WriteJSON(w, err)
+	} else if token, err := IssueWithAMR(ctx, &acct, amr); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, token)
+	}
+
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewClaimSet(t *testing.T) {
+
+	acct := account.Account{Email: "foo@bar.com"}
+
+	claimSet, err := NewClaimSet(&acct, &config.Global{})
+	if err != nil {
+		t.Fatalf("Unexpected error %s from NewClaimSet", err)
+	} else if claimSet.Sub != "foo@bar.com" || claimSet.Scope != AllScope {
+		t.Errorf("Unexpected claim set %+v", claimSet)
+	} else if claimSet.Exp-claimSet.Iat != int64(DefaultTokenLifetime/time.Second) {
+		t.Errorf("Expected the default token lifetime, but got %d seconds", claimSet.Exp-claimSet.Iat)
+	}
+
+	claimSet, err = NewClaimSet(&acct, &config.Global{
+		TokenLifetime: "1h",
+		DefaultScope:  "viewer",
+		TokenClaims:   `{"n":"Foo"}`,
+		TokenIssuer:   "ori",
+		TokenAudience: "app",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %s from NewClaimSet", err)
+	} else if claimSet.Scope != "viewer" || claimSet.PrivateClaims["n"] != "Foo" || claimSet.Iss != "ori" || claimSet.Aud != "app" {
+		t.Errorf("Unexpected claim set %+v", claimSet)
+	} else if claimSet.Exp-claimSet.Iat != 3600 {
+		t.Errorf("Expected a lifetime of 3600 seconds, but got %d", claimSet.Exp-claimSet.Iat)
+	}
+
+	if _, err := NewClaimSet(&acct, &config.Global{TokenLifetime: "forever"}); err != ErrBadTokenConfig {
+		t.Errorf("Expected ErrBadTokenConfig with a bad lifetime, but got %s", err)
+	}
+
+	if _, err := NewClaimSet(&acct, &config.Global{TokenClaims: "INVALIDJSON"}); err != ErrBadTokenConfig {
+		t.Errorf("Expected ErrBadTokenConfig with bad claims, but got %s", err)
+	}
+
+}
+
+func TestLoginHandler(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	conf := config.Global{AuthSecret: "foo"}
+
+	// wrong password
+	w := test.NewState().
+		Config(&conf).
+		Body(&Credentials{Email: "foo@bar.com", Password: "wrong"}).
+		Run(ctx, LoginHandler)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized with a wrong password, got %d", w.Code)
+	}
+
+	// nonexistent account
+	w = test.NewState().
+		Config(&conf).
+		Body(&Credentials{Email: "nobody@here.chickens", Password: "foobar"}).
+		Run(ctx, LoginHandler)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized with a nonexistent account, got %d", w.Code)
+	}
+
+	// the happy path
+	var token Token
+	w = test.NewState().
+		Config(&conf).
+		Body(&Credentials{Email: "foo@bar.com", Password: "foobar"}).
+		Run(ctx, LoginHandler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http.StatusOK, got %d: error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("Unexpected error %s reading body of response", err)
+	}
+
+	if claimSet, err := Decode([]byte(token.Token), []byte("foo")); err != nil {
+		t.Errorf("Unexpected error %s decoding issued token", err)
+	} else if claimSet.Sub != "foo@bar.com" || claimSet.Exp != token.ExpiresAt {
+		t.Errorf("Unexpected claim set %+v for issued token", claimSet)
+	}
+
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"net/http"
+	"time"
+)
+
+// AMRClaim is the claim listing the methods used to authenticate the account a JWT
+// was issued to, as described in RFC 8176.
+const AMRClaim = "amr"
+
+// The authentication methods LoginHandler records in the amr claim.
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+)
+
+var ErrMFARequired = errors.New(http.StatusForbidden, "This requires logging in with two-factor authentication")
+
+// TOTPConfirmation is the request body accepted by TOTPConfirmHandler.
+type TOTPConfirmation struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodes is the response body of TOTPConfirmHandler.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// MFA is an AuthCheck that grants access if the request's JWT was issued after logging in
+// with a second factor, i.e., its amr claim includes AMRMFA. The Super account passes too.
+// Combine it with other checks using CheckAll:
+//	kami.Delete("/records/:id", auth.CheckAll(auth.HasRole("admin"), auth.MFA).Then(deleteRecord))
+func MFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	var acct account.Account
+	var claims struct {
+		AMR []string `json:"amr"`
+	}
+
+	if err := GetAccount(ctx, &acct); err != nil {
+		return err
+	} else if acct.Super() {
+		return nil
+	} else if acct.Nobody() {
+		return ErrNotLoggedIn
+	} else if err := GetClaims(ctx, &claims); err != nil {
+		return ErrMFARequired
+	}
+
+	for _, method := range claims.AMR {
+		if method == AMRMFA {
+			return nil
+		}
+	}
+
+	return ErrMFARequired
+
+}
+
+// TOTPEnrollHandler is a kami.HandlerFunc that starts setting up two-factor authentication
+// for the logged-in account, as described in Account.EnrollTOTP. It responds with an
+// account.TOTPEnrollment. Install it on whatever route you like:
+//	kami.Post("/totp", auth.TOTPEnrollHandler)
+func TOTPEnrollHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+	var conf config.Global
+
+	if err := GetAccount(ctx, &acct); err != nil {
+		rest.WriteJSON(w, err)
+		return
+	} else if acct.Super() || acct.Nobody() {
+		rest.WriteJSON(w, ErrNotLoggedIn)
+		return
+	} else if err := config.Get(ctx, &conf); err != nil {
+		rest.WriteJSON(w, err)
+		return
+	}
+
+	issuer := conf.TOTPIssuer
+	if issuer == "" {
+		issuer = conf.TokenIssuer
+	}
+	if issuer == "" {
+		issuer = r.Host
+	}
+
+	if enrollment, err := acct.EnrollTOTP(issuer); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Save(ctx, &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, enrollment)
+	}
+
+}
+
+// TOTPConfirmHandler is a kami.HandlerFunc that finishes setting up two-factor authentication
+// for the logged-in account, as described in Account.ConfirmTOTP. It expects a JSON body shaped
+// like TOTPConfirmation and responds with RecoveryCodes. Install it on whatever route you like:
+//	kami.Put("/totp", auth.TOTPConfirmHandler)
+func TOTPConfirmHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+	var confirmation TOTPConfirmation
+
+	if err := GetAccount(ctx, &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if acct.Super() || acct.Nobody() {
+		rest.WriteJSON(w, ErrNotLoggedIn)
+	} else if err := rest.ReadJSON(r, &confirmation); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if codes, err := acct.ConfirmTOTP(confirmation.Code, time.Now()); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Save(ctx, &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &RecoveryCodes{codes})
+	}
+
+}
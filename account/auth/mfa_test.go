@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/audit"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMFA(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	handler := Check(MFA).Then(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	acct := account.Account{Email: "foo@bar.com"}
+
+	w := test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Account(&acct).
+		Claims(map[string]interface{}{AMRClaim: []string{AMRPassword}}).
+		Run(ctx, handler)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http.StatusForbidden for a password-only login, got %d", w.Code)
+	}
+
+	w = test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Account(&acct).
+		Claims(map[string]interface{}{AMRClaim: []string{AMRPassword, AMROTP, AMRMFA}}).
+		Run(ctx, handler)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK for a two-factor login, got %d", w.Code)
+	}
+
+}
+
+func TestCheckLoginWithTOTP(t *testing.T) {
+
+	var acct account.Account
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	ctx = test.WithConfig(ctx, map[string]interface{}{"AuthSecret": "foo"})
+	account.Get(ctx, "foo@bar.com", &acct)
+
+	if _, err := CheckLogin(ctx, &acct, "foobar", "123456"); err != account.ErrTOTPNotEnrolled {
+		t.Errorf("Expected ErrTOTPNotEnrolled, got %v", err)
+	}
+
+	now := time.Now()
+	acct.EnrollTOTP("Example")
+	codes, _ := acct.ConfirmTOTP(totpCodeForTest(&acct, now.Add(-30*time.Second)), now.Add(-30*time.Second))
+	account.Save(ctx, &acct)
+
+	if amr, err := CheckLogin(ctx, &acct, "foobar", ""); err != nil || len(amr) != 1 || amr[0] != AMRPassword {
+		t.Errorf("Expected a password-only login, got %v %v", amr, err)
+	}
+
+	if _, err := CheckLogin(ctx, &acct, "foobar", "wat"); err != account.ErrInvalidTOTPCode {
+		t.Errorf("Expected ErrInvalidTOTPCode, got %v", err)
+	}
+
+	if amr, err := CheckLogin(ctx, &acct, "foobar", codes[0]); err != nil || len(amr) != 2 || amr[1] != AMRMFA {
+		t.Errorf("Expected a login with a recovery code, got %v %v", amr, err)
+	}
+
+	account.Get(ctx, "foo@bar.com", &acct)
+	if len(acct.RecoveryCodes) != account.RecoveryCodeCount-1 {
+		t.Errorf("Expected the recovery code to be used up, got %d left", len(acct.RecoveryCodes))
+	}
+
+	// using up the code is recorded as part of the login, not as a change to the account
+	var records []audit.Record
+	q := datastore.NewQuery(audit.Entity).Filter("Target =", "foo@bar.com").Filter("Action =", audit.AccountLogin)
+	for i := 0; i < 20 && len(records) == 0; i++ {
+		if _, err := q.GetAll(ctx, &records); err != nil {
+			t.Fatalf("Unexpected error %s reading the audit log", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(records) != 1 {
+		t.Errorf("Expected 1 login audit record, got %+v", records)
+	}
+
+}
+
+// totpCodeForTest computes the TOTP code for acct at now, as authenticator apps do.
+func totpCodeForTest(acct *account.Account, now time.Time) string {
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(now.Unix()/30))
+
+	mac := hmac.New(sha1.New, acct.TOTPSecret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+
+}
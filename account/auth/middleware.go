@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"encoding/json"
 	"github.com/guregu/kami"
 	"github.com/the-information/ori/account"
 	"github.com/the-information/ori/config"
@@ -20,6 +21,7 @@ var (
 	ErrCannotGetAccount          = errors.New(http.StatusUnauthorized, "There was an error retrieving the account to be authenticated. Please try again.")
 	ErrCannotGetClaimSet         = errors.New(http.StatusUnauthorized, "There was an error retrieving the claim set to be authenticated. Please try again.")
 	ErrRoleMissing               = errors.New(http.StatusForbidden, "The specified account does not have the specified role")
+	ErrOrgRoleMissing            = errors.New(http.StatusForbidden, "The specified account does not have the specified role in that organization")
 	ErrRoleNotInScope            = errors.New(http.StatusUnauthorized, "The authentication token does not have the specified role in scope")
 	ErrNotInAuthContext          = errors.New(http.StatusInternalServerError, "That context object was not run through auth.Middleware!")
 	ErrAccountIDDoesNotMatch     = errors.New(http.StatusForbidden, "Account ID does not match route parameter")
@@ -28,33 +30,99 @@ var (
 )
 
 // Middleware sets up the request context so account information can be
-// retrieved with auth.GetAccount(ctx). It panics if config.Get(ctx) fails.
+// retrieved with auth.GetAccount(ctx). Requests are authorized by a JWT in the
+// Authorization header, or by an API key in the X-API-Key header or in the
+// Authorization header as "Key <key>". Tokens and keys belonging to disabled
+// accounts are rejected with DisabledAccountError, and JWTs whose Session has been
+// revoked with RevokedSessionError. It panics if config.Get(ctx) fails
+// or if the configured AuthKeys, SigningKey or ClockSkew cannot be parsed.
 func Middleware(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
 
 	var conf config.Global
+	var verifier *Verifier
 
 	if err := config.Get(ctx, &conf); err != nil {
 		panic("Could not get AuthSecret: " + err.Error())
-	} else if claimSet, err := Decode([]byte(r.Header.Get("Authorization")), []byte(conf.AuthSecret)); err != nil {
+	} else if v, err := NewVerifier(&conf); err != nil {
+		panic("Could not read auth keys: " + err.Error())
+	} else {
+		verifier = v
+	}
+
+	// remember who is asking, so Issue can record it with the session
+	ctx = context.WithValue(ctx, internal.ClientContextKey, clientFromRequest(r))
+
+	if key := apiKeyFromRequest(r); key != "" {
+		if keyCtx, err := apiKeyContext(ctx, key); err != nil {
+			rest.WriteJSON(w, &rest.Response{
+				Code: http.StatusUnauthorized,
+				Body: &rest.Message{Message: "Could not retrieve account for API key: " + err.Error()},
+			})
+			return nil
+		} else {
+			return keyCtx
+		}
+	}
+
+	claims, special, err := verifier.decode([]byte(r.Header.Get("Authorization")))
+	if err != nil {
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, err)
 		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, err)
 		return context.WithValue(ctx, internal.AuthContextKey, err)
-	} else if claimSet == SuperClaimSet {
+	}
+
+	// keep the raw claims around so GetClaims can decode them on demand
+	ctx = context.WithValue(ctx, internal.ClaimsContextKey, claims.payload)
+
+	if special == SuperClaimSet {
 		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, SuperClaimSet)
 		return context.WithValue(ctx, internal.AuthContextKey, &account.Super)
-	} else if claimSet == NobodyClaimSet {
+	} else if special == NobodyClaimSet {
 		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, NobodyClaimSet)
 		return context.WithValue(ctx, internal.AuthContextKey, &account.Nobody)
+	} else if revoked, err := isRevoked(ctx, claims); err != nil {
+		log.Errorf(ctx, "Error checking revocation status of JWT: %s", err.Error())
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, err)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, err)
+		return context.WithValue(ctx, internal.AuthContextKey, err)
+	} else if revoked {
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, RevokedJWTError)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, RevokedJWTError)
+		return context.WithValue(ctx, internal.AuthContextKey, RevokedJWTError)
+	} else if claims.Purpose != nil {
+		// tokens issued for a specific purpose, like resetting a password, don't log anyone in
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, PurposeJWTError)
+		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, PurposeJWTError)
+		return context.WithValue(ctx, internal.AuthContextKey, PurposeJWTError)
 	} else {
 
 		var acct account.Account
-		if err := account.Get(ctx, claimSet.Sub, &acct); err != nil {
+		if err := account.Get(ctx, claims.Sub, &acct); err != nil {
 			rest.WriteJSON(w, &rest.Response{
 				Code: http.StatusUnauthorized,
-				Body: &rest.Message{"Could not retrieve account with key " + claimSet.Sub + ": " + err.Error()},
+				Body: &rest.Message{Message: "Could not retrieve account with key " + claims.Sub + ": " + err.Error()},
 			})
 			return nil
+		} else if acct.Deleted() {
+			ctx = context.WithValue(ctx, internal.ClaimsContextKey, DeletedAccountError)
+			ctx = context.WithValue(ctx, internal.ClaimSetContextKey, DeletedAccountError)
+			return context.WithValue(ctx, internal.AuthContextKey, DeletedAccountError)
+		} else if acct.Disabled {
+			ctx = context.WithValue(ctx, internal.ClaimsContextKey, DisabledAccountError)
+			ctx = context.WithValue(ctx, internal.ClaimSetContextKey, DisabledAccountError)
+			return context.WithValue(ctx, internal.AuthContextKey, DisabledAccountError)
+		} else if revoked, err := checkSession(ctx, claims); err != nil {
+			log.Errorf(ctx, "Error checking session of JWT: %s", err.Error())
+			ctx = context.WithValue(ctx, internal.ClaimsContextKey, err)
+			ctx = context.WithValue(ctx, internal.ClaimSetContextKey, err)
+			return context.WithValue(ctx, internal.AuthContextKey, err)
+		} else if revoked {
+			ctx = context.WithValue(ctx, internal.ClaimsContextKey, RevokedSessionError)
+			ctx = context.WithValue(ctx, internal.ClaimSetContextKey, RevokedSessionError)
+			return context.WithValue(ctx, internal.AuthContextKey, RevokedSessionError)
 		} else {
-			ctx = context.WithValue(ctx, internal.ClaimSetContextKey, claimSet)
+			// GetClaimSet builds the full claim set from these only if it's asked for
+			ctx = context.WithValue(ctx, internal.ClaimSetContextKey, claims)
 			return context.WithValue(ctx, internal.AuthContextKey, &acct)
 		}
 
@@ -84,30 +152,29 @@ func Super(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 }
 
 // HasRole returns an AuthCheck that grants access under the following conditions:
-//	- The account specified by the token has the specified role.
-//	- The token itself has that role in scope.
+//	- The account specified by the token has the specified role, or a role that implies it.
+//	- The token itself has that role, or a role that implies it, in scope.
 //	- The token is not used up.
 func HasRole(role string) AuthCheck {
 
 	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 
 		var acct account.Account
-		var claimSet jws.ClaimSet
 
 		if err := GetAccount(ctx, &acct); err != nil {
 			// we can't get the user, so we can't check authentication status.
 			log.Errorf(ctx, "Error getting account for authentication: %s", err.Error())
 			return ErrCannotGetAccount
-		} else if err := GetClaimSet(ctx, &claimSet); err != nil {
+		} else if claims, err := getTokenClaims(ctx); err != nil {
 			log.Errorf(ctx, "Error getting claim set for authentication: %s", err.Error())
 			return ErrCannotGetClaimSet
-		} else if !acct.HasRole(role) {
+		} else if !acct.HasRole(ctx, role) {
 			// the account making the request does not have the specified role.
 			return ErrRoleMissing
-		} else if !roleInScope(ctx, role) {
+		} else if !roleInScope(ctx, claims, role) {
 			// the JWT claimset for this request does not have the specified role in its scope.
 			return ErrRoleNotInScope
-		} else if err = UseClaimSet(ctx, &claimSet); err == ErrClaimSetUsedUp {
+		} else if err = useClaims(ctx, claims); err == ErrClaimSetUsedUp {
 			// The claimset for this request has been all used up.
 			return err
 		} else if err != nil {
@@ -121,19 +188,60 @@ func HasRole(role string) AuthCheck {
 
 }
 
-func roleInScope(ctx context.Context, role string) bool {
+// HasOrgRole returns an AuthCheck that grants access if the account specified by the token
+// is a member of the organization whose ID is in route parameter paramName, and has role
+// there, or a role that implies it, and the token has role in its scope, just as for HasRole.
+// The Super account passes too. So, for instance,
+//	kami.Delete("/orgs/:org/projects/:id", auth.Check(auth.HasOrgRole("org", "admin")).Then(deleteProject))
+// only lets an organization's admins delete its projects.
+func HasOrgRole(paramName, role string) AuthCheck {
 
-	switch t := ctx.Value(internal.ClaimSetContextKey).(type) {
-	case *jws.ClaimSet:
-		roles := strings.Split(t.Scope, ",")
-		for _, scope := range roles {
-			if scope == AllScope || scope == role {
-				return true
-			}
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+		var acct account.Account
+		var membership account.Membership
+
+		if err := GetAccount(ctx, &acct); err != nil {
+			log.Errorf(ctx, "Error getting account for authentication: %s", err.Error())
+			return ErrCannotGetAccount
+		} else if acct.Super() {
+			return nil
+		} else if acct.Nobody() {
+			return ErrOrgRoleMissing
+		} else if orgID := rest.Param(ctx, paramName); orgID == "" {
+			return ErrOrgRoleMissing
+		} else if err := account.GetMembership(ctx, orgID, acct.Email, &membership); err == account.ErrNotMember {
+			return ErrOrgRoleMissing
+		} else if err != nil {
+			return err
+		} else if !acct.HasOrgRole(ctx, &membership, role) {
+			return ErrOrgRoleMissing
+		} else if claims, err := getTokenClaims(ctx); err != nil {
+			log.Errorf(ctx, "Error getting claim set for authentication: %s", err.Error())
+			return ErrCannotGetClaimSet
+		} else if !roleInScope(ctx, claims, role) {
+			// as with HasRole, a token scoped down to fewer roles can't use the rest
+			return ErrRoleNotInScope
+		} else if err = useClaims(ctx, claims); err == ErrClaimSetUsedUp {
+			return err
+		} else if err != nil {
+			return errors.New(http.StatusBadRequest, err.Error())
+		} else {
+			return nil
 		}
+
 	}
 
-	return false
+}
+
+func roleInScope(ctx context.Context, claims *tokenClaims, role string) bool {
+
+	graph, err := account.GetRoleGraph(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Error getting role graph for authentication: %s", err.Error())
+		return false
+	}
+	return scopeIncludes(graph, strings.Split(claims.Scope, ","), role)
 
 }
 
@@ -256,6 +364,52 @@ func GetClaimSet(ctx context.Context, claimSet *jws.ClaimSet) error {
 	case *jws.ClaimSet:
 		*claimSet = *t
 		return nil
+	case *tokenClaims:
+		if c, err := t.claimSet(); err != nil {
+			return err
+		} else {
+			*claimSet = *c
+			return nil
+		}
+	default:
+		return ErrNotInAuthContext
+	}
+
+}
+
+// getTokenClaims retrieves the claims of the authorized token for ctx, whether
+// auth.Middleware decoded them from a JWT or they came with a jws.ClaimSet, as
+// they do for API keys.
+func getTokenClaims(ctx context.Context) (*tokenClaims, error) {
+
+	switch t := ctx.Value(internal.ClaimSetContextKey).(type) {
+	case error:
+		return nil, t
+	case *jws.ClaimSet:
+		return claimsFromClaimSet(t), nil
+	case *tokenClaims:
+		return t, nil
+	default:
+		return nil, ErrNotInAuthContext
+	}
+
+}
+
+// GetClaims decodes the claims of the authorized JWT for ctx into claims, which should
+// be a pointer to a struct with a json tag for each claim it wants, such as:
+//	var myClaims struct {
+//		Sub    string `json:"sub"`
+//		UserID int64  `json:"u"`
+//	}
+//	err := auth.GetClaims(ctx, &myClaims)
+// It returns the error if one was encountered.
+func GetClaims(ctx context.Context, claims interface{}) error {
+
+	switch t := ctx.Value(internal.ClaimsContextKey).(type) {
+	case error:
+		return t
+	case []byte:
+		return json.Unmarshal(t, claims)
 	default:
 		return ErrNotInAuthContext
 	}
@@ -268,20 +422,25 @@ const ClaimSetCounterShards = 50
 // UseClaimSet attempts to consume a claimSet. It returns an error if
 // the claimset could not be consumed.
 func UseClaimSet(ctx context.Context, claimSet *jws.ClaimSet) error {
+	return useClaims(ctx, claimsFromClaimSet(claimSet))
+}
+
+// useClaims does the work of UseClaimSet.
+func useClaims(ctx context.Context, claims *tokenClaims) error {
 
-	if _, ok := claimSet.PrivateClaims["u"]; !ok {
+	if claims.Uses == nil {
 		// This claimset lacks a usage counter, so it's not consumable.
 		return nil
-	} else if _, ok := claimSet.PrivateClaims["jti"]; !ok {
+	} else if claims.JTI == "" {
 		// no JTI, so no way to check
 		return ErrInvalidConsumableClaimSet
-	} else if counter, err := shard.NewCounter(ClaimSetCounterEntity, claimSet.PrivateClaims["jti"].(string), ClaimSetCounterShards); err != nil {
+	} else if counter, err := shard.NewCounter(ClaimSetCounterEntity, claims.JTI, ClaimSetCounterShards); err != nil {
 		return err
 	} else if err := counter.Increment(ctx, 1); err != nil {
 		return err
 	} else if uses, err := counter.Value(ctx); err != nil {
 		return err
-	} else if uses > int64(claimSet.PrivateClaims["u"].(float64)) {
+	} else if uses > int64(*claims.Uses) {
 		return ErrClaimSetUsedUp
 	} else {
 		return nil
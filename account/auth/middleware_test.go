@@ -2,6 +2,7 @@ package auth
 
 import (
 	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
 	"github.com/the-information/ori/internal"
 	"github.com/the-information/ori/test"
 	"golang.org/x/net/context"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestMiddlewarePanic(t *testing.T) {
@@ -138,6 +140,23 @@ func TestMiddleware(t *testing.T) {
 		t.Errorf("Unexpected account on retrieval: %+v", acct)
 	}
 
+	// disabled account
+	var disabled account.Account
+	account.Get(realCtx, "foo@bar.com", &disabled)
+	disabled.Disable("spam")
+	account.Save(realCtx, &disabled)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", test.JWT(&jws.ClaimSet{Sub: "foo@bar.com"}, "foo"))
+
+	resultCtx = Middleware(realCtx, w, r)
+	if resultCtx == nil {
+		t.Errorf("Expected Middleware not to terminate (i.e. to return another context), but it terminated")
+	} else if err = GetAccount(resultCtx, &acct); err != DisabledAccountError {
+		t.Errorf("Expected DisabledAccountError for a disabled account, but got %v", err)
+	}
+
 }
 
 func TestHasRole(t *testing.T) {
@@ -196,6 +215,44 @@ func TestHasRole(t *testing.T) {
 
 }
 
+func TestGetClaims(t *testing.T) {
+
+	var claims struct {
+		Sub    string `json:"sub"`
+		UserID int64  `json:"u"`
+	}
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	if err := GetClaims(ctx, &claims); err != ErrNotInAuthContext {
+		t.Errorf("Expected ErrNotInAuthContext outside the middleware, but got %s", err)
+	}
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	ctx = test.WithConfig(ctx, map[string]interface{}{"AuthSecret": "foo"})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", test.JWT(&jws.ClaimSet{
+		Sub:           "foo@bar.com",
+		Exp:           time.Now().Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"u": 7},
+	}, "foo"))
+
+	if err := GetClaims(Middleware(ctx, w, r), &claims); err != nil {
+		t.Errorf("Unexpected error %s from GetClaims", err)
+	} else if claims.Sub != "foo@bar.com" || claims.UserID != 7 {
+		t.Errorf("Bad claims from GetClaims: %+v", claims)
+	}
+
+	r.Header.Set("Authorization", "wrong")
+	if err := GetClaims(Middleware(ctx, w, r), &claims); err != InvalidJWTError {
+		t.Errorf("Expected InvalidJWTError from GetClaims, but got %s", err)
+	}
+
+}
+
 func TestUseClaimSet(t *testing.T) {
 
   ctx, done, _ := aetest.NewContext()
@@ -233,3 +290,81 @@ func TestUseClaimSet(t *testing.T) {
     t.Errorf("Expected ErrClaimSetUsedUp on used-up claimset, but got %s", err)
   }
 }
+
+func TestHasRoleWithRoleGraph(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	acct := account.Account{Email: "foo@bar.com", Roles: []string{"admin"}}
+	conf := config.Global{AuthSecret: "foo", RoleGraph: `{"admin":["editor"],"editor":["viewer"]}`}
+	handler := Check(HasRole("viewer")).Then(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// admin implies viewer, both on the account and in scope
+	w := test.NewState().Config(&conf).Account(&acct).Scope("admin").Run(ctx, handler)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// but viewer doesn't imply admin
+	w = test.NewState().Config(&conf).Account(&acct).Scope("viewer").Run(ctx, Check(HasRole("admin")).Then(handler))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized, got %d", w.Code)
+	}
+
+}
+
+func TestHasOrgRole(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	acct := account.Account{Email: "member@bar.com"}
+	conf := config.Global{AuthSecret: "foo", RoleGraph: `{"admin":["viewer"]}`}
+	handler := Check(HasOrgRole("org", "viewer")).Then(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	account.New(ctx, "member@bar.com", "foobar")
+	account.NewOrg(ctx, "acme", "Acme Inc.")
+	account.NewOrg(ctx, "initech", "Initech")
+	if _, err := account.SetMembership(ctx, "acme", "member@bar.com", []string{"admin"}); err != nil {
+		t.Fatalf("Unexpected error adding member: %s", err)
+	}
+
+	// admin in acme implies viewer there
+	w := test.NewState().Config(&conf).Account(&acct).Scope(AllScope).Param("org", "acme").Run(ctx, handler)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// but the account isn't a member of initech at all
+	w = test.NewState().Config(&conf).Account(&acct).Scope(AllScope).Param("org", "initech").Run(ctx, handler)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http.StatusForbidden, got %d", w.Code)
+	}
+
+	// and viewer doesn't imply admin
+	account.SetMembership(ctx, "acme", "member@bar.com", []string{"viewer"})
+	w = test.NewState().Config(&conf).Account(&acct).Scope(AllScope).Param("org", "acme").Run(ctx, Check(HasOrgRole("org", "admin")).Then(handler))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http.StatusForbidden, got %d", w.Code)
+	}
+
+	// a token scoped down to viewer, such as a child token, can't act as an admin even
+	// where the account is one
+	account.SetMembership(ctx, "acme", "member@bar.com", []string{"admin"})
+	w = test.NewState().Config(&conf).Account(&acct).Scope("viewer").Param("org", "acme").Run(ctx, Check(HasOrgRole("org", "admin")).Then(handler))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized, got %d", w.Code)
+	}
+
+	// but it can still use the viewer role it has in scope
+	w = test.NewState().Config(&conf).Account(&acct).Scope("viewer").Param("org", "acme").Run(ctx, handler)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, got %d: %s", w.Code, w.Body.String())
+	}
+
+}
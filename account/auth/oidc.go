@@ -0,0 +1,447 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownOIDCProvider     = errors.New(http.StatusBadRequest, "There is no identity provider with that name")
+	ErrInvalidIDToken          = errors.New(http.StatusUnauthorized, "The ID token is invalid")
+	ErrNoLinkedAccount         = errors.New(http.StatusForbidden, "No account is linked to that identity, and one can't be created for it")
+	ErrOIDCProviderUnavailable = errors.New(http.StatusBadGateway, "The identity provider's keys could not be retrieved")
+	ErrBadOIDCConfig           = errors.New(http.StatusInternalServerError, "The identity provider configuration for this app is invalid")
+)
+
+// JWKSLifetime is how long the keys fetched from an identity provider are used before
+// they are fetched again. They are also fetched again, at most once a minute, when an
+// ID token is signed with a key that isn't among them, so rotated keys are picked up quickly.
+var JWKSLifetime = time.Hour
+
+const jwksRefetchInterval = time.Minute
+
+// OIDCHTTPClient returns the HTTP client used to fetch identity providers' keys.
+// Tests outside App Engine can replace it to talk to a local stand-in issuer.
+var OIDCHTTPClient = func(ctx context.Context) *http.Client {
+	return urlfetch.Client(ctx)
+}
+
+// OIDCProvider holds the settings for an OpenID Connect identity provider, as stored
+// in config.Global.OIDCProviders. For instance,
+//	{"acme": {"issuer": "https://login.acme.com", "clientID": "ori-app", "autoCreate": true}}
+// accepts ID tokens from Acme's identity provider issued to ori-app.
+type OIDCProvider struct {
+	// Issuer is the provider's issuer identifier, which its ID tokens carry as their iss claim.
+	Issuer string `json:"issuer"`
+	// ClientID is the app's client ID at the provider, which its ID tokens must be issued to.
+	ClientID string `json:"clientID"`
+	// JWKSURL is where the provider publishes its keys. If it is empty, it is found through
+	// OpenID Connect discovery, at /.well-known/openid-configuration under Issuer.
+	JWKSURL string `json:"jwksURL,omitempty"`
+	// AutoCreate allows accounts to be created for identities that aren't linked to one
+	// and whose email addresses don't belong to one yet.
+	AutoCreate bool `json:"autoCreate,omitempty"`
+	// Roles are given to accounts created for the provider's identities.
+	Roles []string `json:"roles,omitempty"`
+	// TrustMFA makes logins whose ID tokens list mfa in their amr claim count as two-factor
+	// logins, so that auth.MFA accepts them. Set it only for providers whose two-factor
+	// authentication you trust; otherwise the amr claim of their ID tokens is ignored.
+	TrustMFA bool `json:"trustMFA,omitempty"`
+}
+
+// OIDCCredentials is the request body accepted by OIDCLoginHandler.
+type OIDCCredentials struct {
+	// Provider is the name of the provider in config.Global.OIDCProviders.
+	Provider string `json:"provider"`
+	// IDToken is the ID token the provider issued.
+	IDToken string `json:"idToken"`
+	// Nonce, if not empty, must match the nonce claim of the ID token. Pass the nonce the
+	// authentication request was made with, to keep ID tokens from being replayed.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// IDTokenClaims holds the claims of an OpenID Connect ID token that ori uses.
+type IDTokenClaims struct {
+	Iss           string   `json:"iss"`
+	Sub           string   `json:"sub"`
+	Aud           audience `json:"aud"`
+	Azp           string   `json:"azp,omitempty"`
+	Exp           int64    `json:"exp"`
+	Iat           int64    `json:"iat"`
+	Nbf           int64    `json:"nbf,omitempty"`
+	Nonce         string   `json:"nonce,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	AMR           []string `json:"amr,omitempty"`
+}
+
+// audience is the aud claim, which may be a single string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+
+}
+
+func (a audience) contains(s string) bool {
+
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+
+}
+
+// ParseOIDCProviders reads the identity providers from conf.OIDCProviders.
+func ParseOIDCProviders(conf *config.Global) (map[string]*OIDCProvider, error) {
+
+	providers := map[string]*OIDCProvider{}
+	if conf.OIDCProviders == "" {
+		return providers, nil
+	} else if err := json.Unmarshal([]byte(conf.OIDCProviders), &providers); err != nil {
+		return nil, ErrBadOIDCConfig
+	}
+
+	for _, provider := range providers {
+		if provider == nil || provider.Issuer == "" || provider.ClientID == "" {
+			return nil, ErrBadOIDCConfig
+		}
+	}
+
+	return providers, nil
+
+}
+
+// VerifyIDToken checks that idToken was signed by one of p's keys and issued by p to
+// p.ClientID, that it is current, allowing leeway for clock skew, and, if nonce is not
+// empty, that it carries nonce. It returns the token's claims.
+func VerifyIDToken(ctx context.Context, p *OIDCProvider, idToken, nonce string, leeway time.Duration) (*IDTokenClaims, error) {
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, InvalidJWTError
+	}
+
+	var header jws.Header
+	if err := readHeader([]byte(parts[0]), &header); err != nil {
+		return nil, err
+	} else if header.Algorithm != "RS256" && header.Algorithm != "ES256" {
+		// providers sign with their keys; anything else, HS256 included, can't be checked
+		return nil, InvalidAlgorithmError
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := p.keys(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	} else if len(keys) == 0 {
+		return nil, UnknownKeyError
+	} else if err := verifySignature(header.Algorithm, []byte(parts[0]+"."+parts[1]), sig, nil, keys); err != nil {
+		return nil, err
+	}
+
+	var claims IDTokenClaims
+	if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	skew := int64(leeway / time.Second)
+
+	if claims.Exp+skew <= now {
+		return nil, ExpiredJWTError
+	} else if claims.Nbf != 0 && claims.Nbf-skew > now {
+		return nil, PrematureJWTError
+	} else if claims.Iat-skew > now {
+		return nil, FutureJWTError
+	} else if claims.Iss != p.Issuer {
+		return nil, InvalidIssuerError
+	} else if !claims.Aud.contains(p.ClientID) || (len(claims.Aud) > 1 && claims.Azp != p.ClientID) {
+		return nil, InvalidAudienceError
+	} else if claims.Sub == "" {
+		return nil, InvalidJWTError
+	} else if nonce != "" && claims.Nonce != nonce {
+		return nil, InvalidNonceError
+	}
+
+	return &claims, nil
+
+}
+
+// LinkOIDCAccount returns the account linked to the identity claims describes. If there is
+// none, it links the account whose email address matches the identity's, as long as both the
+// provider and the account have verified it and the account doesn't use TOTP, which logging
+// in through the provider would get around. If there is no such account either, it creates
+// one, verified and with p.Roles, if p.AutoCreate is set. Otherwise it returns ErrNoLinkedAccount.
+func LinkOIDCAccount(ctx context.Context, p *OIDCProvider, claims *IDTokenClaims) (*account.Account, error) {
+
+	var acct account.Account
+
+	if email, err := account.FindIdentity(ctx, claims.Iss, claims.Sub); err == nil {
+		if err := account.Get(ctx, email, &acct); err == nil {
+			return &acct, nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, ErrNoLinkedAccount
+	}
+
+	if err := account.Get(ctx, claims.Email, &acct); err == datastore.ErrNoSuchEntity {
+
+		if !p.AutoCreate {
+			return nil, ErrNoLinkedAccount
+		}
+
+		created, err := account.NewWithoutPassword(ctx, claims.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		created.Roles = p.Roles
+		created.Verified = true
+		created.VerifiedAt = time.Now()
+		if err := account.Save(ctx, created); err != nil {
+			return nil, err
+		}
+		acct = *created
+
+	} else if err != nil {
+		return nil, err
+	} else if !acct.Verified || acct.TOTPEnabled {
+		return nil, ErrNoLinkedAccount
+	}
+
+	if err := account.LinkIdentity(ctx, acct.Email, claims.Iss, claims.Sub); err != nil {
+		return nil, err
+	}
+	return &acct, nil
+
+}
+
+// OIDCLoginHandler is a kami.HandlerFunc that exchanges an ID token from one of the identity
+// providers in config.Global.OIDCProviders for a JWT, as LoginHandler does for a password.
+// It expects a JSON body shaped like OIDCCredentials and responds with a Token. The account
+// is found or created as described in LinkOIDCAccount. The JWT has no amr claim, unless the
+// provider's TrustMFA is set and the ID token's amr claim lists mfa, in which case it lists
+// AMRMFA. Install it on whatever route you like:
+//	kami.Post("/login/oidc", auth.OIDCLoginHandler)
+func OIDCLoginHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var creds OIDCCredentials
+	var conf config.Global
+	var leeway time.Duration
+
+	if err := rest.ReadJSON(r, &creds); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+		return
+	} else if err := config.Get(ctx, &conf); err != nil {
+		rest.WriteJSON(w, err)
+		return
+	} else if conf.ClockSkew != "" {
+		if leeway, err = time.ParseDuration(conf.ClockSkew); err != nil || leeway < 0 {
+			rest.WriteJSON(w, ErrBadTokenConfig)
+			return
+		}
+	}
+
+	providers, err := ParseOIDCProviders(&conf)
+	if err != nil {
+		rest.WriteJSON(w, err)
+		return
+	}
+
+	provider := providers[creds.Provider]
+	if provider == nil {
+		rest.WriteJSON(w, ErrUnknownOIDCProvider)
+	} else if claims, err := VerifyIDToken(ctx, provider, creds.IDToken, creds.Nonce, leeway); err != nil {
+		log.Warningf(ctx, "%s: rejected ID token: %s", creds.Provider, err)
+		if err == ErrOIDCProviderUnavailable {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, ErrInvalidIDToken)
+		}
+	} else if acct, err := LinkOIDCAccount(ctx, provider, claims); err != nil {
+		rest.WriteJSON(w, err)
+	} else if acct.Deleted() {
+		rest.WriteJSON(w, account.ErrAccountDeleted)
+	} else if acct.Disabled {
+		rest.WriteJSON(w, ErrAccountDisabled)
+	} else if token, err := IssueWithAMR(ctx, acct, provider.amr(claims)); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, token)
+	}
+
+}
+
+// amr returns the authentication methods to record for a login with an ID token bearing
+// claims, as described in OIDCLoginHandler.
+func (p *OIDCProvider) amr(claims *IDTokenClaims) []string {
+
+	if !p.TrustMFA {
+		return nil
+	}
+
+	for _, method := range claims.AMR {
+		if method == AMRMFA {
+			return []string{AMRMFA}
+		}
+	}
+	return nil
+
+}
+
+type providerKeys struct {
+	byKid     map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+var oidcCache = struct {
+	sync.Mutex
+	jwksURLs map[string]string
+	keys     map[string]*providerKeys
+}{jwksURLs: map[string]string{}, keys: map[string]*providerKeys{}}
+
+// keys returns p's keys with ID kid, or all its keys if kid is empty, fetching them
+// if they haven't been yet, have expired or don't include kid.
+func (p *OIDCProvider) keys(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+
+	jwksURL, err := p.jwksURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	oidcCache.Lock()
+	cached := oidcCache.keys[jwksURL]
+	oidcCache.Unlock()
+
+	if cached == nil ||
+		now.Sub(cached.fetchedAt) > JWKSLifetime ||
+		(cached.byKid[kid] == nil && kid != "" && now.Sub(cached.fetchedAt) > jwksRefetchInterval) {
+
+		var set JWKSet
+		if err := fetchJSON(ctx, jwksURL, &set); err != nil {
+			log.Errorf(ctx, "Error fetching keys from %s: %s", jwksURL, err)
+			if cached == nil {
+				return nil, ErrOIDCProviderUnavailable
+			}
+			// make do with the keys we have
+		} else {
+
+			cached = &providerKeys{byKid: map[string]crypto.PublicKey{}, fetchedAt: now}
+			for _, jwk := range set.Keys {
+				if jwk.Use != "" && jwk.Use != "sig" {
+					continue
+				} else if key, err := jwk.PublicKey(); err == nil {
+					cached.byKid[jwk.Kid] = key
+				}
+			}
+
+			oidcCache.Lock()
+			oidcCache.keys[jwksURL] = cached
+			oidcCache.Unlock()
+
+		}
+
+	}
+
+	var keys []crypto.PublicKey
+	for id, key := range cached.byKid {
+		if kid == "" || id == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+
+}
+
+// jwksURL returns p.JWKSURL, or else the jwks_uri from p's discovery document.
+func (p *OIDCProvider) jwksURL(ctx context.Context) (string, error) {
+
+	if p.JWKSURL != "" {
+		return p.JWKSURL, nil
+	}
+
+	oidcCache.Lock()
+	jwksURL := oidcCache.jwksURLs[p.Issuer]
+	oidcCache.Unlock()
+
+	if jwksURL != "" {
+		return jwksURL, nil
+	}
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+
+	discoveryURL := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := fetchJSON(ctx, discoveryURL, &discovery); err != nil {
+		log.Errorf(ctx, "Error fetching %s: %s", discoveryURL, err)
+		return "", ErrOIDCProviderUnavailable
+	} else if discovery.Issuer != p.Issuer || discovery.JWKSURI == "" {
+		log.Errorf(ctx, "%s describes issuer %q with keys at %q", discoveryURL, discovery.Issuer, discovery.JWKSURI)
+		return "", ErrOIDCProviderUnavailable
+	}
+
+	oidcCache.Lock()
+	oidcCache.jwksURLs[p.Issuer] = discovery.JWKSURI
+	oidcCache.Unlock()
+
+	return discovery.JWKSURI, nil
+
+}
+
+func fetchJSON(ctx context.Context, url string, dst interface{}) error {
+
+	resp, err := OIDCHTTPClient(ctx).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.StatusCode, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubIssuer is a local stand-in for an OpenID Connect identity provider.
+type stubIssuer struct {
+	*httptest.Server
+	key         crypto.Signer
+	jwksFetches int
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Unexpected error %s generating RSA key", err)
+	}
+
+	issuer := &stubIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.URL,
+			"jwks_uri": issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.jwksFetches++
+		jwk, _ := NewJWK(issuer.key.Public())
+		json.NewEncoder(w).Encode(&JWKSet{Keys: []JWK{*jwk}})
+	})
+	issuer.Server = httptest.NewServer(mux)
+
+	OIDCHTTPClient = func(ctx context.Context) *http.Client {
+		return issuer.Client()
+	}
+
+	return issuer
+
+}
+
+func (s *stubIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{Issuer: s.URL, ClientID: "ori-app"}
+}
+
+func (s *stubIssuer) idToken(t *testing.T, sub string, claims map[string]interface{}) string {
+
+	claimSet := &jws.ClaimSet{
+		Iss:           s.URL,
+		Aud:           "ori-app",
+		Sub:           sub,
+		Iat:           time.Now().Unix(),
+		Exp:           time.Now().Add(time.Hour).Unix(),
+		PrivateClaims: claims,
+	}
+
+	jwt, err := EncodeWithKey(claimSet, s.key)
+	if err != nil {
+		t.Fatalf("Unexpected error %s signing ID token", err)
+	}
+	return string(jwt)
+
+}
+
+func TestVerifyIDToken(t *testing.T) {
+
+	issuer := newStubIssuer(t)
+	defer issuer.Close()
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	idToken := issuer.idToken(t, "user-1", map[string]interface{}{
+		"email":          "fed@bar.com",
+		"email_verified": true,
+		"nonce":          "n-0S6_WzA2Mj",
+	})
+
+	if claims, err := VerifyIDToken(ctx, provider, idToken, "n-0S6_WzA2Mj", 0); err != nil {
+		t.Fatalf("Unexpected error verifying ID token: %s", err)
+	} else if claims.Sub != "user-1" || claims.Email != "fed@bar.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	if _, err := VerifyIDToken(ctx, provider, idToken, "wrong", 0); err != InvalidNonceError {
+		t.Errorf("Expected InvalidNonceError, got %v", err)
+	}
+
+	other := *provider
+	other.ClientID = "someone-else"
+	if _, err := VerifyIDToken(ctx, &other, idToken, "", 0); err != InvalidAudienceError {
+		t.Errorf("Expected InvalidAudienceError, got %v", err)
+	}
+
+	other = *provider
+	other.Issuer = "https://elsewhere.example.com"
+	other.JWKSURL = issuer.URL + "/jwks"
+	if _, err := VerifyIDToken(ctx, &other, idToken, "", 0); err != InvalidIssuerError {
+		t.Errorf("Expected InvalidIssuerError, got %v", err)
+	}
+
+	expired, _ := EncodeWithKey(&jws.ClaimSet{
+		Iss: issuer.URL,
+		Aud: "ori-app",
+		Sub: "user-1",
+		Iat: time.Now().Add(-2 * time.Hour).Unix(),
+		Exp: time.Now().Add(-time.Hour).Unix(),
+	}, issuer.key)
+	if _, err := VerifyIDToken(ctx, provider, string(expired), "", 0); err != ExpiredJWTError {
+		t.Errorf("Expected ExpiredJWTError, got %v", err)
+	}
+
+	// an HS256 token "signed" with no secret must not get through
+	forged, _ := Encode(&jws.ClaimSet{
+		Iss: issuer.URL,
+		Aud: "ori-app",
+		Sub: "user-1",
+		Exp: time.Now().Add(time.Hour).Unix(),
+	}, nil)
+	if _, err := VerifyIDToken(ctx, provider, string(forged), "", 0); err != InvalidAlgorithmError {
+		t.Errorf("Expected InvalidAlgorithmError, got %v", err)
+	}
+
+	// a token signed with a key the issuer doesn't publish
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	impostor, _ := EncodeWithKey(&jws.ClaimSet{
+		Iss: issuer.URL,
+		Aud: "ori-app",
+		Sub: "user-1",
+		Exp: time.Now().Add(time.Hour).Unix(),
+	}, otherKey)
+	if _, err := VerifyIDToken(ctx, provider, string(impostor), "", 0); err != UnknownKeyError {
+		t.Errorf("Expected UnknownKeyError, got %v", err)
+	}
+
+	// the keys were fetched once and cached; the unknown key was fetched again too soon to refetch
+	if issuer.jwksFetches != 1 {
+		t.Errorf("Expected the issuer's keys to be fetched once, but they were fetched %d times", issuer.jwksFetches)
+	}
+
+}
+
+func TestAudience(t *testing.T) {
+
+	var claims IDTokenClaims
+
+	if err := json.Unmarshal([]byte(`{"aud":"ori-app"}`), &claims); err != nil || !claims.Aud.contains("ori-app") {
+		t.Errorf("Expected a single audience to be read, got %v, error %v", claims.Aud, err)
+	}
+	if err := json.Unmarshal([]byte(`{"aud":["other","ori-app"]}`), &claims); err != nil || !claims.Aud.contains("ori-app") || len(claims.Aud) != 2 {
+		t.Errorf("Expected an array of audiences to be read, got %v, error %v", claims.Aud, err)
+	}
+
+}
+
+func TestParseOIDCProviders(t *testing.T) {
+
+	if providers, err := ParseOIDCProviders(&config.Global{}); err != nil || len(providers) != 0 {
+		t.Errorf("Expected no providers, got %v, error %v", providers, err)
+	}
+
+	conf := config.Global{OIDCProviders: `{"acme": {"issuer": "https://login.acme.com", "clientID": "ori-app", "autoCreate": true}}`}
+	if providers, err := ParseOIDCProviders(&conf); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	} else if p := providers["acme"]; p == nil || p.Issuer != "https://login.acme.com" || !p.AutoCreate {
+		t.Errorf("Unexpected providers %+v", providers)
+	}
+
+	for _, bad := range []string{`wat`, `{"acme": {"clientID": "ori-app"}}`, `{"acme": null}`} {
+		if _, err := ParseOIDCProviders(&config.Global{OIDCProviders: bad}); err != ErrBadOIDCConfig {
+			t.Errorf("Expected ErrBadOIDCConfig for %s, got %v", bad, err)
+		}
+	}
+
+}
+
+func TestOIDCProviderAMR(t *testing.T) {
+
+	claims := &IDTokenClaims{AMR: []string{"pwd", "mfa"}}
+	if amr := (&OIDCProvider{}).amr(claims); len(amr) != 0 {
+		t.Errorf("Expected no amr from an untrusted provider, got %v", amr)
+	} else if amr := (&OIDCProvider{TrustMFA: true}).amr(claims); len(amr) != 1 || amr[0] != AMRMFA {
+		t.Errorf("Expected [%s] from a trusted provider, got %v", AMRMFA, amr)
+	} else if amr := (&OIDCProvider{TrustMFA: true}).amr(&IDTokenClaims{AMR: []string{"pwd"}}); len(amr) != 0 {
+		t.Errorf("Expected no amr for a password-only login, got %v", amr)
+	}
+
+}
+
+func TestOIDCLoginHandler(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	issuer := newStubIssuer(t)
+	defer issuer.Close()
+
+	providers, _ := json.Marshal(map[string]*OIDCProvider{
+		"stub": {Issuer: issuer.URL, ClientID: "ori-app", AutoCreate: true, Roles: []string{"member"}},
+	})
+	conf := config.Global{AuthSecret: "foo", OIDCProviders: string(providers)}
+
+	idToken := issuer.idToken(t, "user-1", map[string]interface{}{
+		"email":          "fed@bar.com",
+		"email_verified": true,
+	})
+
+	var token Token
+	var acct account.Account
+
+	// the first login creates the account
+	w := test.NewState().Config(&conf).Body(&OIDCCredentials{Provider: "stub", IDToken: idToken}).Run(ctx, OIDCLoginHandler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http.StatusOK, got %d: %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil || token.Token == "" {
+		t.Errorf("Expected a token, got %s", w.Body.String())
+	} else if claimSet, err := Decode([]byte(token.Token), []byte("foo")); err != nil || claimSet.Sub != "fed@bar.com" {
+		t.Errorf("Expected a JWT for fed@bar.com, got %+v, error %v", claimSet, err)
+	}
+
+	if err := account.Get(ctx, "fed@bar.com", &acct); err != nil {
+		t.Fatalf("Expected the account to have been created, got %s", err)
+	} else if !acct.Verified || !acct.HasRole(ctx, "member") {
+		t.Errorf("Expected a verified member account, got %+v", acct)
+	}
+
+	// unverified email addresses don't get linked to existing accounts
+	account.New(ctx, "local@bar.com", "foobar")
+	unverified := issuer.idToken(t, "user-2", map[string]interface{}{"email": "local@bar.com"})
+	w = test.NewState().Config(&conf).Body(&OIDCCredentials{Provider: "stub", IDToken: unverified}).Run(ctx, OIDCLoginHandler)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http.StatusForbidden, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// nor do accounts that haven't verified theirs
+	verified := issuer.idToken(t, "user-2", map[string]interface{}{"email": "local@bar.com", "email_verified": true})
+	w = test.NewState().Config(&conf).Body(&OIDCCredentials{Provider: "stub", IDToken: verified}).Run(ctx, OIDCLoginHandler)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http.StatusForbidden, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the provider's amr claim isn't passed through
+	var claims struct {
+		AMR []string `json:"amr"`
+	}
+	mfa := issuer.idToken(t, "user-1", map[string]interface{}{"amr": []string{"mfa"}})
+	w = test.NewState().Config(&conf).Body(&OIDCCredentials{Provider: "stub", IDToken: mfa}).Run(ctx, OIDCLoginHandler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http.StatusOK, got %d: %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("Unexpected error %s reading token", err)
+	} else if err := DecodeInto([]byte(token.Token), []byte("foo"), &claims); err != nil || len(claims.AMR) != 0 {
+		t.Errorf("Expected no amr claim, got %v, error %v", claims.AMR, err)
+	}
+
+	// unknown providers and bad tokens are turned away
+	w = test.NewState().Config(&conf).Body(&OIDCCredentials{Provider: "nope", IDToken: idToken}).Run(ctx, OIDCLoginHandler)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected http.StatusBadRequest, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().Config(&conf).Body(&OIDCCredentials{Provider: "stub", IDToken: "wat"}).Run(ctx, OIDCLoginHandler)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized, got %d: %s", w.Code, w.Body.String())
+	}
+
+}
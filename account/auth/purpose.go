@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PurposeClaim is the private claim that binds a JWT to a single purpose, such as
+// resetting a password. auth.Middleware rejects JWTs that carry it, so they can only
+// be redeemed by the handler they were issued for.
+const PurposeClaim = "pur"
+
+var (
+	PurposeJWTError = Error("JWT can only be used for a specific purpose")
+
+	ErrBadPurposeToken = errors.New(http.StatusUnauthorized, "The token is invalid, has expired or has already been used")
+)
+
+// IssuePurposeToken generates a single-use JWT for sub that is only good for purpose
+// and expires after lifetime. Redeem it with DecodePurposeToken and UseClaimSet.
+func IssuePurposeToken(conf *config.Global, sub, purpose string, lifetime time.Duration) (string, error) {
+
+	jti, err := NewJTI()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	jwt, err := Sign(&jws.ClaimSet{
+		Iss: conf.TokenIssuer,
+		Aud: conf.TokenAudience,
+		Sub: sub,
+		Iat: now.Unix(),
+		Exp: now.Add(lifetime).Unix(),
+		PrivateClaims: map[string]interface{}{
+			PurposeClaim: purpose,
+			"jti":        jti,
+			"u":          1,
+		},
+	}, conf)
+
+	return string(jwt), err
+
+}
+
+// DecodePurposeToken checks that jwt is a valid, unrevoked token issued by IssuePurposeToken
+// for purpose, and returns its claim set. It does not use the token up; call UseClaimSet
+// once whatever the token authorizes has been checked and is about to happen.
+func DecodePurposeToken(ctx context.Context, jwt, purpose string) (*jws.ClaimSet, error) {
+
+	var conf config.Global
+
+	if err := config.Get(ctx, &conf); err != nil {
+		return nil, err
+	}
+
+	verifier, err := NewVerifier(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	claimSet, err := verifier.Decode([]byte(jwt))
+	if err != nil {
+		log.Warningf(ctx, "Bad %s token: %s", purpose, err.Error())
+		return nil, ErrBadPurposeToken
+	} else if claimSet.PrivateClaims[PurposeClaim] != purpose {
+		return nil, ErrBadPurposeToken
+	} else if revoked, err := IsRevoked(ctx, claimSet); err != nil {
+		return nil, err
+	} else if revoked {
+		return nil, ErrBadPurposeToken
+	}
+
+	return claimSet, nil
+
+}
+
+// purposeLifetime parses the lifetime setting of a purpose token from config.Global,
+// falling back on def if it isn't set.
+func purposeLifetime(setting string, def time.Duration) (time.Duration, error) {
+
+	if setting == "" {
+		return def, nil
+	} else if d, err := time.ParseDuration(setting); err != nil || d <= 0 {
+		return 0, ErrBadTokenConfig
+	} else {
+		return d, nil
+	}
+
+}
+
+// linkWithToken returns base with token added in the token query parameter.
+func linkWithToken(base *url.URL, token string) string {
+
+	link := *base
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String()
+
+}
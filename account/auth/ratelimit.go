@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitKeyPrefix prefixes the memcache keys that rate limit counts are kept under.
+const RateLimitKeyPrefix = "ori-ratelimit|"
+
+var ErrRateLimited = errors.New(http.StatusTooManyRequests, "Too many requests; please try again later")
+
+// A RateLimiter limits how many requests each client can make in a window of time.
+// Clients are identified by the email address of their account, or by their IP
+// address if they aren't logged in.
+//
+// Counts are kept in memcache and expire with their window, so they cost nothing to
+// clean up and a single round trip to update. Memcache may evict them early, though,
+// so limits are a best effort: a client can occasionally get more than Limit requests
+// through in a window.
+type RateLimiter struct {
+	// Name identifies the counts the limiter uses. Limiters with the same Name
+	// share their counts. It must not be empty, since counting by URL path would give
+	// every distinct path, like /accounts/:id for each account, a limit of its own.
+	Name string
+	// Limit is the number of requests allowed per window.
+	Limit int64
+	// Window is the length of each window. Counts start over at the beginning of each window.
+	Window time.Duration
+}
+
+// RateLimit returns an AuthCheck that allows each client limit requests per window to the
+// routes it is installed on with the same name, and rejects any more with a 429. Since it
+// passes for everyone under the limit, use it with CheckAll rather than Check:
+//	kami.Post("/reports", auth.CheckAll(auth.HasRole("analyst"), auth.RateLimit("reports", 10, time.Minute)).Then(makeReport))
+// It panics if name is empty.
+func RateLimit(name string, limit int64, window time.Duration) AuthCheck {
+
+	if name == "" {
+		panic("auth.RateLimit needs a name")
+	}
+	return (&RateLimiter{Name: name, Limit: limit, Window: window}).Check
+
+}
+
+// Check is an AuthCheck that counts the request against its client's limit. It sets the
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers on every response,
+// and the Retry-After header when the limit has been exceeded.
+// If the count can't be updated, the request is logged and allowed through.
+func (l *RateLimiter) Check(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	now := time.Now()
+	window := int64(l.Window)
+	if window <= 0 {
+		window = int64(time.Second)
+	}
+
+	bucket := now.UnixNano() / window
+	reset := time.Unix(0, (bucket+1)*window)
+
+	name := l.Name
+	client := rateLimitClient(ctx, r)
+	key := fmt.Sprintf("%s%s|%s|%d", RateLimitKeyPrefix, name, client, bucket)
+
+	// memcache.Increment can't set an expiration, so add the count first and only
+	// then increment it. ErrNotStored just means an earlier request already added it.
+	item := &memcache.Item{
+		Key:        key,
+		Value:      []byte("0"),
+		Expiration: reset.Sub(now) + time.Second,
+	}
+
+	var count int64
+	if err := memcache.Add(ctx, item); err != nil && err != memcache.ErrNotStored {
+		log.Errorf(ctx, "Error adding rate limit count for %s: %s", client, err.Error())
+		return nil
+	} else if n, err := memcache.IncrementExisting(ctx, key, 1); err != nil {
+		log.Errorf(ctx, "Error incrementing rate limit count for %s: %s", client, err.Error())
+		return nil
+	} else {
+		count = int64(n)
+	}
+
+	remaining := l.Limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(l.Limit, 10))
+	w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+	if count > l.Limit {
+		// round up so clients don't come back a moment too soon
+		retryAfter := (reset.Sub(now) + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter), 10))
+		log.Warningf(ctx, "%s: rate limit of %d per %s exceeded for %s", client, l.Limit, l.Window, name)
+		return ErrRateLimited
+	}
+
+	return nil
+
+}
+
+// rateLimitClient identifies the client making r: by account email if it is logged in,
+// or else by IP address.
+func rateLimitClient(ctx context.Context, r *http.Request) string {
+
+	var acct account.Account
+
+	if err := GetAccount(ctx, &acct); err == nil && !acct.Nobody() {
+		return acct.Email
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	} else {
+		return r.RemoteAddr
+	}
+
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	foo := account.Account{Email: "foo@bar.com"}
+	bar := account.Account{Email: "bar@bar.com"}
+	noContent := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	handler := CheckAll(RateLimit("test", 2, time.Hour)).Then(noContent)
+
+	for i, remaining := range []string{"1", "0"} {
+		w := test.NewState().Account(&foo).Run(ctx, handler)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Request %d: expected http.StatusNoContent, got %d: %s", i, w.Code, w.Body.String())
+		} else if w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != remaining {
+			t.Errorf("Request %d: unexpected rate limit headers %v", i, w.Header())
+		}
+	}
+
+	w := test.NewState().Account(&foo).Run(ctx, handler)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected http.StatusTooManyRequests, got %d", w.Code)
+	} else if retryAfter := w.Header().Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Expected a Retry-After header, but got %q", retryAfter)
+	}
+
+	// other accounts have limits of their own
+	w = test.NewState().Account(&bar).Run(ctx, handler)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent for another account, got %d", w.Code)
+	}
+
+	// and so do other limiters
+	other := CheckAll((&RateLimiter{Name: "other", Limit: 1, Window: time.Hour}).Check).Then(noContent)
+	w = test.NewState().Account(&foo).Run(ctx, other)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent from another limiter, got %d", w.Code)
+	}
+
+}
+
+func TestRateLimitPanic(t *testing.T) {
+
+	defer func() {
+		if err := recover(); err == nil {
+			t.Errorf("RateLimit did not panic without a name, but it should have")
+		}
+	}()
+
+	RateLimit("", 2, time.Hour)
+
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/guregu/kami"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/mail"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PasswordResetPurpose is the purpose of the tokens issued by RequestPasswordReset.
+const PasswordResetPurpose = "password_reset"
+
+// DefaultPasswordResetLifetime is the lifetime of a password reset token when
+// config.Global does not set PasswordResetLifetime.
+var DefaultPasswordResetLifetime = time.Hour
+
+var ErrNoPasswordResetURL = errors.New(http.StatusInternalServerError, "The app has no valid PasswordResetURL configured")
+
+// PasswordResetRequest is the request body accepted by RequestPasswordResetHandler.
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordReset is the request body accepted by CompletePasswordResetHandler.
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// RequestPasswordReset emails the account with address email a link to conf.PasswordResetURL
+// carrying a single-use password reset token. If there is no such account, it does nothing,
+// so callers can't use it to find out who has an account.
+func RequestPasswordReset(ctx context.Context, email string, mailer mail.Mailer) error {
+
+	var conf config.Global
+	var acct account.Account
+
+	if err := config.Get(ctx, &conf); err != nil {
+		return err
+	}
+
+	resetURL, err := url.Parse(conf.PasswordResetURL)
+	if err != nil || conf.PasswordResetURL == "" {
+		return ErrNoPasswordResetURL
+	}
+
+	lifetime, err := purposeLifetime(conf.PasswordResetLifetime, DefaultPasswordResetLifetime)
+	if err != nil {
+		return err
+	}
+
+	if err := account.Get(ctx, email, &acct); err == datastore.ErrNoSuchEntity {
+		log.Infof(ctx, "%s: password reset requested for nonexistent account", email)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := IssuePurposeToken(&conf, acct.Email, PasswordResetPurpose, lifetime)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(ctx, &mail.Message{
+		To:      acct.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your account. If it was you, "+
+			"follow this link within %s to choose a new one:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.", lifetime, linkWithToken(resetURL, token)),
+	})
+
+}
+
+// CompletePasswordReset sets the password of the account named by the password reset
+// token jwt to password, and uses up the token. Every JWT issued to the account
+// beforehand is revoked, and any login lockout is lifted.
+func CompletePasswordReset(ctx context.Context, jwt, password string) error {
+
+	var acct account.Account
+
+	claimSet, err := DecodePurposeToken(ctx, jwt, PasswordResetPurpose)
+	if err != nil {
+		return err
+	} else if err := account.Get(ctx, claimSet.Sub, &acct); err == datastore.ErrNoSuchEntity {
+		return ErrBadPurposeToken
+	} else if err != nil {
+		return err
+	} else if err := acct.SetPassword(ctx, password); err != nil {
+		// check the password before using up the token, so people can try again
+		return err
+	} else if err := UseClaimSet(ctx, claimSet); err == ErrClaimSetUsedUp {
+		return ErrBadPurposeToken
+	} else if err != nil {
+		return err
+	} else if err := account.Save(ctx, &acct); err != nil {
+		return err
+	} else if err := Unlock(ctx, acct.Email); err != nil {
+		return err
+	} else {
+		return RevokeSubject(ctx, acct.Email)
+	}
+
+}
+
+// RequestPasswordResetHandler returns a kami.HandlerFunc that sends a password reset email
+// through mailer, as described in RequestPasswordReset. It expects a JSON body shaped like
+// PasswordResetRequest and responds with a 204 whether or not the account exists.
+// Install it on whatever route you like:
+//	kami.Post("/password-reset", auth.RequestPasswordResetHandler(&mail.AppEngine{Sender: "noreply@example.com"}))
+func RequestPasswordResetHandler(mailer mail.Mailer) kami.HandlerFunc {
+
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+		var req PasswordResetRequest
+
+		if err := rest.ReadJSON(r, &req); err != nil {
+			rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+		} else if req.Email == "" {
+			rest.WriteJSON(w, errors.New(http.StatusBadRequest, "An email address is required"))
+		} else if err := RequestPasswordReset(ctx, req.Email, mailer); err != nil {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, &rest.NoContent)
+		}
+
+	}
+
+}
+
+// CompletePasswordResetHandler is a kami.HandlerFunc that sets a new password for the
+// account named by a password reset token, as described in CompletePasswordReset. It
+// expects a JSON body shaped like PasswordReset and responds with a 204.
+// Install it on whatever route you like:
+//	kami.Put("/password-reset", auth.CompletePasswordResetHandler)
+func CompletePasswordResetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var reset PasswordReset
+
+	if err := rest.ReadJSON(r, &reset); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if err := CompletePasswordReset(ctx, reset.Token, reset.Password); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
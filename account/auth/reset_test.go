@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/mail"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+type recordingMailer struct {
+	messages []mail.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg *mail.Message) error {
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+var tokenParam = regexp.MustCompile(`token=([^\s]+)`)
+
+func TestPasswordReset(t *testing.T) {
+
+	var acct account.Account
+	var mailer recordingMailer
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	ctx = test.WithConfig(ctx, map[string]interface{}{
+		"AuthSecret":       "foo",
+		"PasswordResetURL": "https://example.com/reset",
+	})
+
+	// nobody is told whether an account exists
+	if err := RequestPasswordReset(ctx, "nobody@here.chickens", &mailer); err != nil {
+		t.Errorf("Unexpected error %s requesting reset for a nonexistent account", err)
+	} else if len(mailer.messages) != 0 {
+		t.Errorf("Expected no email for a nonexistent account, but got %+v", mailer.messages)
+	}
+
+	if err := RequestPasswordReset(ctx, "foo@bar.com", &mailer); err != nil {
+		t.Fatalf("Unexpected error %s requesting reset", err)
+	} else if len(mailer.messages) != 1 || mailer.messages[0].To != "foo@bar.com" {
+		t.Fatalf("Expected one email to foo@bar.com, but got %+v", mailer.messages)
+	}
+
+	match := tokenParam.FindStringSubmatch(mailer.messages[0].Body)
+	if match == nil {
+		t.Fatalf("No reset link in email body %q", mailer.messages[0].Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+
+	// the token doesn't log anyone in
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", token)
+	if err := GetAccount(Middleware(ctx, w, r), &acct); err != PurposeJWTError {
+		t.Errorf("Expected PurposeJWTError logging in with a reset token, but got %s", err)
+	}
+
+	// a bad password doesn't use up the token
+	if err, ok := CompletePasswordReset(ctx, token, "foo").(*account.PasswordPolicyError); !ok || !err.Broke(account.PasswordTooShort) {
+		t.Errorf("Expected a PasswordPolicyError for a short password, but got %v", err)
+	}
+
+	if err := CompletePasswordReset(ctx, token, "newpassword"); err != nil {
+		t.Fatalf("Unexpected error %s completing reset", err)
+	}
+
+	account.Get(ctx, "foo@bar.com", &acct)
+	if err := acct.CheckPassword("newpassword"); err != nil {
+		t.Errorf("Expected the password to have changed, but got %s", err)
+	}
+
+	if err := CompletePasswordReset(ctx, token, "anotherpassword"); err != ErrBadPurposeToken {
+		t.Errorf("Expected ErrBadPurposeToken reusing a reset token, but got %s", err)
+	}
+
+	if err := CompletePasswordReset(ctx, "wat", "anotherpassword"); err != ErrBadPurposeToken {
+		t.Errorf("Expected ErrBadPurposeToken with a bad token, but got %s", err)
+	}
+
+}
+
+func TestPasswordResetHandlers(t *testing.T) {
+
+	var mailer recordingMailer
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+
+	w := test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Body(&PasswordResetRequest{Email: "foo@bar.com"}).
+		Run(ctx, RequestPasswordResetHandler(&mailer))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected http.StatusInternalServerError without a PasswordResetURL, got %d", w.Code)
+	}
+
+	w = test.NewState().
+		Config(&config.Global{AuthSecret: "foo", PasswordResetURL: "https://example.com/reset"}).
+		Body(&PasswordResetRequest{Email: "foo@bar.com"}).
+		Run(ctx, RequestPasswordResetHandler(&mailer))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected http.StatusNoContent, got %d: %s", w.Code, w.Body.String())
+	} else if len(mailer.messages) != 1 {
+		t.Fatalf("Expected one email, but got %+v", mailer.messages)
+	}
+
+	token, _ := url.QueryUnescape(tokenParam.FindStringSubmatch(mailer.messages[0].Body)[1])
+
+	w = test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Body(&PasswordReset{Token: token, Password: "newpassword"}).
+		Run(ctx, CompletePasswordResetHandler)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, got %d: %s", w.Code, w.Body.String())
+	}
+
+}
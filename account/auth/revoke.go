@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"time"
+)
+
+// RevokedTokenEntity is the name of the Datastore entity used to record
+// revoked JWTs, keyed by jti.
+const RevokedTokenEntity = "APIRevokedToken"
+
+// RevokedSubjectEntity is the name of the Datastore entity used to record
+// that every JWT issued to a subject before some time has been revoked.
+const RevokedSubjectEntity = "APIRevokedSubject"
+
+var RevokedJWTError = Error("JWT has been revoked")
+
+type revocation struct {
+	RevokedAt time.Time
+}
+
+// NewJTI generates a random JWT ID suitable for the jti claim.
+func NewJTI() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+
+}
+
+// RevokeToken revokes the JWT with ID jti, so auth.Middleware will no longer accept it.
+func RevokeToken(ctx context.Context, jti string) error {
+
+	_, err := nds.Put(ctx, datastore.NewKey(ctx, RevokedTokenEntity, jti, 0, nil), &revocation{RevokedAt: time.Now()})
+	return err
+
+}
+
+// RevokeSubject revokes every JWT issued to sub up to now. JWTs issued
+// to sub afterwards are not affected.
+//
+// JWTs record when they were issued to the second, so RevokeSubject records the
+// revocation as of the start of the next second, and waits for it before returning.
+// That way a JWT issued just before the call is revoked, while one issued just after
+// it, like that of a login following "log out everywhere", is not.
+func RevokeSubject(ctx context.Context, sub string) error {
+
+	now := time.Now()
+	cutoff := now.Truncate(time.Second).Add(time.Second)
+
+	if _, err := nds.Put(ctx, datastore.NewKey(ctx, RevokedSubjectEntity, sub, 0, nil), &revocation{RevokedAt: cutoff}); err != nil {
+		return err
+	}
+
+	time.Sleep(cutoff.Sub(time.Now()))
+	return nil
+
+}
+
+// IsRevoked checks whether claimSet has been revoked, either by its jti or because
+// every JWT issued to its subject before its iat has been revoked.
+func IsRevoked(ctx context.Context, claimSet *jws.ClaimSet) (bool, error) {
+	return isRevoked(ctx, claimsFromClaimSet(claimSet))
+}
+
+// isRevoked does the work of IsRevoked.
+func isRevoked(ctx context.Context, claims *tokenClaims) (bool, error) {
+
+	keys := []*datastore.Key{datastore.NewKey(ctx, RevokedSubjectEntity, claims.Sub, 0, nil)}
+	if claims.JTI != "" {
+		keys = append(keys, datastore.NewKey(ctx, RevokedTokenEntity, claims.JTI, 0, nil))
+	}
+
+	revocations := make([]revocation, len(keys))
+	err := nds.GetMulti(ctx, keys, revocations)
+
+	switch t := err.(type) {
+	case appengine.MultiError:
+		for _, mErr := range t {
+			if mErr != nil && mErr != datastore.ErrNoSuchEntity {
+				return false, t
+			}
+		}
+	default:
+		return false, err
+	case nil:
+		// do nothing
+	}
+
+	if !revocations[0].RevokedAt.IsZero() && claims.Iat < revocations[0].RevokedAt.Unix() {
+		// the subject's tokens were revoked after this one was issued; see RevokeSubject
+		return true, nil
+	} else if len(revocations) > 1 && !revocations[1].RevokedAt.IsZero() {
+		return true, nil
+	} else {
+		return false, nil
+	}
+
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/test"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRevocation(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	tokenA := &jws.ClaimSet{Sub: "foo@bar.com", Iat: time.Now().Add(-time.Minute).Unix(), PrivateClaims: map[string]interface{}{"jti": "a"}}
+	tokenB := &jws.ClaimSet{Sub: "foo@bar.com", Iat: time.Now().Add(-time.Minute).Unix(), PrivateClaims: map[string]interface{}{"jti": "b"}}
+
+	if revoked, err := IsRevoked(ctx, tokenA); err != nil || revoked {
+		t.Errorf("Expected token not to be revoked, but got %t, %s", revoked, err)
+	}
+
+	// revoke one token by jti
+	if err := RevokeToken(ctx, "a"); err != nil {
+		t.Fatalf("Unexpected error %s on RevokeToken", err)
+	}
+	if revoked, err := IsRevoked(ctx, tokenA); err != nil || !revoked {
+		t.Errorf("Expected token a to be revoked, but got %t, %s", revoked, err)
+	}
+	if revoked, err := IsRevoked(ctx, tokenB); err != nil || revoked {
+		t.Errorf("Expected token b not to be revoked, but got %t, %s", revoked, err)
+	}
+
+	// revoke everything issued to the subject
+	if err := RevokeSubject(ctx, "foo@bar.com"); err != nil {
+		t.Fatalf("Unexpected error %s on RevokeSubject", err)
+	}
+	if revoked, err := IsRevoked(ctx, tokenB); err != nil || !revoked {
+		t.Errorf("Expected token b to be revoked, but got %t, %s", revoked, err)
+	}
+
+	// tokens issued afterwards are fine, even right afterwards
+	tokenC := &jws.ClaimSet{Sub: "foo@bar.com", Iat: time.Now().Unix()}
+	if revoked, err := IsRevoked(ctx, tokenC); err != nil || revoked {
+		t.Errorf("Expected token c not to be revoked, but got %t, %s", revoked, err)
+	}
+
+	// but tokens issued in the same second just before are revoked
+	tokenD := &jws.ClaimSet{Sub: "foo@bar.com", Iat: time.Now().Unix()}
+	if err := RevokeSubject(ctx, "foo@bar.com"); err != nil {
+		t.Fatalf("Unexpected error %s on RevokeSubject", err)
+	} else if revoked, err := IsRevoked(ctx, tokenD); err != nil || !revoked {
+		t.Errorf("Expected token d to be revoked, but got %t, %s", revoked, err)
+	}
+
+}
+
+func TestMiddlewareRevocation(t *testing.T) {
+
+	var acct account.Account
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	ctx = test.WithConfig(ctx, map[string]interface{}{"AuthSecret": "foo"})
+
+	claimSet := &jws.ClaimSet{
+		Sub:           "foo@bar.com",
+		Iat:           time.Now().Add(-time.Minute).Unix(),
+		Exp:           time.Now().Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{"jti": "revokeme"},
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", test.JWT(claimSet, "foo"))
+
+	if err := GetAccount(Middleware(ctx, w, r), &acct); err != nil {
+		t.Errorf("Unexpected error %s before revocation", err)
+	}
+
+	RevokeToken(ctx, "revokeme")
+
+	if err := GetAccount(Middleware(ctx, w, r), &acct); err != RevokedJWTError {
+		t.Errorf("Expected RevokedJWTError after revocation, but got %s", err)
+	}
+
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"github.com/guregu/kami"
+	"github.com/qedus/nds"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/internal"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// SessionEntity is the name of the Datastore entity used to record sessions.
+// Sessions are stored as descendants of the account's key, keyed by the jti of
+// the JWT that started them, so account.Remove deletes them along with the account.
+const SessionEntity = "APISession"
+
+// SessionClaim is the private claim identifying the session a JWT belongs to.
+// Child tokens copy it from their parent, so revoking a session revokes them too.
+const SessionClaim = "sid"
+
+// SessionTouchInterval is how often auth.Middleware updates a session's LastSeenAt,
+// so that busy sessions don't write to the datastore on every request.
+var SessionTouchInterval = 5 * time.Minute
+
+// ExpiredSessionRetention is how long sessions are kept after their JWTs expire. Each login
+// deletes the account's sessions that expired longer ago than that. Keep it longer than
+// config.Global.ClockSkew, since auth.Middleware refuses JWTs whose session is gone.
+var ExpiredSessionRetention = 24 * time.Hour
+
+var (
+	RevokedSessionError = Error("The session has been revoked")
+
+	ErrNoSuchSession = errors.New(http.StatusNotFound, "There is no session with that ID")
+)
+
+// Session records a login: every JWT issued by Issue starts one, and auth.Middleware
+// refuses JWTs whose session has been revoked or no longer exists.
+type Session struct {
+	// ID identifies the session. It is the jti of the JWT that started it.
+	ID string `json:"id" datastore:"-"`
+	// UserAgent is the User-Agent header of the request that started the session.
+	UserAgent string `json:"userAgent" datastore:",noindex"`
+	// IP is the address of the client that started the session.
+	IP string `json:"ip" datastore:",noindex"`
+	// CreatedAt is the time at which the session started.
+	CreatedAt time.Time `json:"createdAt" datastore:",noindex"`
+	// LastSeenAt is, to within SessionTouchInterval, the last time the session was used.
+	LastSeenAt time.Time `json:"lastSeenAt" datastore:",noindex"`
+	// ExpiresAt is the time at which the session's JWT expires.
+	ExpiresAt time.Time `json:"expiresAt" datastore:",noindex"`
+	// Revoked is true if the session has been revoked.
+	Revoked bool `json:"revoked" datastore:",noindex"`
+	// RevokedAt is the time at which the session was revoked, if it was.
+	RevokedAt time.Time `json:"revokedAt" datastore:",noindex"`
+	// Current is true if this is the session of the request listing it.
+	Current bool `json:"current,omitempty" datastore:"-"`
+}
+
+// client describes who is on the other end of a request. auth.Middleware stores it
+// in the request context so Issue can record it with the session.
+type client struct {
+	UserAgent string
+	IP        string
+}
+
+func clientFromRequest(r *http.Request) *client {
+
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	return &client{UserAgent: r.UserAgent(), IP: ip}
+
+}
+
+func sessionKey(ctx context.Context, email, id string) *datastore.Key {
+	return datastore.NewKey(ctx, SessionEntity, id, 0, datastore.NewKey(ctx, account.Entity, email, 0, nil))
+}
+
+// recordSession starts the session for claimSet, which Issue has just signed for acct.
+func recordSession(ctx context.Context, acct *account.Account, claimSet *jws.ClaimSet) error {
+
+	id, _ := claimSet.PrivateClaims[SessionClaim].(string)
+	if id == "" || acct.Key(ctx) == nil {
+		return nil
+	}
+
+	now := time.Now()
+	session := &Session{
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  time.Unix(claimSet.Exp, 0),
+	}
+
+	if c, ok := ctx.Value(internal.ClientContextKey).(*client); ok {
+		session.UserAgent = c.UserAgent
+		session.IP = c.IP
+	}
+
+	if _, err := nds.Put(ctx, sessionKey(ctx, acct.Email, id), session); err != nil {
+		return err
+	}
+
+	// tidy up while we're here; it can wait for the next login if it fails
+	if err := removeExpiredSessions(ctx, acct.Email, now); err != nil {
+		log.Warningf(ctx, "%s: couldn't remove expired sessions: %s", acct.Email, err)
+	}
+	return nil
+
+}
+
+// removeExpiredSessions deletes the sessions of the account with email that expired more
+// than ExpiredSessionRetention before now.
+func removeExpiredSessions(ctx context.Context, email string, now time.Time) error {
+
+	var all []Session
+	keys, err := datastore.NewQuery(SessionEntity).
+		Ancestor(datastore.NewKey(ctx, account.Entity, email, 0, nil)).
+		GetAll(ctx, &all)
+	if err != nil {
+		return err
+	}
+
+	var expired []*datastore.Key
+	for i, key := range keys {
+		if all[i].ExpiresAt.Add(ExpiredSessionRetention).Before(now) {
+			expired = append(expired, key)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+	return nds.DeleteMulti(ctx, expired)
+
+}
+
+// removeSessions deletes the sessions of the account at oldEmail, for account.ChangeEmail.
+// Their JWTs name the account by its old address, so they stop working with the change
+// anyway; removing the sessions makes sure of it even if a new account takes the address.
+func removeSessions(ctx context.Context, oldEmail, newEmail string) error {
+
+	keys, err := datastore.NewQuery(SessionEntity).
+		Ancestor(datastore.NewKey(ctx, account.Entity, oldEmail, 0, nil)).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return nds.DeleteMulti(ctx, keys)
+
+}
+
+// GetSession retrieves the session of the account with email identified by id and
+// stores it in the value pointed to by session. It returns ErrNoSuchSession if there is none.
+func GetSession(ctx context.Context, email, id string, session *Session) error {
+
+	if err := nds.Get(ctx, sessionKey(ctx, email, id), session); err == datastore.ErrNoSuchEntity {
+		return ErrNoSuchSession
+	} else if err != nil {
+		return err
+	}
+
+	session.ID = id
+	return nil
+
+}
+
+// ListSessions lists the sessions of the account with email whose JWTs haven't expired,
+// most recently started first.
+func ListSessions(ctx context.Context, email string) ([]Session, error) {
+
+	var all []Session
+	keys, err := datastore.NewQuery(SessionEntity).
+		Ancestor(datastore.NewKey(ctx, account.Entity, email, 0, nil)).
+		GetAll(ctx, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sessions := []Session{}
+	for i, key := range keys {
+		if all[i].ExpiresAt.After(now) {
+			all[i].ID = key.StringID()
+			sessions = append(sessions, all[i])
+		}
+	}
+
+	// sorting in memory spares apps a composite index
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+
+	return sessions, nil
+
+}
+
+// RevokeSession revokes the session of the account with email identified by id, so
+// auth.Middleware will no longer accept its JWT or any of their children.
+func RevokeSession(ctx context.Context, email, id string) error {
+
+	return nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		var session Session
+		if err := GetSession(txCtx, email, id, &session); err != nil {
+			return err
+		} else if session.Revoked {
+			return nil
+		}
+
+		session.Revoked = true
+		session.RevokedAt = time.Now()
+		_, err := nds.Put(txCtx, sessionKey(txCtx, email, id), &session)
+		return err
+
+	}, nil)
+
+}
+
+// checkSession checks whether the session claims belong to has been revoked, and
+// notes that the session has been seen. A session that doesn't exist, because it has
+// been cleaned up or was never recorded, counts as revoked. JWTs that don't belong to
+// a session at all, like API keys' and those minted before sessions were recorded,
+// are let through.
+func checkSession(ctx context.Context, claims *tokenClaims) (bool, error) {
+
+	var session Session
+
+	id := claims.Session
+	if id == "" {
+		return false, nil
+	} else if err := GetSession(ctx, claims.Sub, id, &session); err == ErrNoSuchSession {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	} else if session.Revoked {
+		return true, nil
+	} else if time.Since(session.LastSeenAt) < SessionTouchInterval {
+		return false, nil
+	}
+
+	// update LastSeenAt in a transaction, so this can't undo a concurrent revocation
+	err := nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+		if err := GetSession(txCtx, claims.Sub, id, &session); err != nil {
+			return err
+		}
+		session.LastSeenAt = time.Now()
+		_, err := nds.Put(txCtx, sessionKey(txCtx, claims.Sub, id), &session)
+		return err
+	}, nil)
+
+	if err == ErrNoSuchSession {
+		return true, nil
+	}
+	return session.Revoked, err
+
+}
+
+// currentSession returns the ID of the session the request in ctx was authorized with, if any.
+func currentSession(ctx context.Context) string {
+
+	if claims, err := getTokenClaims(ctx); err != nil {
+		return ""
+	} else {
+		return claims.Session
+	}
+
+}
+
+// SessionsHandler is a kami.HandlerFunc that lists the logged-in account's sessions,
+// as described in ListSessions, marking the one the request was made with as current.
+// Install it on whatever route you like:
+//	kami.Get("/sessions", auth.SessionsHandler)
+func SessionsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+
+	if err := GetAccount(ctx, &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if acct.Super() || acct.Nobody() {
+		rest.WriteJSON(w, ErrNotLoggedIn)
+	} else if sessions, err := ListSessions(ctx, acct.Email); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		current := currentSession(ctx)
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current
+		}
+		rest.WriteJSON(w, sessions)
+	}
+
+}
+
+// RevokeSessionHandler returns a kami.HandlerFunc that revokes one of the logged-in
+// account's sessions, identified by the route parameter paramName. Install it on
+// whatever route you like:
+//	kami.Delete("/sessions/:session", auth.RevokeSessionHandler("session"))
+func RevokeSessionHandler(paramName string) kami.HandlerFunc {
+
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+		var acct account.Account
+
+		if err := GetAccount(ctx, &acct); err != nil {
+			rest.WriteJSON(w, err)
+		} else if acct.Super() || acct.Nobody() {
+			rest.WriteJSON(w, ErrNotLoggedIn)
+		} else if err := RevokeSession(ctx, acct.Email, rest.Param(ctx, paramName)); err != nil {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, &rest.NoContent)
+		}
+
+	}
+
+}
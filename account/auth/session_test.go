@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"github.com/qedus/nds"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/internal"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_clientFromRequest(t *testing.T) {
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "curl/7.54.0")
+	r.RemoteAddr = "10.0.0.1:54321"
+
+	if c := clientFromRequest(r); c.UserAgent != "curl/7.54.0" || c.IP != "10.0.0.1" {
+		t.Errorf("Unexpected client %+v", c)
+	}
+
+	// App Engine gives just the address
+	r.RemoteAddr = "2001:db8::1"
+	if c := clientFromRequest(r); c.IP != "2001:db8::1" {
+		t.Errorf("Expected IP 2001:db8::1, got %s", c.IP)
+	}
+
+}
+
+func TestSessions(t *testing.T) {
+
+	var acct account.Account
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	account.Get(ctx, "foo@bar.com", &acct)
+	ctx = test.WithConfig(ctx, map[string]interface{}{"AuthSecret": "foo"})
+
+	issueCtx := context.WithValue(ctx, internal.ClientContextKey, &client{UserAgent: "curl/7.54.0", IP: "10.0.0.1"})
+	token, err := Issue(issueCtx, &acct)
+	if err != nil {
+		t.Fatalf("Unexpected error %s issuing token", err)
+	}
+
+	claimSet, _ := Decode([]byte(token.Token), []byte("foo"))
+	id, _ := claimSet.PrivateClaims[SessionClaim].(string)
+	if id == "" || id != claimSet.PrivateClaims["jti"] {
+		t.Fatalf("Expected the token's session to be its jti, got %v", claimSet.PrivateClaims)
+	}
+
+	if sessions, err := ListSessions(ctx, "foo@bar.com"); err != nil {
+		t.Fatalf("Unexpected error %s listing sessions", err)
+	} else if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %+v", sessions)
+	} else if s := sessions[0]; s.ID != id || s.UserAgent != "curl/7.54.0" || s.IP != "10.0.0.1" || s.Revoked || s.LastSeenAt.IsZero() {
+		t.Errorf("Unexpected session %+v", s)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", token.Token)
+
+	if err := GetAccount(Middleware(ctx, w, r), &account.Account{}); err != nil {
+		t.Errorf("Unexpected error %s before the session was revoked", err)
+	}
+
+	if err := RevokeSession(ctx, "foo@bar.com", id); err != nil {
+		t.Fatalf("Unexpected error %s revoking session", err)
+	}
+
+	if err := GetAccount(Middleware(ctx, w, r), &account.Account{}); err != RevokedSessionError {
+		t.Errorf("Expected RevokedSessionError after the session was revoked, got %v", err)
+	}
+
+	var session Session
+	if err := GetSession(ctx, "foo@bar.com", id, &session); err != nil || !session.Revoked || session.RevokedAt.IsZero() {
+		t.Errorf("Expected the session to be revoked, got %+v, error %v", session, err)
+	}
+
+	if err := RevokeSession(ctx, "foo@bar.com", "nope"); err != ErrNoSuchSession {
+		t.Errorf("Expected ErrNoSuchSession, got %v", err)
+	}
+
+	// a JWT whose session is gone is refused too
+	token, _ = Issue(issueCtx, &acct)
+	claimSet, _ = Decode([]byte(token.Token), []byte("foo"))
+	id, _ = claimSet.PrivateClaims[SessionClaim].(string)
+	nds.Delete(ctx, sessionKey(ctx, "foo@bar.com", id))
+	r.Header.Set("Authorization", token.Token)
+	if err := GetAccount(Middleware(ctx, w, r), &account.Account{}); err != RevokedSessionError {
+		t.Errorf("Expected RevokedSessionError for a missing session, got %v", err)
+	}
+
+	// logging in cleans up sessions that expired a while ago
+	expired := sessionKey(ctx, "foo@bar.com", "expired")
+	nds.Put(ctx, expired, &Session{ExpiresAt: time.Now().Add(-ExpiredSessionRetention - time.Hour)})
+	Issue(issueCtx, &acct)
+	if err := GetSession(ctx, "foo@bar.com", "expired", &session); err != ErrNoSuchSession {
+		t.Errorf("Expected the expired session to be removed, got %+v, error %v", session, err)
+	}
+
+	// changing the account's email address ends its sessions
+	if err := account.ChangeEmail(ctx, "foo@bar.com", "moved@bar.com"); err != nil {
+		t.Fatalf("Unexpected error %s changing email", err)
+	} else if sessions, err := ListSessions(ctx, "foo@bar.com"); err != nil || len(sessions) != 0 {
+		t.Errorf("Expected the sessions to be removed, got %+v, error %v", sessions, err)
+	} else if sessions, err := ListSessions(ctx, "moved@bar.com"); err != nil || len(sessions) != 0 {
+		t.Errorf("Expected no sessions to be moved, got %+v, error %v", sessions, err)
+	}
+
+}
+
+func TestSessionHandlers(t *testing.T) {
+
+	var acct account.Account
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	account.Get(ctx, "foo@bar.com", &acct)
+	ctx = test.WithConfig(ctx, map[string]interface{}{"AuthSecret": "foo"})
+
+	token, _ := Issue(ctx, &acct)
+	claimSet, _ := Decode([]byte(token.Token), []byte("foo"))
+	id := claimSet.PrivateClaims[SessionClaim].(string)
+
+	w := test.NewState().Account(&acct).Run(ctx, SessionsHandler)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().Account(&acct).Param("session", id).Run(ctx, RevokeSessionHandler("session"))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// someone else's session can't be revoked, because it isn't found among the account's
+	w = test.NewState().Account(&acct).Param("session", "nope").Run(ctx, RevokeSessionHandler("session"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected http.StatusNotFound, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().Account(&account.Nobody).Run(ctx, SessionsHandler)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized, got %d: %s", w.Code, w.Body.String())
+	}
+
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/guregu/kami"
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/mail"
+	"github.com/the-information/ori/rest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// EmailVerificationPurpose is the purpose of the tokens issued by RequestEmailVerification.
+const EmailVerificationPurpose = "verify_email"
+
+// DefaultEmailVerificationLifetime is the lifetime of an email verification token when
+// config.Global does not set EmailVerificationLifetime.
+var DefaultEmailVerificationLifetime = 24 * time.Hour
+
+var (
+	ErrNotLoggedIn              = errors.New(http.StatusUnauthorized, "You must be logged in to do that")
+	ErrUnverified               = errors.New(http.StatusForbidden, "The account's email address has not been verified")
+	ErrNoEmailVerificationURL   = errors.New(http.StatusInternalServerError, "The app has no valid EmailVerificationURL configured")
+	ErrEmailVerificationChanged = errors.New(http.StatusConflict, "The account's email address has changed since the verification token was issued")
+)
+
+// EmailVerification is the request body accepted by VerifyEmailHandler.
+type EmailVerification struct {
+	Token string `json:"token"`
+}
+
+// RequestEmailVerification emails acct a link to conf.EmailVerificationURL carrying
+// a single-use token that confirms acct owns its email address.
+func RequestEmailVerification(ctx context.Context, acct *account.Account, mailer mail.Mailer) error {
+
+	var conf config.Global
+
+	if acct.Super() || acct.Nobody() {
+		return ErrNotLoggedIn
+	} else if err := config.Get(ctx, &conf); err != nil {
+		return err
+	}
+
+	verificationURL, err := url.Parse(conf.EmailVerificationURL)
+	if err != nil || conf.EmailVerificationURL == "" {
+		return ErrNoEmailVerificationURL
+	}
+
+	lifetime, err := purposeLifetime(conf.EmailVerificationLifetime, DefaultEmailVerificationLifetime)
+	if err != nil {
+		return err
+	}
+
+	token, err := IssuePurposeToken(&conf, acct.Email, EmailVerificationPurpose, lifetime)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(ctx, &mail.Message{
+		To:      acct.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Please follow this link within %s to confirm that this is your email address:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.", lifetime, linkWithToken(verificationURL, token)),
+	})
+
+}
+
+// VerifyEmail marks the account named by the email verification token jwt as verified,
+// and uses up the token.
+func VerifyEmail(ctx context.Context, jwt string) error {
+
+	var acct account.Account
+
+	claimSet, err := DecodePurposeToken(ctx, jwt, EmailVerificationPurpose)
+	if err != nil {
+		return err
+	} else if err := account.Get(ctx, claimSet.Sub, &acct); err == datastore.ErrNoSuchEntity {
+		// the token is for an address the account no longer has
+		return ErrEmailVerificationChanged
+	} else if err != nil {
+		return err
+	} else if err := UseClaimSet(ctx, claimSet); err == ErrClaimSetUsedUp {
+		return ErrBadPurposeToken
+	} else if err != nil {
+		return err
+	}
+
+	acct.Verified = true
+	acct.VerifiedAt = time.Now()
+	return account.Save(ctx, &acct)
+
+}
+
+// Verified is an AuthCheck that grants access if the account's email address has been verified.
+func Verified(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+	var acct account.Account
+
+	if err := GetAccount(ctx, &acct); err != nil {
+		return err
+	} else if acct.Super() || acct.Nobody() {
+		return ErrNotLoggedIn
+	} else if !acct.Verified {
+		return ErrUnverified
+	} else {
+		return nil
+	}
+
+}
+
+// RequestEmailVerificationHandler returns a kami.HandlerFunc that sends the logged-in account
+// an email verification link through mailer, as described in RequestEmailVerification. It
+// responds with a 204. Install it on whatever route you like:
+//	kami.Post("/verification", auth.RequestEmailVerificationHandler(&mail.AppEngine{Sender: "noreply@example.com"}))
+func RequestEmailVerificationHandler(mailer mail.Mailer) kami.HandlerFunc {
+
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+		var acct account.Account
+
+		if err := GetAccount(ctx, &acct); err != nil {
+			rest.WriteJSON(w, err)
+		} else if err := RequestEmailVerification(ctx, &acct, mailer); err != nil {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, &rest.NoContent)
+		}
+
+	}
+
+}
+
+// VerifyEmailHandler is a kami.HandlerFunc that confirms an email address with a token
+// sent by RequestEmailVerification, as described in VerifyEmail. It expects a JSON body
+// shaped like EmailVerification and responds with a 204. The token is all it needs, so
+// it works whether or not anyone is logged in. Install it on whatever route you like:
+//	kami.Put("/verification", auth.VerifyEmailHandler)
+func VerifyEmailHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var verification EmailVerification
+
+	if err := rest.ReadJSON(r, &verification); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if err := VerifyEmail(ctx, verification.Token); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
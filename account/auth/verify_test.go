@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/test"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestEmailVerification(t *testing.T) {
+
+	var acct account.Account
+	var mailer recordingMailer
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	account.New(ctx, "foo@bar.com", "foobar")
+	account.Get(ctx, "foo@bar.com", &acct)
+	ctx = test.WithConfig(ctx, map[string]interface{}{
+		"AuthSecret":           "foo",
+		"EmailVerificationURL": "https://example.com/verify",
+	})
+
+	if acct.Verified {
+		t.Fatalf("Expected a new account not to be verified")
+	}
+
+	if err := RequestEmailVerification(ctx, &account.Nobody, &mailer); err != ErrNotLoggedIn {
+		t.Errorf("Expected ErrNotLoggedIn for Nobody, but got %s", err)
+	}
+
+	if err := RequestEmailVerification(ctx, &acct, &mailer); err != nil {
+		t.Fatalf("Unexpected error %s requesting verification", err)
+	} else if len(mailer.messages) != 1 || mailer.messages[0].To != "foo@bar.com" {
+		t.Fatalf("Expected one email to foo@bar.com, but got %+v", mailer.messages)
+	}
+
+	match := tokenParam.FindStringSubmatch(mailer.messages[0].Body)
+	if match == nil {
+		t.Fatalf("No verification link in email body %q", mailer.messages[0].Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+
+	// a tampered token is rejected
+	if err := VerifyEmail(ctx, token+"x"); err != ErrBadPurposeToken {
+		t.Errorf("Expected ErrBadPurposeToken with a bad token, but got %s", err)
+	}
+
+	if err := VerifyEmail(ctx, token); err != nil {
+		t.Fatalf("Unexpected error %s verifying email", err)
+	}
+
+	account.Get(ctx, "foo@bar.com", &acct)
+	if !acct.Verified || acct.VerifiedAt.IsZero() {
+		t.Errorf("Expected the account to be verified, but got %+v", acct)
+	}
+
+	if err := VerifyEmail(ctx, token); err != ErrBadPurposeToken {
+		t.Errorf("Expected ErrBadPurposeToken reusing a verification token, but got %s", err)
+	}
+
+}
+
+func TestVerified(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	handler := Check(Verified).Then(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Account(&account.Account{Email: "foo@bar.com"}).
+		Run(ctx, handler)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http.StatusForbidden for an unverified account, got %d", w.Code)
+	}
+
+	w = test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Account(&account.Account{Email: "foo@bar.com", Verified: true}).
+		Run(ctx, handler)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK for a verified account, got %d", w.Code)
+	}
+
+	w = test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Run(ctx, handler)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected http.StatusUnauthorized for Nobody, got %d", w.Code)
+	}
+
+}
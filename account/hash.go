@@ -0,0 +1,201 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The password hashing schemes an Account's PasswordScheme can name.
+const (
+	BcryptScheme   = "bcrypt"
+	Argon2idScheme = "argon2id"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var ErrPasswordMismatch = errors.New(http.StatusUnauthorized, "The password is incorrect")
+
+// PasswordHashing describes how SetPassword hashes passwords.
+type PasswordHashing struct {
+	// Scheme is BcryptScheme or Argon2idScheme.
+	Scheme string
+	// BcryptCost is the cost passed to bcrypt.GenerateFromPassword.
+	BcryptCost int
+	// Argon2Time, Argon2Memory (in KiB) and Argon2Threads are passed to argon2.IDKey.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// DefaultPasswordHashing is the hashing used when config.Global sets none.
+var DefaultPasswordHashing = PasswordHashing{
+	Scheme:        BcryptScheme,
+	BcryptCost:    bcrypt.DefaultCost,
+	Argon2Time:    1,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+}
+
+// parsePasswordHashing fills in h from the password hashing settings in conf.
+func parsePasswordHashing(conf *config.Global, h *PasswordHashing) error {
+
+	parseUint := func(setting string, bits int, dst func(uint64)) error {
+		if setting == "" {
+			return nil
+		} else if n, err := strconv.ParseUint(setting, 10, bits); err != nil || n == 0 {
+			return ErrBadPasswordPolicy
+		} else {
+			dst(n)
+			return nil
+		}
+	}
+
+	switch conf.PasswordHashScheme {
+	case "":
+	case BcryptScheme, Argon2idScheme:
+		h.Scheme = conf.PasswordHashScheme
+	default:
+		return ErrBadPasswordPolicy
+	}
+
+	if conf.PasswordBcryptCost != "" {
+		if n, err := strconv.Atoi(conf.PasswordBcryptCost); err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+			return ErrBadPasswordPolicy
+		} else {
+			h.BcryptCost = n
+		}
+	}
+
+	if err := parseUint(conf.PasswordArgon2Time, 32, func(n uint64) { h.Argon2Time = uint32(n) }); err != nil {
+		return err
+	} else if err := parseUint(conf.PasswordArgon2Memory, 32, func(n uint64) { h.Argon2Memory = uint32(n) }); err != nil {
+		return err
+	} else {
+		return parseUint(conf.PasswordArgon2Threads, 8, func(n uint64) { h.Argon2Threads = uint8(n) })
+	}
+
+}
+
+// hash hashes password according to h, returning the scheme used along with the hash.
+func (h *PasswordHashing) hash(password string) (string, []byte, error) {
+
+	switch h.Scheme {
+	case Argon2idScheme:
+
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", nil, err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+		encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+		return Argon2idScheme, []byte(encoded), nil
+
+	default:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return BcryptScheme, hash, err
+	}
+
+}
+
+// outdated reports whether a hash made with scheme was made with different settings than h.
+func (h *PasswordHashing) outdated(scheme string, hash []byte) bool {
+
+	if scheme == "" {
+		scheme = BcryptScheme
+	}
+
+	want := h.Scheme
+	if want == "" {
+		want = BcryptScheme
+	}
+
+	if scheme != want {
+		return true
+	}
+
+	switch scheme {
+	case Argon2idScheme:
+		params, _, _, err := decodeArgon2id(hash)
+		return err != nil || params.Argon2Time != h.Argon2Time || params.Argon2Memory != h.Argon2Memory || params.Argon2Threads != h.Argon2Threads
+	default:
+		// bcrypt.GenerateFromPassword uses the default for costs that are too low
+		want := h.BcryptCost
+		if want < bcrypt.MinCost {
+			want = bcrypt.DefaultCost
+		}
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != want
+	}
+
+}
+
+// comparePassword checks password against a hash made with scheme. Accounts saved before
+// schemes were recorded have no scheme, and use bcrypt.
+func comparePassword(scheme string, hash []byte, password string) error {
+
+	switch scheme {
+	case Argon2idScheme:
+
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return err
+		}
+
+		proposed := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(proposed, key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+
+	case BcryptScheme, "":
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrPasswordMismatch
+		} else {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown password hashing scheme %q", scheme)
+	}
+
+}
+
+// decodeArgon2id parses an argon2id hash in the form hash produces.
+func decodeArgon2id(hash []byte) (params PasswordHashing, salt, key []byte, err error) {
+
+	var version int
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != Argon2idScheme {
+		err = fmt.Errorf("malformed argon2id hash")
+		return
+	} else if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	} else if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %d", version)
+		return
+	} else if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return
+	} else if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+
+	params.Scheme = Argon2idScheme
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	return
+
+}
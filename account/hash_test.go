@@ -0,0 +1,109 @@
+package account
+
+import (
+	"bytes"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/internal"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+// testArgon2 configures cheap argon2id hashing, to keep the tests quick.
+var testArgon2 = datastore.PropertyList{
+	{Name: "PasswordHashScheme", Value: Argon2idScheme},
+	{Name: "PasswordArgon2Time", Value: "1"},
+	{Name: "PasswordArgon2Memory", Value: "1024"},
+	{Name: "PasswordArgon2Threads", Value: "1"},
+}
+
+func TestArgon2idPassword(t *testing.T) {
+
+	var account Account
+	argon2Ctx := context.WithValue(ctx, internal.ConfigContextKey, &testArgon2)
+
+	if err := account.SetPassword(argon2Ctx, "foobar"); err != nil {
+		t.Fatalf("Unexpected error %s setting password", err)
+	} else if account.PasswordScheme != Argon2idScheme || !bytes.HasPrefix(account.SecurePassword, []byte("$argon2id$v=19$m=1024,t=1,p=1$")) {
+		t.Fatalf("Unexpected hash %s %s", account.PasswordScheme, account.SecurePassword)
+	}
+
+	hash := account.SecurePassword
+	if err := account.CheckPassword("foobar"); err != nil {
+		t.Errorf("Got unexpected CheckPassword failure %s", err)
+	} else if !bytes.Equal(hash, account.SecurePassword) {
+		t.Errorf("Expected an up-to-date hash to be left alone")
+	}
+
+	if err := account.CheckPassword("wat"); err != ErrPasswordMismatch {
+		t.Errorf("Expected ErrPasswordMismatch checking a wrong password, got %v", err)
+	}
+
+}
+
+func TestRehashPassword(t *testing.T) {
+
+	// an account saved before schemes were recorded, with a cheap bcrypt hash
+	account := Account{SecurePassword: fooBcrypt}
+	bcryptCtx := context.WithValue(ctx, internal.ConfigContextKey, &datastore.PropertyList{
+		{Name: "PasswordBcryptCost", Value: "7"},
+	})
+	argon2Ctx := context.WithValue(ctx, internal.ConfigContextKey, &testArgon2)
+
+	if err := account.CheckPassword("foo"); err != nil {
+		t.Fatalf("Got unexpected CheckPassword failure %s", err)
+	} else if !bytes.Equal(account.SecurePassword, fooBcrypt) {
+		t.Errorf("Expected CheckPassword to leave the hash alone")
+	}
+
+	if rehash, err := account.NeedsRehash(bcryptCtx); err != nil || !rehash {
+		t.Fatalf("Expected a cost 6 hash to need rehashing, got %v, error %v", rehash, err)
+	} else if err := account.Rehash(bcryptCtx, "foo"); err != nil {
+		t.Fatalf("Unexpected error %s rehashing", err)
+	} else if cost, _ := bcrypt.Cost(account.SecurePassword); cost != 7 || account.PasswordScheme != BcryptScheme {
+		t.Errorf("Expected a rehash with bcrypt cost 7, got %s with cost %d", account.PasswordScheme, cost)
+	} else if rehash, _ := account.NeedsRehash(bcryptCtx); rehash {
+		t.Errorf("Expected an up-to-date hash not to need rehashing")
+	}
+
+	if rehash, err := account.NeedsRehash(argon2Ctx); err != nil || !rehash {
+		t.Fatalf("Expected a bcrypt hash to need rehashing for argon2id, got %v, error %v", rehash, err)
+	} else if err := account.Rehash(argon2Ctx, "foo"); err != nil {
+		t.Fatalf("Unexpected error %s rehashing", err)
+	} else if account.PasswordScheme != Argon2idScheme {
+		t.Errorf("Expected a rehash with argon2id, got %s", account.PasswordScheme)
+	}
+
+	if err := account.CheckPassword("foo"); err != nil {
+		t.Errorf("Got unexpected CheckPassword failure %s after rehash", err)
+	}
+
+}
+
+func Test_parsePasswordHashing(t *testing.T) {
+
+	h := DefaultPasswordHashing
+	if err := parsePasswordHashing(&config.Global{
+		PasswordHashScheme:    "argon2id",
+		PasswordArgon2Memory:  "32768",
+		PasswordArgon2Threads: "2",
+	}, &h); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	} else if h.Scheme != Argon2idScheme || h.Argon2Memory != 32768 || h.Argon2Threads != 2 || h.Argon2Time != 1 {
+		t.Errorf("Unexpected hashing %+v", h)
+	}
+
+	for _, conf := range []config.Global{
+		{PasswordHashScheme: "md5"},
+		{PasswordBcryptCost: "2"},
+		{PasswordArgon2Threads: "256"},
+		{PasswordArgon2Time: "0"},
+	} {
+		h := DefaultPasswordHashing
+		if err := parsePasswordHashing(&conf, &h); err != ErrBadPasswordPolicy {
+			t.Errorf("Expected ErrBadPasswordPolicy for %+v, got %v", conf, err)
+		}
+	}
+
+}
@@ -0,0 +1,85 @@
+package account
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"time"
+)
+
+// IdentityEntity is the name of the Datastore entity used to link an account to an
+// identity at an external identity provider, such as an OpenID Connect issuer.
+// Identities are stored as descendants of the account's key, so Remove deletes them
+// along with the account.
+var IdentityEntity = "APIFederatedIdentity"
+
+// Identity links an account to the identity Subject at the identity provider Issuer.
+type Identity struct {
+	// Issuer identifies the identity provider, e.g. the iss claim of an OpenID Connect ID token.
+	Issuer string `json:"issuer"`
+	// Subject identifies the identity at Issuer, e.g. the sub claim of an OpenID Connect ID token.
+	Subject string `json:"subject"`
+	// LinkedAt is the time at which the identity was linked to the account.
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+func identityKey(ctx context.Context, email, issuer, subject string) *datastore.Key {
+	return datastore.NewKey(ctx, IdentityEntity, issuer+" "+subject, 0, datastore.NewKey(ctx, Entity, email, 0, nil))
+}
+
+// LinkIdentity links the account with email to subject at issuer. Linking an identity
+// that is already linked to the account does nothing.
+func LinkIdentity(ctx context.Context, email, issuer, subject string) error {
+
+	return nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		key := identityKey(txCtx, email, issuer, subject)
+		if err := nds.Get(txCtx, key.Parent(), &Account{}); err != nil {
+			return err
+		} else if err := nds.Get(txCtx, key, &Identity{}); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err := nds.Put(txCtx, key, &Identity{Issuer: issuer, Subject: subject, LinkedAt: time.Now()})
+		return err
+
+	}, nil)
+
+}
+
+// UnlinkIdentity removes the link between the account with email and subject at issuer.
+func UnlinkIdentity(ctx context.Context, email, issuer, subject string) error {
+	return nds.Delete(ctx, identityKey(ctx, email, issuer, subject))
+}
+
+// FindIdentity returns the email address of the account linked to subject at issuer,
+// or datastore.ErrNoSuchEntity if there is none. Since identities are found with
+// a query, one linked moments ago may not be found yet.
+func FindIdentity(ctx context.Context, issuer, subject string) (string, error) {
+
+	keys, err := datastore.NewQuery(IdentityEntity).
+		Filter("Issuer =", issuer).
+		Filter("Subject =", subject).
+		KeysOnly().
+		Limit(1).
+		GetAll(ctx, nil)
+
+	if err != nil {
+		return "", err
+	} else if len(keys) == 0 {
+		return "", datastore.ErrNoSuchEntity
+	}
+	return keys[0].Parent().StringID(), nil
+
+}
+
+// Identities lists the external identities linked to the account with email.
+func Identities(ctx context.Context, email string) ([]Identity, error) {
+
+	identities := []Identity{}
+	_, err := datastore.NewQuery(IdentityEntity).
+		Ancestor(datastore.NewKey(ctx, Entity, email, 0, nil)).
+		GetAll(ctx, &identities)
+	return identities, err
+
+}
@@ -0,0 +1,272 @@
+package account
+
+import (
+	"github.com/qedus/nds"
+	"github.com/the-information/ori/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"time"
+)
+
+// OrgEntity is the name of the Datastore entity used to store organizations.
+var OrgEntity = "APIOrganization"
+
+// MembershipEntity is the name of the Datastore entity used to store an account's
+// membership of an organization. Memberships are stored as descendants of the
+// account's key, so Remove deletes them along with the account.
+var MembershipEntity = "APIOrgMembership"
+
+var (
+	ErrOrgExists = errors.New(http.StatusConflict, "An organization with that ID already exists")
+	ErrNoSuchOrg = errors.New(http.StatusNotFound, "There is no organization with that ID")
+	ErrNotMember = errors.New(http.StatusNotFound, "The account is not a member of that organization")
+)
+
+// Organization groups accounts, such as the people working for one of your customers,
+// so that they can be given roles that apply only within it. See Membership.
+type Organization struct {
+	// ID identifies the organization, and is the string ID of its key.
+	ID string `json:"id" datastore:"-"`
+	// Name is the organization's name for people.
+	Name string `json:"name"`
+	// CreatedAt is the time at which the organization was created.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Membership records that an account belongs to an organization, and the roles it has
+// there. Roles are resolved against the configured RoleGraph, just like Account.Roles.
+type Membership struct {
+	// Org is the ID of the organization.
+	Org string `json:"org"`
+	// Email is the email address of the member account.
+	Email string `json:"email"`
+	// Roles are the roles the account has within the organization.
+	Roles []string `json:"roles"`
+	// JoinedAt is the time at which the account joined the organization.
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// current reports whether m belongs to org as it is now, rather than to an earlier organization
+// with the same ID. RemoveOrg finds memberships with an eventually consistent query, so it can
+// miss some, and they would otherwise come back to life if the ID were used again.
+func (m *Membership) current(org *Organization) bool {
+	return !m.JoinedAt.Before(org.CreatedAt)
+}
+
+// HasOrgRole checks if the account has role in the organization described by m, either
+// directly or because one of its roles there implies role according to the RoleGraph
+// configured for ctx.
+func (a *Account) HasOrgRole(ctx context.Context, m *Membership, role string) bool {
+	return m.Email == a.Email && roleGraph(ctx).Implies(m.Roles, role)
+}
+
+// OrgKey returns the datastore key of the organization identified by id.
+func OrgKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, OrgEntity, id, 0, nil)
+}
+
+func membershipKey(ctx context.Context, orgID, email string) *datastore.Key {
+	return datastore.NewKey(ctx, MembershipEntity, orgID, 0, datastore.NewKey(ctx, Entity, email, 0, nil))
+}
+
+// NewOrg creates an organization identified by id, returning ErrOrgExists if there
+// already is one.
+func NewOrg(ctx context.Context, id, name string) (*Organization, error) {
+
+	org := &Organization{
+		ID:        id,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+
+	err := nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		key := OrgKey(txCtx, id)
+		if err := nds.Get(txCtx, key, &Organization{}); err == nil {
+			return ErrOrgExists
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err := nds.Put(txCtx, key, org)
+		return err
+
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+
+}
+
+// GetOrg retrieves the organization identified by id and stores it in the value
+// pointed to by org. It returns ErrNoSuchOrg if there is none.
+func GetOrg(ctx context.Context, id string, org *Organization) error {
+
+	if err := nds.Get(ctx, OrgKey(ctx, id), org); err == datastore.ErrNoSuchEntity {
+		return ErrNoSuchOrg
+	} else if err != nil {
+		return err
+	}
+
+	org.ID = id
+	return nil
+
+}
+
+// RemoveOrg deletes the organization identified by id, along with its memberships.
+// Any memberships it misses are ignored from then on, even if the ID is used again.
+func RemoveOrg(ctx context.Context, id string) error {
+
+	keys, err := datastore.NewQuery(MembershipEntity).
+		Filter("Org =", id).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// memberships live in their accounts' entity groups, so they can't all be
+	// deleted in one transaction; delete the organization last, so that if
+	// this fails part of the way through it can be retried
+	if err := nds.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	return nds.Delete(ctx, OrgKey(ctx, id))
+
+}
+
+// SetMembership makes the account with email a member of the organization identified
+// by orgID with roles, replacing the roles it had there if it was a member already.
+func SetMembership(ctx context.Context, orgID, email string, roles []string) (*Membership, error) {
+
+	if roles == nil {
+		roles = []string{}
+	}
+
+	var membership Membership
+
+	err := nds.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+		var org Organization
+
+		key := membershipKey(txCtx, orgID, email)
+		if err := GetOrg(txCtx, orgID, &org); err != nil {
+			return err
+		} else if err := nds.Get(txCtx, key.Parent(), &Account{}); err != nil {
+			return err
+		} else if err := nds.Get(txCtx, key, &membership); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		} else if err == datastore.ErrNoSuchEntity || !membership.current(&org) {
+			membership = Membership{Org: orgID, Email: email, JoinedAt: time.Now()}
+		}
+
+		membership.Roles = roles
+		_, err := nds.Put(txCtx, key, &membership)
+		return err
+
+	}, xgTransaction)
+
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+
+}
+
+// GetMembership retrieves the membership of the account with email in the organization
+// identified by orgID and stores it in the value pointed to by membership. It returns
+// ErrNotMember if the account isn't a member, or if there is no such organization.
+func GetMembership(ctx context.Context, orgID, email string, membership *Membership) error {
+
+	var org Organization
+
+	if err := GetOrg(ctx, orgID, &org); err == ErrNoSuchOrg {
+		return ErrNotMember
+	} else if err != nil {
+		return err
+	} else if err := nds.Get(ctx, membershipKey(ctx, orgID, email), membership); err == datastore.ErrNoSuchEntity {
+		return ErrNotMember
+	} else if err != nil {
+		return err
+	} else if !membership.current(&org) {
+		return ErrNotMember
+	} else {
+		return nil
+	}
+
+}
+
+// RemoveMembership removes the account with email from the organization identified by orgID.
+func RemoveMembership(ctx context.Context, orgID, email string) error {
+	return nds.Delete(ctx, membershipKey(ctx, orgID, email))
+}
+
+// Members lists the memberships of the organization identified by orgID. It returns
+// ErrNoSuchOrg if there is no such organization.
+func Members(ctx context.Context, orgID string) ([]Membership, error) {
+
+	var org Organization
+	var found []Membership
+
+	if err := GetOrg(ctx, orgID, &org); err != nil {
+		return nil, err
+	} else if _, err := datastore.NewQuery(MembershipEntity).Filter("Org =", orgID).GetAll(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	members := []Membership{}
+	for _, m := range found {
+		if m.current(&org) {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+
+}
+
+// Memberships lists the memberships of the account with email, from its own entity group,
+// so they are always up to date.
+func Memberships(ctx context.Context, email string) ([]Membership, error) {
+
+	var found []Membership
+
+	if _, err := datastore.NewQuery(MembershipEntity).
+		Ancestor(datastore.NewKey(ctx, Entity, email, 0, nil)).
+		GetAll(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	orgKeys := make([]*datastore.Key, len(found))
+	for i, m := range found {
+		orgKeys[i] = OrgKey(ctx, m.Org)
+	}
+
+	orgs := make([]Organization, len(found))
+	switch t := nds.GetMulti(ctx, orgKeys, orgs).(type) {
+	case appengine.MultiError:
+		for _, mErr := range t {
+			if mErr != nil && mErr != datastore.ErrNoSuchEntity {
+				return nil, t
+			}
+		}
+	case nil:
+		// do nothing
+	default:
+		return nil, t
+	}
+
+	// leave out memberships of organizations that have since been removed, which are
+	// left zero above
+	memberships := []Membership{}
+	for i, m := range found {
+		if !orgs[i].CreatedAt.IsZero() && m.current(&orgs[i]) {
+			memberships = append(memberships, m)
+		}
+	}
+	return memberships, nil
+
+}
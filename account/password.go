@@ -0,0 +1,256 @@
+package account
+
+import (
+	"bufio"
+	"github.com/the-information/ori/config"
+	"github.com/the-information/ori/errors"
+	"golang.org/x/net/context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BcryptMaxLength is the length in bytes beyond which bcrypt ignores the rest of a password.
+const BcryptMaxLength = 72
+
+// The rules a PasswordPolicy checks. A PasswordPolicyError lists the ones a password broke.
+const (
+	PasswordTooShort   = "too_short"
+	PasswordTooLong    = "too_long"
+	PasswordNeedsLower = "lower"
+	PasswordNeedsUpper = "upper"
+	PasswordNeedsDigit = "digit"
+	PasswordNeedsOther = "symbol"
+	PasswordBlocked    = "blocked"
+)
+
+var ErrBadPasswordPolicy = errors.New(http.StatusInternalServerError, "The password policy for this app is invalid")
+
+// ErrPasswordTooShort was returned by SetPassword for passwords under six characters.
+//
+// Deprecated: SetPassword now returns a *PasswordPolicyError; check whether it
+// Broke(PasswordTooShort) instead.
+var ErrPasswordTooShort = errors.New(http.StatusBadRequest, "Password is too short")
+
+// PasswordPolicyError is returned by SetPassword when a password breaks one or more
+// rules of the PasswordPolicy. rest.WriteJSON writes it as a 400 listing every rule
+// the password broke.
+type PasswordPolicyError struct {
+	Message string `json:"message"`
+	// Rules lists the rules the password broke, such as PasswordTooShort.
+	Rules []string `json:"rules"`
+	// Details describes each rule in Rules for people, in the same order.
+	Details []string `json:"details"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Message + ": " + strings.Join(e.Details, "; ")
+}
+
+func (e *PasswordPolicyError) Code() int {
+	return http.StatusBadRequest
+}
+
+// Broke reports whether the password broke rule.
+func (e *PasswordPolicyError) Broke(rule string) bool {
+
+	for _, r := range e.Rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+
+}
+
+func (e *PasswordPolicyError) add(rule, detail string) {
+	e.Rules = append(e.Rules, rule)
+	e.Details = append(e.Details, detail)
+}
+
+// PasswordPolicy describes what SetPassword accepts as a password.
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+	// MaxLength is the most bytes a password may have. It can be no more than BcryptMaxLength.
+	MaxLength int
+	// RequiredClasses lists the classes of character a password must contain at least
+	// one of: PasswordNeedsLower, PasswordNeedsUpper, PasswordNeedsDigit and PasswordNeedsOther.
+	RequiredClasses []string
+	// Blocklist holds passwords that may not be used, in lower case.
+	Blocklist map[string]bool
+	// Hashing is how passwords are hashed.
+	Hashing PasswordHashing
+}
+
+// DefaultPasswordPolicy is the policy used when config.Global sets none.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 6,
+	MaxLength: BcryptMaxLength,
+	Hashing:   DefaultPasswordHashing,
+}
+
+var passwordClasses = map[string]func(rune) bool{
+	PasswordNeedsLower: unicode.IsLower,
+	PasswordNeedsUpper: unicode.IsUpper,
+	PasswordNeedsDigit: unicode.IsDigit,
+	PasswordNeedsOther: func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	},
+}
+
+var passwordClassDetails = map[string]string{
+	PasswordNeedsLower: "must contain a lowercase letter",
+	PasswordNeedsUpper: "must contain an uppercase letter",
+	PasswordNeedsDigit: "must contain a digit",
+	PasswordNeedsOther: "must contain a character that is neither a letter nor a digit",
+}
+
+// Check returns a *PasswordPolicyError listing every rule password breaks, or nil.
+func (p *PasswordPolicy) Check(password string) error {
+
+	result := &PasswordPolicyError{Message: "Password does not meet the password policy"}
+
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		result.add(PasswordTooShort, "must be at least "+strconv.Itoa(p.MinLength)+" characters long")
+	}
+
+	maxLength := p.MaxLength
+	if maxLength <= 0 || maxLength > BcryptMaxLength {
+		maxLength = BcryptMaxLength
+	}
+	if len(password) > maxLength {
+		result.add(PasswordTooLong, "must be at most "+strconv.Itoa(maxLength)+" bytes long")
+	}
+
+	for _, class := range p.RequiredClasses {
+		if strings.IndexFunc(password, passwordClasses[class]) == -1 {
+			result.add(class, passwordClassDetails[class])
+		}
+	}
+
+	if p.Blocklist[strings.ToLower(password)] {
+		result.add(PasswordBlocked, "is too common")
+	}
+
+	if len(result.Rules) > 0 {
+		return result
+	}
+	return nil
+
+}
+
+// GetPasswordPolicy returns the PasswordPolicy described by the password settings in
+// config.Global for ctx. If ctx was not run through config.Middleware, or config.Global
+// sets none, it returns DefaultPasswordPolicy.
+func GetPasswordPolicy(ctx context.Context) (*PasswordPolicy, error) {
+
+	var conf config.Global
+
+	if err := config.Get(ctx, &conf); err == config.ErrNotInConfigContext {
+		policy := DefaultPasswordPolicy
+		return &policy, nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		return ParsePasswordPolicy(&conf)
+	}
+
+}
+
+// ParsePasswordPolicy builds a PasswordPolicy from the password settings in conf,
+// falling back on DefaultPasswordPolicy for each one that isn't set.
+func ParsePasswordPolicy(conf *config.Global) (*PasswordPolicy, error) {
+
+	policy := DefaultPasswordPolicy
+
+	if conf.PasswordMinLength != "" {
+		if n, err := strconv.Atoi(conf.PasswordMinLength); err != nil || n < 0 {
+			return nil, ErrBadPasswordPolicy
+		} else {
+			policy.MinLength = n
+		}
+	}
+
+	if conf.PasswordMaxLength != "" {
+		if n, err := strconv.Atoi(conf.PasswordMaxLength); err != nil || n < 1 || n > BcryptMaxLength {
+			return nil, ErrBadPasswordPolicy
+		} else {
+			policy.MaxLength = n
+		}
+	}
+
+	if policy.MinLength > policy.MaxLength {
+		return nil, ErrBadPasswordPolicy
+	}
+
+	if conf.PasswordRequiredClasses != "" {
+		for _, class := range strings.Split(conf.PasswordRequiredClasses, ",") {
+			class = strings.TrimSpace(class)
+			if _, ok := passwordClasses[class]; !ok {
+				return nil, ErrBadPasswordPolicy
+			}
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		}
+	}
+
+	if err := parsePasswordHashing(conf, &policy.Hashing); err != nil {
+		return nil, err
+	}
+
+	if conf.PasswordBlocklistFile != "" {
+		if blocklist, err := loadPasswordBlocklist(conf.PasswordBlocklistFile); err != nil {
+			return nil, err
+		} else {
+			policy.Blocklist = blocklist
+		}
+	}
+
+	return &policy, nil
+
+}
+
+var blocklists = struct {
+	sync.Mutex
+	byPath map[string]map[string]bool
+}{byPath: map[string]map[string]bool{}}
+
+// loadPasswordBlocklist reads the blocklist at path, one password per line, ignoring
+// blank lines and lines starting with #. Blocklists are cached for the life of the instance,
+// since they are deployed with the app.
+func loadPasswordBlocklist(path string) (map[string]bool, error) {
+
+	blocklists.Lock()
+	defer blocklists.Unlock()
+
+	if blocklist, ok := blocklists.byPath[path]; ok {
+		return blocklist, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blocklist := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			blocklist[strings.ToLower(line)] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	blocklists.byPath[path] = blocklist
+	return blocklist, nil
+
+}
@@ -0,0 +1,87 @@
+package account
+
+import (
+	"github.com/the-information/ori/config"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+
+	policy := PasswordPolicy{
+		MinLength:       10,
+		MaxLength:       20,
+		RequiredClasses: []string{PasswordNeedsUpper, PasswordNeedsDigit, PasswordNeedsOther},
+		Blocklist:       map[string]bool{"password123!a": true},
+	}
+
+	if err := policy.Check("Correct-horse-9"); err != nil {
+		t.Errorf("Unexpected error %s for a good password", err)
+	}
+
+	err, ok := policy.Check("short").(*PasswordPolicyError)
+	if !ok {
+		t.Fatalf("Expected a *PasswordPolicyError, got %v", err)
+	}
+	for _, rule := range []string{PasswordTooShort, PasswordNeedsUpper, PasswordNeedsDigit, PasswordNeedsOther} {
+		if !err.Broke(rule) {
+			t.Errorf("Expected %q to break rule %s, got %+v", "short", rule, err)
+		}
+	}
+	if err.Broke(PasswordTooLong) || err.Broke(PasswordNeedsLower) || len(err.Details) != len(err.Rules) {
+		t.Errorf("Unexpected rules broken: %+v", err)
+	}
+
+	if err, ok := policy.Check("Password123!A").(*PasswordPolicyError); !ok || !err.Broke(PasswordBlocked) {
+		t.Errorf("Expected a blocked password, got %v", err)
+	}
+
+	if err, ok := policy.Check("A1!" + strings.Repeat("x", 20)).(*PasswordPolicyError); !ok || !err.Broke(PasswordTooLong) {
+		t.Errorf("Expected a password that is too long, got %v", err)
+	}
+
+	// bcrypt's limit applies even if MaxLength doesn't say so
+	unbounded := PasswordPolicy{}
+	if err, ok := unbounded.Check(strings.Repeat("x", BcryptMaxLength+1)).(*PasswordPolicyError); !ok || !err.Broke(PasswordTooLong) {
+		t.Errorf("Expected a password over %d bytes to be too long, got %v", BcryptMaxLength, err)
+	}
+
+}
+
+func TestParsePasswordPolicy(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# common passwords\n\nLetMeIn\nqwerty123\n")
+	f.Close()
+
+	policy, err := ParsePasswordPolicy(&config.Global{
+		PasswordMinLength:       "8",
+		PasswordRequiredClasses: "lower, digit",
+		PasswordBlocklistFile:   f.Name(),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	} else if policy.MinLength != 8 || policy.MaxLength != BcryptMaxLength || len(policy.RequiredClasses) != 2 {
+		t.Errorf("Unexpected policy %+v", policy)
+	} else if !policy.Blocklist["letmein"] || !policy.Blocklist["qwerty123"] || len(policy.Blocklist) != 2 {
+		t.Errorf("Unexpected blocklist %+v", policy.Blocklist)
+	}
+
+	for _, conf := range []config.Global{
+		{PasswordMinLength: "-1"},
+		{PasswordMaxLength: "73"},
+		{PasswordMinLength: "30", PasswordMaxLength: "20"},
+		{PasswordRequiredClasses: "emoji"},
+	} {
+		if _, err := ParsePasswordPolicy(&conf); err != ErrBadPasswordPolicy {
+			t.Errorf("Expected ErrBadPasswordPolicy for %+v, got %v", conf, err)
+		}
+	}
+
+}
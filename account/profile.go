@@ -0,0 +1,120 @@
+package account
+
+import (
+	"github.com/the-information/ori/errors"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// profilePrefix is prepended to the names of profile properties in the account's entity.
+const profilePrefix = "Profile."
+
+var ErrNoProfile = errors.New(http.StatusBadRequest, "This app has not registered a profile for accounts")
+
+var profile struct {
+	sync.RWMutex
+	t reflect.Type
+}
+
+// RegisterProfile registers the type of the app's account profile, which is stored
+// in Account.Profile and saved in the same entity as the account. prototype must be
+// a pointer to a struct that datastore.SaveStruct can save, such as:
+//	type Profile struct {
+//		DisplayName string `json:"displayName"`
+//		Newsletter  bool   `json:"newsletter"`
+//	}
+//
+//	func init() {
+//		account.RegisterProfile(&Profile{})
+//	}
+// Register it before any account is loaded. Afterwards, Account.Profile always holds
+// a pointer of the same type, e.g. acct.Profile.(*Profile).
+func RegisterProfile(prototype interface{}) {
+
+	t := reflect.TypeOf(prototype)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("account: RegisterProfile needs a pointer to a struct")
+	}
+
+	profile.Lock()
+	profile.t = t.Elem()
+	profile.Unlock()
+
+}
+
+// NewProfile returns a pointer to a new, empty value of the type registered with
+// RegisterProfile, or nil if none has been.
+func NewProfile() interface{} {
+
+	profile.RLock()
+	defer profile.RUnlock()
+
+	if profile.t == nil {
+		return nil
+	}
+	return reflect.New(profile.t).Interface()
+
+}
+
+// Load implements datastore.PropertyLoadSaver. Properties whose names start with
+// "Profile." are loaded into a new Profile.
+func (a *Account) Load(props []datastore.Property) error {
+
+	var own, profileProps []datastore.Property
+
+	for _, prop := range props {
+		if strings.HasPrefix(prop.Name, profilePrefix) {
+			prop.Name = strings.TrimPrefix(prop.Name, profilePrefix)
+			profileProps = append(profileProps, prop)
+		} else {
+			own = append(own, prop)
+		}
+	}
+
+	if err := datastore.LoadStruct(a, own); err != nil {
+		return err
+	}
+
+	a.Profile = NewProfile()
+	if a.Profile == nil {
+		// keep them as they are, so they aren't lost when the account is saved
+		a.profileProps = profileProps
+		return nil
+	}
+
+	a.profileProps = nil
+	return datastore.LoadStruct(a.Profile, profileProps)
+
+}
+
+// Save implements datastore.PropertyLoadSaver. Profile is saved alongside the
+// account's own properties, with their names prefixed by "Profile.".
+func (a *Account) Save() ([]datastore.Property, error) {
+
+	props, err := datastore.SaveStruct(a)
+	if err != nil {
+		return nil, err
+	}
+
+	profileProps := a.profileProps
+	if a.Profile != nil {
+
+		if NewProfile() == nil {
+			return nil, ErrNoProfile
+		} else if profileProps, err = datastore.SaveStruct(a.Profile); err != nil {
+			return nil, err
+		}
+
+	}
+
+	for _, prop := range profileProps {
+		prop.Name = profilePrefix + prop.Name
+		props = append(props, prop)
+	}
+
+	return props, nil
+
+}
@@ -0,0 +1,111 @@
+package account
+
+import (
+	"encoding/json"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+type testProfile struct {
+	DisplayName string `json:"displayName"`
+	Newsletter  bool   `json:"newsletter"`
+}
+
+func withTestProfile(f func()) {
+
+	RegisterProfile(&testProfile{})
+	defer func() {
+		profile.Lock()
+		profile.t = nil
+		profile.Unlock()
+	}()
+
+	f()
+
+}
+
+func TestProfileProperties(t *testing.T) {
+
+	var acct Account
+	props := []datastore.Property{
+		{Name: "Email", Value: "foo@bar.com"},
+		{Name: "Profile.DisplayName", Value: "Foo"},
+		{Name: "Profile.Newsletter", Value: true},
+	}
+
+	// without a registered profile, profile properties survive a round trip
+	if err := acct.Load(props); err != nil {
+		t.Fatalf("Unexpected error %s loading", err)
+	} else if acct.Profile != nil || acct.Email != "foo@bar.com" {
+		t.Errorf("Unexpected account %+v", acct)
+	}
+
+	saved, err := acct.Save()
+	if err != nil {
+		t.Fatalf("Unexpected error %s saving", err)
+	} else if !hasProperty(saved, "Profile.DisplayName", "Foo") || !hasProperty(saved, "Profile.Newsletter", true) {
+		t.Errorf("Expected profile properties to be kept, got %+v", saved)
+	}
+
+	withTestProfile(func() {
+
+		acct = Account{}
+		if err := acct.Load(props); err != nil {
+			t.Fatalf("Unexpected error %s loading", err)
+		} else if p, ok := acct.Profile.(*testProfile); !ok || p.DisplayName != "Foo" || !p.Newsletter {
+			t.Fatalf("Unexpected profile %+v", acct.Profile)
+		}
+
+		// JSON merges into the profile, as the admin PATCH route does
+		if err := json.Unmarshal([]byte(`{"profile":{"displayName":"Bar"}}`), &acct); err != nil {
+			t.Fatalf("Unexpected error %s unmarshaling", err)
+		} else if p := acct.Profile.(*testProfile); p.DisplayName != "Bar" || !p.Newsletter {
+			t.Errorf("Expected the profile to be merged, got %+v", p)
+		}
+
+		if saved, err := acct.Save(); err != nil {
+			t.Fatalf("Unexpected error %s saving", err)
+		} else if !hasProperty(saved, "Profile.DisplayName", "Bar") || !hasProperty(saved, "Email", "foo@bar.com") {
+			t.Errorf("Unexpected properties %+v", saved)
+		}
+
+	})
+
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+
+	withTestProfile(func() {
+
+		var acct Account
+
+		created, err := New(ctx, "profile@bar.com", "foobar")
+		if err != nil {
+			t.Fatalf("Unexpected error %s creating account", err)
+		}
+
+		created.Profile.(*testProfile).DisplayName = "Foo"
+		if err := Save(ctx, created); err != nil {
+			t.Fatalf("Unexpected error %s saving account", err)
+		}
+
+		if err := Get(ctx, "profile@bar.com", &acct); err != nil {
+			t.Fatalf("Unexpected error %s getting account", err)
+		} else if p, ok := acct.Profile.(*testProfile); !ok || p.DisplayName != "Foo" {
+			t.Errorf("Unexpected profile %+v", acct.Profile)
+		}
+
+	})
+
+}
+
+func hasProperty(props []datastore.Property, name string, value interface{}) bool {
+
+	for _, prop := range props {
+		if prop.Name == name && prop.Value == value {
+			return true
+		}
+	}
+	return false
+
+}
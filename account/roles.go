@@ -0,0 +1,95 @@
+package account
+
+import (
+	"encoding/json"
+	"github.com/the-information/ori/config"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// RoleGraph describes which roles imply which other roles. Each key is a role,
+// and its value is the list of roles anyone holding it also holds, so that
+//	RoleGraph{"admin": {"editor"}, "editor": {"viewer"}}
+// grants an admin the editor and viewer roles too. Implications are transitive,
+// and cycles are harmless.
+type RoleGraph map[string][]string
+
+// ParseRoleGraph decodes a RoleGraph from its JSON representation. The empty string
+// is an empty graph.
+func ParseRoleGraph(data string) (RoleGraph, error) {
+
+	graph := RoleGraph{}
+
+	if data == "" {
+		return graph, nil
+	} else if err := json.Unmarshal([]byte(data), &graph); err != nil {
+		return nil, err
+	} else {
+		return graph, nil
+	}
+
+}
+
+// GetRoleGraph returns the RoleGraph stored in config.Global.RoleGraph for ctx. If ctx
+// was not run through config.Middleware, it returns an empty graph.
+func GetRoleGraph(ctx context.Context) (RoleGraph, error) {
+
+	var conf config.Global
+
+	if err := config.Get(ctx, &conf); err == config.ErrNotInConfigContext {
+		return RoleGraph{}, nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		return ParseRoleGraph(conf.RoleGraph)
+	}
+
+}
+
+// roleGraph returns the RoleGraph for ctx, as GetRoleGraph does. If the configured graph
+// can't be read, it logs why and returns an empty graph, so only roles held directly count.
+func roleGraph(ctx context.Context) RoleGraph {
+
+	graph, err := GetRoleGraph(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Error reading role graph: %s", err.Error())
+		return RoleGraph{}
+	}
+	return graph
+
+}
+
+// Expand returns roles along with every role they imply, without duplicates.
+func (graph RoleGraph) Expand(roles []string) []string {
+
+	seen := make(map[string]bool, len(roles))
+	expanded := make([]string, 0, len(roles))
+
+	queue := append([]string{}, roles...)
+	for len(queue) > 0 {
+		role := queue[0]
+		queue = queue[1:]
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+		expanded = append(expanded, role)
+		queue = append(queue, graph[role]...)
+	}
+
+	return expanded
+
+}
+
+// Implies checks whether holding roles means holding role too.
+func (graph RoleGraph) Implies(roles []string, role string) bool {
+
+	for _, r := range graph.Expand(roles) {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+
+}
@@ -0,0 +1,202 @@
+package account
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/the-information/ori/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP settings. They are the ones authenticator apps assume, so they aren't configurable.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+	// TOTPSkew is the number of periods either side of now in which a code is accepted,
+	// to allow for slow typists and drifting clocks.
+	TOTPSkew = 1
+	// RecoveryCodeCount is the number of recovery codes ConfirmTOTP generates.
+	RecoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPNotEnrolled    = errors.New(http.StatusBadRequest, "Two-factor authentication has not been set up for this account")
+	ErrTOTPAlreadyEnabled = errors.New(http.StatusConflict, "Two-factor authentication is already enabled for this account")
+	ErrInvalidTOTPCode    = errors.New(http.StatusUnauthorized, "The two-factor authentication code is incorrect or has already been used")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is what an account needs to add itself to an authenticator app.
+type TOTPEnrollment struct {
+	// Secret is the base32-encoded TOTP secret, for typing in by hand.
+	Secret string `json:"secret"`
+	// URI is the otpauth:// URI of the secret, for showing as a QR code.
+	URI string `json:"uri"`
+}
+
+// EnrollTOTP generates a new TOTP secret for the account and returns it, along with an
+// otpauth:// URI naming issuer, for the account's owner to add to their authenticator app.
+// Two-factor authentication isn't enabled until the owner proves they have done so with
+// ConfirmTOTP. It returns ErrTOTPAlreadyEnabled if it already is.
+func (a *Account) EnrollTOTP(issuer string) (*TOTPEnrollment, error) {
+
+	if a.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	a.TOTPSecret = secret
+	a.TOTPLastStep = 0
+
+	encoded := totpEncoding.EncodeToString(secret)
+	params := url.Values{}
+	params.Set("secret", encoded)
+	params.Set("issuer", issuer)
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + a.Email,
+		RawQuery: params.Encode(),
+	}
+
+	return &TOTPEnrollment{Secret: encoded, URI: uri.String()}, nil
+
+}
+
+// ConfirmTOTP enables two-factor authentication for an account that has called EnrollTOTP,
+// given a current code from the owner's authenticator app. It returns a fresh set of
+// single-use recovery codes for the owner to keep somewhere safe; only their hashes are
+// stored, so this is the only time they are available.
+func (a *Account) ConfirmTOTP(code string, now time.Time) ([]string, error) {
+
+	if a.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	} else if len(a.TOTPSecret) == 0 {
+		return nil, ErrTOTPNotEnrolled
+	} else if err := a.checkTOTP(code, now); err != nil {
+		return nil, err
+	}
+
+	codes, err := a.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	a.TOTPEnabled = true
+	return codes, nil
+
+}
+
+// CheckTOTP checks code against the account's authenticator app at time now. Each code
+// can only be used once, so the account should be saved afterwards.
+func (a *Account) CheckTOTP(code string, now time.Time) error {
+
+	if !a.TOTPEnabled {
+		return ErrTOTPNotEnrolled
+	}
+	return a.checkTOTP(code, now)
+
+}
+
+// UseRecoveryCode checks code against the account's unused recovery codes, and uses
+// it up if it matches, so the account should be saved afterwards.
+func (a *Account) UseRecoveryCode(code string) error {
+
+	if !a.TOTPEnabled {
+		return ErrTOTPNotEnrolled
+	}
+
+	hashed := hashRecoveryCode(code)
+	for i, stored := range a.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+			a.RecoveryCodes = append(a.RecoveryCodes[:i], a.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrInvalidTOTPCode
+
+}
+
+// DisableTOTP turns two-factor authentication off for the account and forgets its
+// secret and recovery codes.
+func (a *Account) DisableTOTP() {
+	a.TOTPEnabled = false
+	a.TOTPSecret = nil
+	a.TOTPLastStep = 0
+	a.RecoveryCodes = nil
+}
+
+func (a *Account) checkTOTP(code string, now time.Time) error {
+
+	step := now.Unix() / int64(TOTPPeriod/time.Second)
+	for s := step - TOTPSkew; s <= step+TOTPSkew; s++ {
+		// codes from steps at or before the last one used can't be replayed
+		if s > a.TOTPLastStep && subtle.ConstantTimeCompare([]byte(totpCode(a.TOTPSecret, s)), []byte(code)) == 1 {
+			a.TOTPLastStep = s
+			return nil
+		}
+	}
+
+	return ErrInvalidTOTPCode
+
+}
+
+func (a *Account) newRecoveryCodes() ([]string, error) {
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	a.RecoveryCodes = hashes
+	return codes, nil
+
+}
+
+// hashRecoveryCode hashes a recovery code for storage, ignoring case and dashes
+// so people can type codes back however they like.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
+
+// totpCode computes the TOTP code for secret at step, as described in RFC 6238.
+func totpCode(secret []byte, step int64) string {
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+
+}
@@ -0,0 +1,86 @@
+package account
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_totpCode(t *testing.T) {
+
+	// the SHA-1 test vectors from RFC 6238, truncated to six digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, code := range vectors {
+		if got := totpCode(secret, unix/30); got != code {
+			t.Errorf("Expected code %s at %d, got %s", code, unix, got)
+		}
+	}
+
+}
+
+func TestTOTP(t *testing.T) {
+
+	account := Account{Email: "foo@bar.com"}
+	now := time.Unix(1500000000, 0)
+
+	enrollment, err := account.EnrollTOTP("Example")
+	if err != nil {
+		t.Fatalf("Unexpected error %s enrolling", err)
+	}
+
+	uri, err := url.Parse(enrollment.URI)
+	if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Example:foo@bar.com" || uri.Query().Get("secret") != enrollment.Secret {
+		t.Errorf("Unexpected URI %s", enrollment.URI)
+	}
+
+	if err := account.CheckTOTP(totpCode(account.TOTPSecret, now.Unix()/30), now); err != ErrTOTPNotEnrolled {
+		t.Errorf("Expected ErrTOTPNotEnrolled before confirming, got %v", err)
+	}
+
+	if _, err := account.ConfirmTOTP("000000", now); err != ErrInvalidTOTPCode {
+		t.Errorf("Expected ErrInvalidTOTPCode confirming with a bad code, got %v", err)
+	}
+
+	codes, err := account.ConfirmTOTP(totpCode(account.TOTPSecret, now.Unix()/30), now)
+	if err != nil {
+		t.Fatalf("Unexpected error %s confirming", err)
+	} else if !account.TOTPEnabled || len(codes) != RecoveryCodeCount || len(account.RecoveryCodes) != RecoveryCodeCount {
+		t.Fatalf("Expected TOTP enabled with %d recovery codes, got %+v", RecoveryCodeCount, codes)
+	}
+
+	if _, err := account.EnrollTOTP("Example"); err != ErrTOTPAlreadyEnabled {
+		t.Errorf("Expected ErrTOTPAlreadyEnabled, got %v", err)
+	}
+
+	// the code used to confirm can't be used again
+	if err := account.CheckTOTP(totpCode(account.TOTPSecret, now.Unix()/30), now); err != ErrInvalidTOTPCode {
+		t.Errorf("Expected a replayed code to fail, got %v", err)
+	}
+
+	later := now.Add(TOTPPeriod)
+	if err := account.CheckTOTP(totpCode(account.TOTPSecret, later.Unix()/30), later); err != nil {
+		t.Errorf("Unexpected error %s checking a fresh code", err)
+	}
+
+	if err := account.UseRecoveryCode(strings.ToUpper(codes[3])); err != nil {
+		t.Errorf("Unexpected error %s using a recovery code", err)
+	} else if err := account.UseRecoveryCode(codes[3]); err != ErrInvalidTOTPCode {
+		t.Errorf("Expected a used recovery code to fail, got %v", err)
+	} else if len(account.RecoveryCodes) != RecoveryCodeCount-1 {
+		t.Errorf("Expected %d recovery codes left, got %d", RecoveryCodeCount-1, len(account.RecoveryCodes))
+	}
+
+	account.DisableTOTP()
+	if account.TOTPEnabled || account.TOTPSecret != nil || account.RecoveryCodes != nil {
+		t.Errorf("Expected TOTP to be forgotten, got %+v", account)
+	}
+
+}
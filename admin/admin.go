@@ -3,16 +3,21 @@ package admin
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"github.com/guregu/kami"
 	"github.com/the-information/ori/account"
 	"github.com/the-information/ori/account/auth"
 	"github.com/the-information/ori/admin/dsimport"
+	"github.com/the-information/ori/audit"
 	"github.com/the-information/ori/config"
 	"github.com/the-information/ori/errors"
+	"github.com/the-information/ori/query"
 	"github.com/the-information/ori/rest"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/jws"
+	"google.golang.org/appengine/datastore"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,14 +38,40 @@ func NewHandler(route string) *kami.Mux {
 
 	ori.Get(route+"config", auth.Check(auth.Super).Then(getConfig))
 	ori.Patch(route+"config", auth.Check(auth.Super).Then(changeConfig))
+	ori.Post(route+"keys", auth.Check(auth.Super).Then(rotateKeys))
 
+	ori.Get(route+"accounts", auth.Check(auth.Super).Then(listAccounts))
 	ori.Post(route+"accounts", auth.Check(auth.Super).Then(newAccount))
 	ori.Get(route+"accounts/:id", auth.Check(auth.Super).Then(getAccount))
 	ori.Delete(route+"accounts/:id", auth.Check(auth.Super).Then(deleteAccount))
+	ori.Post(route+"accounts/:id/removal", auth.Check(auth.Super).Then(removeAccountBatch))
 	ori.Patch(route+"accounts/:id", auth.Check(auth.Super).Then(changeAccount))
 	ori.Post(route+"accounts/:id/password", auth.Check(auth.Super).Then(changeAccountPassword))
 	ori.Get(route+"accounts/:id/jwt", auth.Check(auth.Super).Then(getJwt))
+	ori.Get(route+"accounts/:id/roles", auth.Check(auth.Super).Then(getAccountRoles))
+	ori.Get(route+"accounts/:id/export", auth.Check(auth.Super).Then(exportAccount))
+	ori.Delete(route+"accounts/:id/tokens", auth.Check(auth.Super).Then(revokeAccountTokens))
+	ori.Get(route+"accounts/:id/lockout", auth.Check(auth.Super).Then(getAccountLockout))
+	ori.Delete(route+"accounts/:id/lockout", auth.Check(auth.Super).Then(unlockAccount))
+	ori.Delete(route+"accounts/:id/totp", auth.Check(auth.Super).Then(disableAccountTOTP))
+	ori.Post(route+"accounts/:id/disable", auth.Check(auth.Super).Then(disableAccount))
+	ori.Delete(route+"accounts/:id/disable", auth.Check(auth.Super).Then(enableAccount))
+	ori.Get(route+"accounts/:id/sessions", auth.Check(auth.Super).Then(listSessions))
+	ori.Delete(route+"accounts/:id/sessions/:session", auth.Check(auth.Super).Then(revokeSession))
+	ori.Delete(route+"tokens/:jti", auth.Check(auth.Super).Then(revokeToken))
+	ori.Get(route+"orgs", auth.Check(auth.Super).Then(listOrgs))
+	ori.Post(route+"orgs", auth.Check(auth.Super).Then(newOrg))
+	ori.Get(route+"orgs/:org", auth.Check(auth.Super).Then(getOrg))
+	ori.Delete(route+"orgs/:org", auth.Check(auth.Super).Then(deleteOrg))
+	ori.Get(route+"orgs/:org/members", auth.Check(auth.Super).Then(listOrgMembers))
+	ori.Put(route+"orgs/:org/members/:id", auth.Check(auth.Super).Then(setOrgMember))
+	ori.Delete(route+"orgs/:org/members/:id", auth.Check(auth.Super).Then(removeOrgMember))
+	ori.Post(route+"accounts/:id/apikeys", auth.Check(auth.Super).Then(newAPIKey))
+	ori.Get(route+"accounts/:id/apikeys", auth.Check(auth.Super).Then(listAPIKeys))
+	ori.Delete(route+"accounts/:id/apikeys/:keyId", auth.Check(auth.Super).Then(revokeAPIKey))
 	ori.Post(route+"load", auth.Check(auth.Super).Then(loadEntities))
+	ori.Get(route+"audit", auth.Check(auth.Super).Then(listAudit))
+	ori.Get(route+"jwks.json", auth.JWKSHandler)
 
 	return ori
 
@@ -57,13 +88,35 @@ func getConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 }
 
+// ErrAuthSecretSet is returned when a config change would replace the app's AuthSecret,
+// which would invalidate every JWT signed with it at once.
+var ErrAuthSecretSet = errors.New(http.StatusConflict, "The app already has an AuthSecret; use `ori secret rotate` to change the keys JWTs are signed with")
+
+// authSecret returns the AuthSecret in conf, if it has one.
+func authSecret(conf config.Config) interface{} {
+
+	for _, prop := range conf {
+		if prop.Name == "AuthSecret" && prop.Value != "" {
+			return prop.Value
+		}
+	}
+	return nil
+
+}
+
 func changeConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	conf := config.Config{}
 	if err := config.Get(ctx, &conf); err != nil {
 		rest.WriteJSON(w, err)
-	} else if err := rest.ReadJSON(r, &conf); err != nil {
+		return
+	}
+
+	secret := authSecret(conf)
+	if err := rest.ReadJSON(r, &conf); err != nil {
 		rest.WriteJSON(w, err)
+	} else if secret != nil && authSecret(conf) != secret {
+		rest.WriteJSON(w, ErrAuthSecretSet)
 	} else if err := config.Save(ctx, &conf); err != nil {
 		rest.WriteJSON(w, err)
 	} else {
@@ -72,6 +125,171 @@ func changeConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 }
 
+type keyRotationRequest struct {
+	GracePeriod string
+}
+
+func rotateKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var rotationReq keyRotationRequest
+	var conf struct{ AuthKeys string }
+	gracePeriod := auth.DefaultGracePeriod
+
+	if err := rest.ReadJSON(r, &rotationReq); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+		return
+	} else if rotationReq.GracePeriod != "" {
+		if d, err := time.ParseDuration(rotationReq.GracePeriod); err != nil || d < 0 {
+			rest.WriteJSON(w, errors.New(http.StatusBadRequest, "Invalid grace period "+rotationReq.GracePeriod))
+			return
+		} else {
+			gracePeriod = d
+		}
+	}
+
+	// rotate the stored key ring in a transaction, so concurrent rotations can't lose a key
+	var ring *auth.KeyRing
+	err := config.Update(ctx, &conf, func() error {
+		var err error
+		if ring, err = auth.ParseKeyRing(conf.AuthKeys); err != nil {
+			return err
+		} else if _, err := ring.Rotate(time.Now(), gracePeriod); err != nil {
+			return err
+		}
+		conf.AuthKeys = ring.String()
+		return nil
+	})
+
+	if err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, ring.Redacted())
+	}
+
+}
+
+// defaultAccountPageSize is the number of accounts listAccounts returns when
+// the request doesn't set _limit.
+const defaultAccountPageSize = 100
+
+type accountList struct {
+	Accounts []account.Account `json:"accounts"`
+	// Next is the cursor to pass as _start to get the next page, if there may be one.
+	Next string `json:"next,omitempty"`
+}
+
+// listAccounts lists accounts a page at a time. It takes the query parameters
+// query.DatastoreWithValues understands, so for instance
+//	?Roles=admin&CreatedAt_ge=2016-01-01T00:00:00Z&_limit=20&_start=<cursor>
+// returns the first 20 admins created since 2016 after <cursor>.
+func listAccounts(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params := r.URL.Query()
+
+	q, err := query.DatastoreWithValues(account.Entity, params)
+	if err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	limit := defaultAccountPageSize
+	if params.Get("_limit") == "" {
+		q = q.Limit(limit)
+	} else {
+		// DatastoreWithValues has already checked it
+		limit, _ = strconv.Atoi(params.Get("_limit"))
+	}
+
+	list := accountList{Accounts: []account.Account{}}
+	t := q.Run(ctx)
+	for {
+		var acct account.Account
+		if _, err := t.Next(&acct); err == datastore.Done {
+			break
+		} else if err != nil {
+			rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+		list.Accounts = append(list.Accounts, acct)
+	}
+
+	if len(list.Accounts) == limit {
+		if cursor, err := t.Cursor(); err != nil {
+			rest.WriteJSON(w, err)
+			return
+		} else {
+			list.Next = cursor.String()
+		}
+	}
+
+	rest.WriteJSON(w, &list)
+
+}
+
+// defaultAuditPageSize is the number of records listAudit returns when
+// the request doesn't set _limit.
+const defaultAuditPageSize = 100
+
+type auditList struct {
+	Records []audit.Record `json:"records"`
+	// Next is the cursor to pass as _start to get the next page, if there may be one.
+	Next string `json:"next,omitempty"`
+}
+
+// listAudit lists the audit log a page at a time, newest first unless the request sets
+// _order. Like listAccounts, it takes the query parameters query.DatastoreWithValues
+// understands, so for instance
+//	?Target="foo@bar.com"&At_ge=2016-01-01T00:00:00Z
+// returns the changes made to foo@bar.com since 2016. Filtering on one field and
+// ordering by another needs a composite index.
+func listAudit(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params := r.URL.Query()
+
+	q, err := query.DatastoreWithValues(audit.Entity, params)
+	if err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if params.Get("_order") == "" {
+		q = q.Order("-At")
+	}
+
+	limit := defaultAuditPageSize
+	if params.Get("_limit") == "" {
+		q = q.Limit(limit)
+	} else {
+		// DatastoreWithValues has already checked it
+		limit, _ = strconv.Atoi(params.Get("_limit"))
+	}
+
+	list := auditList{Records: []audit.Record{}}
+	t := q.Run(ctx)
+	for {
+		var record audit.Record
+		if _, err := t.Next(&record); err == datastore.Done {
+			break
+		} else if err != nil {
+			rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+		list.Records = append(list.Records, record)
+	}
+
+	if len(list.Records) == limit {
+		if cursor, err := t.Cursor(); err != nil {
+			rest.WriteJSON(w, err)
+			return
+		} else {
+			list.Next = cursor.String()
+		}
+	}
+
+	rest.WriteJSON(w, &list)
+
+}
+
 type accountCreationRequest struct {
 	Email    string
 	Password string
@@ -107,6 +325,28 @@ func getAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 }
 
+type accountRoles struct {
+	Roles          []string `json:"roles"`
+	EffectiveRoles []string `json:"effectiveRoles"`
+}
+
+func getAccountRoles(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	accountId := rest.Param(ctx, "id")
+
+	var acct account.Account
+	if email, err := base64.RawURLEncoding.DecodeString(accountId); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if roles, err := acct.EffectiveRoles(ctx); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &accountRoles{Roles: acct.Roles, EffectiveRoles: roles})
+	}
+
+}
+
 func deleteAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	accountId := rest.Param(ctx, "id")
@@ -148,15 +388,25 @@ func getJwt(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	jti, err := auth.NewJTI()
+	if err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusInternalServerError, "Could not generate JWT"))
+		return
+	}
+
 	// All set. Generate the JWT.
-	jwt, err := auth.Encode(&jws.ClaimSet{
+	jwt, err := auth.Sign(&jws.ClaimSet{
+		Iss:   conf.TokenIssuer,
+		Aud:   conf.TokenAudience,
 		Sub:   acct.Email,
 		Scope: strings.Join(acct.Roles, ","),
+		Iat:   time.Now().Unix(),
 		Exp:   time.Now().AddDate(1, 0, 0).Unix(),
 		PrivateClaims: map[string]interface{}{
-			"n": "DEV USER",
+			"n":   "DEV USER",
+			"jti": jti,
 		},
-	}, []byte(conf.AuthSecret))
+	}, &conf)
 
 	if err != nil {
 		rest.WriteJSON(w, errors.New(http.StatusInternalServerError, "Could not generate JWT"))
@@ -169,9 +419,301 @@ func getJwt(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 }
 
+func revokeAccountTokens(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := auth.RevokeSubject(ctx, acct.Email); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
+
+func getAccountLockout(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var lockout auth.LoginLockout
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := auth.GetLoginLockout(ctx, string(email), &lockout); err != nil && err != datastore.ErrNoSuchEntity {
+		rest.WriteJSON(w, err)
+	} else {
+		// no record just means no recent failures
+		rest.WriteJSON(w, &lockout)
+	}
+
+}
+
+func unlockAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := auth.Unlock(ctx, string(email)); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
+
+// disableAccountTOTP turns two-factor authentication off, for people who have lost
+// their authenticator app and their recovery codes.
+func disableAccountTOTP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		acct.DisableTOTP()
+		if err := account.Save(ctx, &acct); err != nil {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, &rest.NoContent)
+		}
+	}
+
+}
+
+func listSessions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if sessions, err := auth.ListSessions(ctx, string(email)); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, sessions)
+	}
+
+}
+
+func revokeSession(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := auth.RevokeSession(ctx, string(email), rest.Param(ctx, "session")); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
+
+type accountRemovalRequest struct {
+	BatchSize int `json:"batchSize"`
+}
+
+// removeAccountBatch marks the account deleted, if it isn't already, then deletes a batch
+// of its entities and responds with the account.RemovalProgress. Call it again until the
+// progress is done; an interrupted removal picks up where it left off.
+func removeAccountBatch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+	var req accountRemovalRequest
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := rest.ReadJSON(r, &req); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+
+		if !acct.Deleted() {
+			acct.MarkDeleted()
+			if err := account.Save(ctx, &acct); err != nil {
+				rest.WriteJSON(w, err)
+				return
+			}
+		}
+
+		if progress, err := account.RemoveBatch(ctx, &acct, req.BatchSize); err != nil {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, progress)
+		}
+
+	}
+
+}
+
+type accountDisableRequest struct {
+	Reason string `json:"reason"`
+}
+
+func disableAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+	var req accountDisableRequest
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := rest.ReadJSON(r, &req); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		acct.Disable(req.Reason)
+		if err := account.Save(ctx, &acct); err != nil {
+			rest.WriteJSON(w, err)
+		} else {
+			rest.WriteJSON(w, &acct)
+		}
+	}
+
+}
+
+func enableAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := acct.Enable(); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Save(ctx, &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &acct)
+	}
+
+}
+
+func listOrgs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	orgs := []account.Organization{}
+	if keys, err := datastore.NewQuery(account.OrgEntity).GetAll(ctx, &orgs); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		for i, key := range keys {
+			orgs[i].ID = key.StringID()
+		}
+		rest.WriteJSON(w, &orgs)
+	}
+
+}
+
+type orgCreationRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func newOrg(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var orgReq orgCreationRequest
+	if err := rest.ReadJSON(r, &orgReq); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if orgReq.ID == "" {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, "An organization needs an id"))
+	} else if org, err := account.NewOrg(ctx, orgReq.ID, orgReq.Name); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		newOrgURL, _ := r.URL.Parse("orgs/" + org.ID)
+		w.Header().Set("Location", newOrgURL.String())
+		rest.WriteJSON(w, rest.CreatedResponse(org))
+	}
+
+}
+
+func getOrg(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var org account.Organization
+	if err := account.GetOrg(ctx, rest.Param(ctx, "org"), &org); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &org)
+	}
+
+}
+
+func deleteOrg(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if err := account.RemoveOrg(ctx, rest.Param(ctx, "org")); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
+
+func listOrgMembers(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if members, err := account.Members(ctx, rest.Param(ctx, "org")); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &members)
+	}
+
+}
+
+type orgMemberRequest struct {
+	Roles []string `json:"roles"`
+}
+
+func setOrgMember(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var memberReq orgMemberRequest
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := rest.ReadJSON(r, &memberReq); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if membership, err := account.SetMembership(ctx, rest.Param(ctx, "org"), string(email), memberReq.Roles); err == datastore.ErrNoSuchEntity {
+		rest.WriteJSON(w, &rest.ErrNotFound)
+	} else if err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, membership)
+	}
+
+}
+
+func removeOrgMember(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.RemoveMembership(ctx, rest.Param(ctx, "org"), string(email)); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
+
+func revokeToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if jti := rest.Param(ctx, "jti"); jti == "" {
+		rest.WriteJSON(w, &rest.ErrNotFound)
+	} else if err := auth.RevokeToken(ctx, jti); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
+
+// accountChanges holds the account fields changeAccount accepts in the request body.
+// Everything else, such as verified, disabled, deletedAt and totpEnabled, is read-only
+// here and changes only through its own handler or flow.
+type accountChanges struct {
+	Email   *string         `json:"email"`
+	Roles   *[]string       `json:"roles"`
+	Profile json.RawMessage `json:"profile"`
+}
+
 func changeAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	var acct account.Account
+	var changes accountChanges
 	var resp rest.Response
 	resp.Body = &acct
 
@@ -186,15 +728,34 @@ func changeAccount(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		email = string(emailBytes)
 	}
 
-	// read the account and merge it with the request body
+	// read the account and the changes in the request body
 	if err = account.Get(ctx, email, &acct); err != nil {
 		rest.WriteJSON(w, err)
 		return
-	} else if err = rest.ReadJSON(r, &acct); err != nil {
+	} else if acct.Deleted() {
+		// it's on its way out; don't move it or give it roles
+		rest.WriteJSON(w, account.ErrAccountDeleted)
+		return
+	} else if err = rest.ReadJSON(r, &changes); err != nil {
 		rest.WriteJSON(w, err)
 		return
 	}
 
+	if changes.Email != nil {
+		acct.Email = *changes.Email
+	}
+
+	if changes.Roles != nil {
+		acct.Roles = *changes.Roles
+	}
+
+	if changes.Profile != nil {
+		if err = json.Unmarshal(changes.Profile, &acct.Profile); err != nil {
+			rest.WriteJSON(w, err)
+			return
+		}
+	}
+
 	// is the email address changing?
 	if email != acct.Email {
 
@@ -248,7 +809,7 @@ func changeAccountPassword(ctx context.Context, w http.ResponseWriter, r *http.R
 		rest.WriteJSON(w, err)
 	} else if err := account.Get(ctx, email, &acct); err != nil {
 		rest.WriteJSON(w, err)
-	} else if err := acct.SetPassword(newPassword); err != nil {
+	} else if err := acct.SetPassword(ctx, newPassword); err != nil {
 		rest.WriteJSON(w, err)
 	} else if err := account.Save(ctx, &acct); err != nil {
 		rest.WriteJSON(w, err)
@@ -258,6 +819,67 @@ func changeAccountPassword(ctx context.Context, w http.ResponseWriter, r *http.R
 
 }
 
+// exportSecrets lists, by entity kind, the properties exportAccount leaves out unless the
+// request has ?secrets=true, since they would let whoever holds the export log in as the
+// account, or work out how to.
+var exportSecrets = map[string][]string{
+	account.Entity:    {"SecurePassword", "TOTPSecret", "RecoveryCodes"},
+	auth.APIKeyEntity: {"Hash"},
+}
+
+// exportAccount responds with the account and every entity stored under its key, in the
+// format loadEntities reads. Secrets are left out, as described in exportSecrets, unless
+// the request asks for a full backup with ?secrets=true.
+func exportAccount(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var acct account.Account
+	var entities []datastore.PropertyList
+
+	secrets := r.URL.Query().Get("secrets") == "true"
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if keys, err := datastore.NewQuery("").Ancestor(acct.Key(ctx)).GetAll(ctx, &entities); err != nil {
+		// the ancestor query finds the account itself too
+		rest.WriteJSON(w, err)
+	} else if export, err := dsimport.Export(keys, withoutSecrets(keys, entities, secrets)); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, export)
+	}
+
+}
+
+// withoutSecrets returns entities, keyed by keys, with the properties listed in exportSecrets
+// taken out, unless keep is set.
+func withoutSecrets(keys []*datastore.Key, entities []datastore.PropertyList, keep bool) []datastore.PropertyList {
+
+	if keep {
+		return entities
+	}
+
+	for i, key := range keys {
+
+		var kept datastore.PropertyList
+		for _, p := range entities[i] {
+			secret := false
+			for _, name := range exportSecrets[key.Kind()] {
+				secret = secret || p.Name == name
+			}
+			if !secret {
+				kept = append(kept, p)
+			}
+		}
+		entities[i] = kept
+
+	}
+
+	return entities
+
+}
+
 func loadEntities(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	if err := dsimport.Process(ctx, r.Body); err != nil {
@@ -267,3 +889,56 @@ func loadEntities(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+type apiKeyCreationRequest struct {
+	Name  string
+	Roles []string
+}
+
+type apiKeyCreationResponse struct {
+	Key string `json:"key"`
+	*auth.APIKey
+}
+
+func newAPIKey(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	var keyReq apiKeyCreationRequest
+	var acct account.Account
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := rest.ReadJSON(r, &keyReq); err != nil {
+		rest.WriteJSON(w, errors.New(http.StatusBadRequest, err.Error()))
+	} else if err := account.Get(ctx, string(email), &acct); err != nil {
+		rest.WriteJSON(w, err)
+	} else if apiKey, plaintext, err := auth.NewAPIKey(ctx, &acct, keyReq.Name, keyReq.Roles); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, rest.CreatedResponse(&apiKeyCreationResponse{Key: plaintext, APIKey: apiKey}))
+	}
+
+}
+
+func listAPIKeys(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if apiKeys, err := auth.ListAPIKeys(ctx, string(email)); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, apiKeys)
+	}
+
+}
+
+func revokeAPIKey(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if email, err := base64.RawURLEncoding.DecodeString(rest.Param(ctx, "id")); err != nil {
+		rest.WriteJSON(w, err)
+	} else if err := auth.RevokeAPIKey(ctx, string(email), rest.Param(ctx, "keyId")); err != nil {
+		rest.WriteJSON(w, err)
+	} else {
+		rest.WriteJSON(w, &rest.NoContent)
+	}
+
+}
@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"github.com/qedus/nds"
 	"github.com/the-information/ori/account"
+	"github.com/the-information/ori/account/auth"
+	"github.com/the-information/ori/audit"
 	"github.com/the-information/ori/config"
 	"github.com/the-information/ori/test"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2/jws"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 	"net/http"
@@ -65,7 +68,7 @@ func Test_changeConfig(t *testing.T) {
 	w := test.NewState().
 		Config(&conf).
 		Body(&config.Global{
-			AuthSecret: "bar",
+			TokenIssuer: "bar",
 		}).
 		Run(ctx, changeConfig)
 
@@ -74,10 +77,72 @@ func Test_changeConfig(t *testing.T) {
 	}
 
 	test.LoadConfig(ctx, &conf2)
-	if conf2.AuthSecret != "bar" || conf2.ValidOriginSuffix != "example.com" {
+	if conf2.AuthSecret != "foo" || conf2.TokenIssuer != "bar" || conf2.ValidOriginSuffix != "example.com" {
 		t.Errorf("Unexpected config state after update: %+v", &conf2)
 	}
 
+	// the auth secret can't be replaced once it is set
+	w = test.NewState().
+		Config(&conf).
+		Body(&config.Global{
+			AuthSecret: "bar",
+		}).
+		Run(ctx, changeConfig)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status code http.StatusConflict, got %d %s", w.Code, w.Body.String())
+	}
+
+}
+
+func Test_rotateKeys(t *testing.T) {
+
+	var conf config.Global
+	var ring auth.KeyRing
+
+	w := test.NewState().
+		Config(&config.Global{AuthSecret: "foo"}).
+		Body(map[string]string{"GracePeriod": "1h"}).
+		Run(ctx, rotateKeys)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code OK, got %d %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &ring); err != nil {
+		t.Fatalf("Unexpected error %s on unmarshal", err)
+	} else if len(ring.Keys) != 2 || ring.Keys[0].ID != auth.LegacyKeyID || ring.Keys[1].Secret != "" {
+		t.Errorf("Unexpected key ring in response: %s", w.Body.String())
+	}
+
+	test.LoadConfig(ctx, &conf)
+	if saved, err := auth.ParseKeyRing(conf.AuthKeys); err != nil {
+		t.Fatalf("Unexpected error %s parsing saved key ring", err)
+	} else if saved.ActiveKey() == nil || saved.Active != ring.Active {
+		t.Errorf("Unexpected key ring saved to config: %+v", saved)
+	}
+
+	// rotate again; the first key should start retiring
+	w = test.NewState().
+		Config(&conf).
+		Body(map[string]string{}).
+		Run(ctx, rotateKeys)
+
+	test.LoadConfig(ctx, &conf)
+	if saved, _ := auth.ParseKeyRing(conf.AuthKeys); len(saved.Keys) != 3 || saved.Active == ring.Active {
+		t.Errorf("Expected a new active key after rotation, but got %+v", saved)
+	} else if saved.Keys[1].RetiresAt == 0 {
+		t.Errorf("Expected the old key to be retiring, but got %+v", saved.Keys[1])
+	}
+
+	// bad grace period
+	w = test.NewState().
+		Config(&conf).
+		Body(map[string]string{"GracePeriod": "forever"}).
+		Run(ctx, rotateKeys)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected http.StatusBadRequest, got %d", w.Code)
+	}
+
 }
 
 func Test_newAccount(t *testing.T) {
@@ -140,6 +205,72 @@ func Test_getAccount(t *testing.T) {
 
 }
 
+func Test_exportAccount(t *testing.T) {
+
+	var export map[string]json.RawMessage
+
+	account.New(ctx, "export@bar.com", "foobar")
+	account.LinkIdentity(ctx, "export@bar.com", "https://login.acme.com", "1234")
+
+	w := test.NewState().
+		Param("id", base64.RawURLEncoding.EncodeToString([]byte("export@bar.com"))).
+		Run(ctx, exportAccount)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code http.StatusOK, got %d, error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil {
+		t.Fatalf("Unexpected error %s reading body of response", err)
+	}
+
+	for _, key := range []string{
+		account.Entity + "/export%40bar.com",
+		account.Entity + "/export%40bar.com/" + account.IdentityEntity + "/https%3A%2F%2Flogin.acme.com+1234",
+	} {
+		if _, ok := export[key]; !ok {
+			t.Errorf("Expected export to include %s, got %s", key, w.Body.String())
+		}
+	}
+
+	if len(export) != 2 {
+		t.Errorf("Expected export of 2 entities, got %d: %s", len(export), w.Body.String())
+	}
+
+	// secrets are left out
+	var exported map[string]json.RawMessage
+	json.Unmarshal(export[account.Entity+"/export%40bar.com"], &exported)
+	if _, ok := exported["SecurePassword"]; ok || exported["Email"] == nil {
+		t.Errorf("Expected the account's password hash to be left out, got %s", export[account.Entity+"/export%40bar.com"])
+	}
+
+}
+
+func Test_getAccountRoles(t *testing.T) {
+
+	var roles accountRoles
+
+	acct, _ := account.New(ctx, "roles@bar.com", "foobar")
+	acct.Roles = []string{"admin"}
+	account.Save(ctx, acct)
+
+	id := base64.RawURLEncoding.EncodeToString([]byte("roles@bar.com"))
+
+	w := test.NewState().
+		Config(&config.Global{RoleGraph: `{"admin":["editor"],"editor":["viewer"]}`}).
+		Param("id", id).
+		Run(ctx, getAccountRoles)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code http.StatusOK, got %d, error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &roles); err != nil {
+		t.Fatalf("unexpected error %s reading body of response", err)
+	}
+
+	if !reflect.DeepEqual(roles.Roles, []string{"admin"}) || !reflect.DeepEqual(roles.EffectiveRoles, []string{"admin", "editor", "viewer"}) {
+		t.Errorf("got unexpected roles %+v", roles)
+	}
+
+}
+
 func Test_getJwt(t *testing.T) {
 
 	id := base64.RawURLEncoding.EncodeToString([]byte("foo@bar.com"))
@@ -152,6 +283,72 @@ func Test_getJwt(t *testing.T) {
 	// FIXME(ian): write a test that decodes the jwt that gets passed through here and validates it
 }
 
+func Test_revokeAccountTokens(t *testing.T) {
+
+	id := base64.RawURLEncoding.EncodeToString([]byte("foo@bar.com"))
+	w := test.NewState().
+		Param("id", id).
+		Run(ctx, revokeAccountTokens)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	if revoked, err := auth.IsRevoked(ctx, &jws.ClaimSet{Sub: "foo@bar.com"}); err != nil || !revoked {
+		t.Errorf("Expected earlier tokens to be revoked, but got %t, %s", revoked, err)
+	}
+
+}
+
+func Test_disableAccount(t *testing.T) {
+
+	var acct account.Account
+
+	id := base64.RawURLEncoding.EncodeToString([]byte("foo@bar.com"))
+	w := test.NewState().
+		Param("id", id).
+		Body(map[string]string{"reason": "chargeback"}).
+		Run(ctx, disableAccount)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	if err := account.Get(ctx, "foo@bar.com", &acct); err != nil {
+		t.Fatalf("Unexpected error reading account: %s", err)
+	} else if !acct.Disabled || acct.DisabledReason != "chargeback" || acct.DisabledAt.IsZero() {
+		t.Errorf("Expected account to be disabled for chargeback, but got %t, %q, %s", acct.Disabled, acct.DisabledReason, acct.DisabledAt)
+	}
+
+	w = test.NewState().
+		Param("id", id).
+		Run(ctx, enableAccount)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	acct = account.Account{}
+	if err := account.Get(ctx, "foo@bar.com", &acct); err != nil {
+		t.Fatalf("Unexpected error reading account: %s", err)
+	} else if acct.Disabled || acct.DisabledReason != "" || !acct.DisabledAt.IsZero() {
+		t.Errorf("Expected account to be enabled again, but got %t, %q, %s", acct.Disabled, acct.DisabledReason, acct.DisabledAt)
+	}
+
+}
+
+func Test_revokeToken(t *testing.T) {
+
+	w := test.NewState().
+		Param("jti", "foo").
+		Run(ctx, revokeToken)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	if revoked, err := auth.IsRevoked(ctx, &jws.ClaimSet{Sub: "bar@bar.com", PrivateClaims: map[string]interface{}{"jti": "foo"}}); err != nil || !revoked {
+		t.Errorf("Expected token foo to be revoked, but got %t, %s", revoked, err)
+	}
+
+}
+
 func Test_changeAccount(t *testing.T) {
 
 	var acct account.Account
@@ -171,10 +368,32 @@ func Test_changeAccount(t *testing.T) {
 	}
 
 	account.Get(ctx, "foo@bar.com", &acct)
-	if !acct.HasRole("admin") {
+	if !acct.HasRole(ctx, "admin") {
 		t.Errorf("Expected account to have role 'admin' after modification, but it didn't")
 	}
 
+	// read-only fields are left alone
+
+	w = test.NewState().
+		Body(map[string]interface{}{
+			"verified":    true,
+			"disabled":    true,
+			"totpEnabled": true,
+			"deletedAt":   time.Now(),
+		}).
+		Param("id", id).
+		Run(ctx, changeAccount)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected http.StatusOK, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	acct = account.Account{}
+	account.Get(ctx, "foo@bar.com", &acct)
+	if acct.Verified || acct.Disabled || acct.TOTPEnabled || acct.Deleted() {
+		t.Errorf("Expected read-only fields to be unchanged, but got %+v", acct)
+	}
+
 	// change the email address
 
 	w = test.NewState().
@@ -194,7 +413,7 @@ func Test_changeAccount(t *testing.T) {
 	}
 
 	account.Get(ctx, "moveto@bar.com", &acct)
-	if !acct.HasRole("baz") || !acct.HasRole("admin") {
+	if !acct.HasRole(ctx, "baz") || !acct.HasRole(ctx, "admin") {
 		t.Errorf("Expected account to have roles 'admin' and 'baz' after modification, but it didn't")
 	}
 
@@ -245,6 +464,43 @@ func Test_deleteAccount(t *testing.T) {
 
 }
 
+func Test_removeAccountBatch(t *testing.T) {
+
+	var progress account.RemovalProgress
+
+	account.New(ctx, "batched@bar.com", "foobar")
+	account.LinkIdentity(ctx, "batched@bar.com", "https://login.acme.com", "1234")
+	account.LinkIdentity(ctx, "batched@bar.com", "https://login.acme.com", "5678")
+
+	id := base64.RawURLEncoding.EncodeToString([]byte("batched@bar.com"))
+
+	for _, expected := range []account.RemovalProgress{
+		{Email: "batched@bar.com", Deleted: 1},
+		{Email: "batched@bar.com", Deleted: 1},
+		{Email: "batched@bar.com", Done: true},
+	} {
+
+		w := test.NewState().
+			Param("id", id).
+			Body(map[string]int{"batchSize": 1}).
+			Run(ctx, removeAccountBatch)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code http.StatusOK, got %d, error %s", w.Code, w.Body.String())
+		} else if err := json.Unmarshal(w.Body.Bytes(), &progress); err != nil {
+			t.Fatalf("Unexpected error %s reading body of response", err)
+		} else if progress != expected {
+			t.Errorf("Expected progress %+v, got %+v", expected, progress)
+		}
+
+	}
+
+	if err := account.Get(ctx, "batched@bar.com", &account.Account{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected the account to be gone, got %v", err)
+	}
+
+}
+
 type Blivet struct {
 	Mark    int64
 	Percent float64
@@ -345,3 +601,239 @@ func Test_loadEntities(t *testing.T) {
 	}
 
 }
+
+func Test_apiKeys(t *testing.T) {
+
+	var created struct {
+		Key string `json:"key"`
+		ID  string `json:"id"`
+	}
+	var listed []auth.APIKey
+
+	acct, _ := account.New(ctx, "apikeys@bar.com", "foobar")
+	acct.Roles = []string{"viewer"}
+	account.Save(ctx, acct)
+
+	id := base64.RawURLEncoding.EncodeToString([]byte("apikeys@bar.com"))
+
+	w := test.NewState().
+		Param("id", id).
+		Body(&apiKeyCreationRequest{Name: "ci", Roles: []string{"viewer"}}).
+		Run(ctx, newAPIKey)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code http.StatusCreated, got %d, error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("unexpected error %s reading body of response", err)
+	} else if created.Key == "" || created.ID == "" {
+		t.Errorf("expected a key and ID, but got %s", w.Body.String())
+	}
+
+	// http://stackoverflow.com/questions/25070974/google-app-engine-golang-datastore-query-getall-not-working-locally
+	datastore.Get(ctx, datastore.NewKey(ctx, auth.APIKeyEntity, created.ID, 0, acct.Key(ctx)), &auth.APIKey{})
+
+	w = test.NewState().
+		Param("id", id).
+		Run(ctx, listAPIKeys)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code http.StatusOK, got %d, error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Errorf("unexpected error %s reading body of response", err)
+	} else if len(listed) != 1 || listed[0].ID != created.ID {
+		t.Errorf("got unexpected API keys %s", w.Body.String())
+	}
+
+	w = test.NewState().
+		Param("id", id).
+		Param("keyId", created.ID).
+		Run(ctx, revokeAPIKey)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status code http.StatusNoContent, got %d, error %s", w.Code, w.Body.String())
+	} else if _, err := auth.LookupAPIKey(ctx, created.Key); err != auth.InvalidAPIKeyError {
+		t.Errorf("Expected the key to be revoked, but got %s", err)
+	}
+
+}
+
+func Test_listAccounts(t *testing.T) {
+
+	var list accountList
+
+	for _, email := range []string{"list1@bar.com", "list2@bar.com", "list3@bar.com"} {
+		acct, _ := account.New(ctx, email, "foobar")
+		acct.Roles = []string{"lister"}
+		account.Save(ctx, acct)
+		// http://stackoverflow.com/questions/25070974/google-app-engine-golang-datastore-query-getall-not-working-locally
+		datastore.Get(ctx, acct.Key(ctx), &account.Account{})
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/_ori/accounts?Roles=lister&_limit=2", nil)
+	listAccounts(ctx, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code http.StatusOK, got %d, error %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unexpected error %s reading body of response", err)
+	} else if len(list.Accounts) != 2 || list.Next == "" {
+		t.Fatalf("Expected 2 accounts and a cursor, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/_ori/accounts?Roles=lister&_limit=2&_start="+list.Next, nil)
+	list = accountList{}
+	listAccounts(ctx, w, r)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unexpected error %s reading body of response", err)
+	} else if len(list.Accounts) != 1 || list.Accounts[0].Email != "list3@bar.com" || list.Next != "" {
+		t.Errorf("Expected the last account and no cursor, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/_ori/accounts?_start=wat", nil)
+	listAccounts(ctx, w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code http.StatusBadRequest for a bad cursor, got %d", w.Code)
+	}
+
+	for _, query := range []string{"a=1&_gt=1", "_limit=-1"} {
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("GET", "/_ori/accounts?"+query, nil)
+		listAccounts(ctx, w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code http.StatusBadRequest for %s, got %d", query, w.Code)
+		}
+	}
+
+}
+
+func Test_listAudit(t *testing.T) {
+
+	var list auditList
+
+	acct, _ := account.New(ctx, "audited@bar.com", "foobar")
+	acct.Roles = []string{"auditor"}
+	account.Save(ctx, acct)
+
+	// audit records are root entities, so there's no key to Get to make the query
+	// consistent; wait for the dev datastore to apply the write instead
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", `/_ori/audit?Target="audited@bar.com"`, nil)
+		listAudit(ctx, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code http.StatusOK, got %d, error %s", w.Code, w.Body.String())
+		} else if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("unexpected error %s reading body of response", err)
+		} else if len(list.Records) > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if len(list.Records) != 1 {
+		t.Fatalf("Expected 1 audit record, got %+v", list.Records)
+	}
+
+	record := list.Records[0]
+	if record.Action != audit.AccountSave || record.Target != "audited@bar.com" || record.At.IsZero() {
+		t.Errorf("Unexpected audit record %+v", record)
+	}
+
+	found := false
+	for _, change := range record.Changes {
+		if change.Field == "Roles" {
+			found = true
+			if string(change.After) != `["auditor"]` {
+				t.Errorf(`Expected Roles to change to ["auditor"], got %s`, change.After)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected a change to Roles, got %+v", record.Changes)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/_ori/audit?_start=wat", nil)
+	listAudit(ctx, w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code http.StatusBadRequest for a bad cursor, got %d", w.Code)
+	}
+
+}
+
+func Test_orgs(t *testing.T) {
+
+	var org account.Organization
+	var members []account.Membership
+
+	w := test.NewState().
+		Body(map[string]string{"id": "globex", "name": "Globex"}).
+		Run(ctx, newOrg)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected http.StatusCreated, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().
+		Param("org", "globex").
+		Run(ctx, getOrg)
+	if err := json.Unmarshal(w.Body.Bytes(), &org); err != nil {
+		t.Fatalf("unexpected error %s reading body of response", err)
+	} else if org.ID != "globex" || org.Name != "Globex" {
+		t.Errorf("Unexpected organization %s", w.Body.String())
+	}
+
+	account.New(ctx, "hank@globex.com", "foobar")
+	id := base64.RawURLEncoding.EncodeToString([]byte("hank@globex.com"))
+
+	w = test.NewState().
+		Param("org", "globex").
+		Param("id", id).
+		Body(map[string][]string{"roles": {"admin"}}).
+		Run(ctx, setOrgMember)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http.StatusOK, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().
+		Param("org", "globex").
+		Param("id", base64.RawURLEncoding.EncodeToString([]byte("nobody@globex.com"))).
+		Body(map[string][]string{"roles": {"admin"}}).
+		Run(ctx, setOrgMember)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected http.StatusNotFound adding a missing account, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	// http://stackoverflow.com/questions/25070974/google-app-engine-golang-datastore-query-getall-not-working-locally
+	datastore.Get(ctx, datastore.NewKey(ctx, account.MembershipEntity, "globex", 0, datastore.NewKey(ctx, account.Entity, "hank@globex.com", 0, nil)), &account.Membership{})
+
+	w = test.NewState().
+		Param("org", "globex").
+		Run(ctx, listOrgMembers)
+	if err := json.Unmarshal(w.Body.Bytes(), &members); err != nil {
+		t.Fatalf("unexpected error %s reading body of response", err)
+	} else if len(members) != 1 || members[0].Email != "hank@globex.com" || members[0].Roles[0] != "admin" {
+		t.Errorf("Unexpected members %s", w.Body.String())
+	}
+
+	w = test.NewState().
+		Param("org", "globex").
+		Param("id", id).
+		Run(ctx, removeOrgMember)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().
+		Param("org", "globex").
+		Run(ctx, deleteOrg)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected http.StatusNoContent, but got %d: error %s", w.Code, w.Body.String())
+	}
+
+	w = test.NewState().
+		Param("org", "globex").
+		Run(ctx, getOrg)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected http.StatusNotFound after deleting the organization, but got %d", w.Code)
+	}
+
+}
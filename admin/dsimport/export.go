@@ -0,0 +1,171 @@
+package dsimport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/appengine/datastore"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EncodeKey encodes key the way Process expects entity keys and key values to be written,
+// e.g. "User/jsmith/Address/1". String IDs that look like integers, such as "1", are
+// percent-encoded in full, so that they aren't read back as integer IDs.
+func EncodeKey(key *datastore.Key) string {
+
+	var segments []string
+	for k := key; k != nil; k = k.Parent() {
+
+		id := url.QueryEscape(k.StringID())
+		if k.StringID() == "" {
+			id = strconv.FormatInt(k.IntID(), 10)
+		} else if _, err := strconv.ParseInt(k.StringID(), 10, 64); err == nil {
+			id = percentEncode(k.StringID())
+		}
+		segments = append([]string{url.QueryEscape(k.Kind()), id}, segments...)
+
+	}
+
+	return strings.Join(segments, "/")
+
+}
+
+// percentEncode percent-encodes every byte of s.
+func percentEncode(s string) string {
+
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		fmt.Fprintf(&buf, "%%%02X", s[i])
+	}
+	return buf.String()
+
+}
+
+// Export encodes entities, keyed by keys, as a JSON object Process can read back in.
+// It returns ErrUnknownType if an entity has a property of a type Process doesn't support,
+// such as appengine.GeoPoint.
+func Export(keys []*datastore.Key, entities []datastore.PropertyList) (json.RawMessage, error) {
+
+	var buf bytes.Buffer
+
+	buf.WriteString("{")
+	for i, key := range keys {
+
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		encodedKey, _ := json.Marshal(EncodeKey(key))
+		buf.Write(encodedKey)
+		buf.WriteString(":")
+
+		if encodedEntity, err := exportEntity(entities[i]); err != nil {
+			return nil, err
+		} else {
+			buf.Write(encodedEntity)
+		}
+
+	}
+	buf.WriteString("}")
+
+	return json.RawMessage(buf.Bytes()), nil
+
+}
+
+func exportEntity(pl datastore.PropertyList) ([]byte, error) {
+
+	// gather the values of multi-valued properties together, keeping the order of their names
+	names := []string{}
+	values := map[string][]interface{}{}
+	multiple := map[string]bool{}
+
+	for _, p := range pl {
+
+		if _, ok := values[p.Name]; !ok {
+			names = append(names, p.Name)
+		}
+
+		if v, err := exportValue(&p); err != nil {
+			return nil, err
+		} else {
+			values[p.Name] = append(values[p.Name], v)
+		}
+		multiple[p.Name] = multiple[p.Name] || p.Multiple
+
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString("{")
+	for i, name := range names {
+
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		var encoded []byte
+		var err error
+		encodedName, _ := json.Marshal(name)
+
+		if multiple[name] || len(values[name]) > 1 {
+			encoded, err = json.Marshal(values[name])
+		} else {
+			encoded, err = json.Marshal(values[name][0])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(encodedName)
+		buf.WriteString(":")
+		buf.Write(encoded)
+
+	}
+	buf.WriteString("}")
+
+	return buf.Bytes(), nil
+
+}
+
+// exportValue returns the JSON form of p's value. Strings, integers, booleans and nulls that
+// are indexed are written plainly; everything else carries its type, so it reads back the same.
+func exportValue(p *datastore.Property) (interface{}, error) {
+
+	switch t := p.Value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return explicitOrPlain(p, "string", t), nil
+	case int64:
+		return explicitOrPlain(p, "int64", t), nil
+	case bool:
+		return explicitOrPlain(p, "bool", t), nil
+	case float64:
+		// always explicit, or 2.0 would read back as an integer
+		return &explicitValue{Type: "float64", Value: t, NoIndex: p.NoIndex}, nil
+	case time.Time:
+		return &explicitValue{Type: "time", Value: t.UTC().Format(time.RFC3339Nano), NoIndex: p.NoIndex}, nil
+	case []byte:
+		return &explicitValue{Type: "binary", Value: base64.RawURLEncoding.EncodeToString(t), NoIndex: p.NoIndex}, nil
+	case datastore.ByteString:
+		return &explicitValue{Type: "binary", Value: base64.RawURLEncoding.EncodeToString(t), NoIndex: p.NoIndex}, nil
+	case *datastore.Key:
+		return &explicitValue{Type: "key", Value: EncodeKey(t), NoIndex: p.NoIndex}, nil
+	default:
+		return nil, ErrUnknownType
+	}
+
+}
+
+func explicitOrPlain(p *datastore.Property, typ string, v interface{}) interface{} {
+
+	if p.NoIndex {
+		return &explicitValue{Type: typ, Value: v, NoIndex: true}
+	}
+	return v
+
+}
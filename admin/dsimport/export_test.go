@@ -0,0 +1,112 @@
+package dsimport
+
+import (
+	"encoding/json"
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_exportEntity(t *testing.T) {
+
+	pl := datastore.PropertyList{
+		{Name: "Name", Value: "Jane Q. Public"},
+		{Name: "Bio", Value: "Likes lotteries", NoIndex: true},
+		{Name: "LotteryNumbers", Value: int64(7), Multiple: true},
+		{Name: "BMI", Value: float64(21)},
+		{Name: "Verified", Value: true},
+		{Name: "CreatedAt", Value: time.Date(2011, 06, 12, 12, 30, 0, 500, time.UTC)},
+		{Name: "Hash", Value: []byte("secret"), NoIndex: true},
+		{Name: "LotteryNumbers", Value: int64(19), Multiple: true},
+		{Name: "Nothing", Value: nil},
+	}
+
+	encoded, err := exportEntity(pl)
+	if err != nil {
+		t.Fatalf("Unexpected error %s exporting entity", err)
+	}
+
+	if !strings.Contains(string(encoded), `"BMI":{"Type":"float64","Value":21}`) {
+		t.Errorf("Expected BMI to be exported as an explicit float64, got %s", encoded)
+	}
+
+	// reading the export back in gives the same properties, with multi-valued ones together
+	e := entity{}
+	results := datastore.PropertyList{}
+	if err := json.Unmarshal(encoded, &e); err != nil {
+		t.Fatalf("Unexpected error %s reading back %s", err, encoded)
+	} else if err := e.FetchProperties(context.Background(), (*[]datastore.Property)(&results)); err != nil {
+		t.Fatalf("Unexpected error %s during FetchProperties", err)
+	}
+
+	byName := func(pl datastore.PropertyList) map[string][]datastore.Property {
+		m := map[string][]datastore.Property{}
+		for _, p := range pl {
+			if tm, ok := p.Value.(time.Time); ok {
+				p.Value = tm.UTC()
+			}
+			m[p.Name] = append(m[p.Name], p)
+		}
+		return m
+	}
+
+	if !reflect.DeepEqual(byName(results), byName(pl)) {
+		t.Errorf("Expected %+v to read back the same, got %+v", pl, results)
+	}
+
+	if _, err := exportEntity(datastore.PropertyList{{Name: "Where", Value: struct{}{}}}); err != ErrUnknownType {
+		t.Errorf("Expected ErrUnknownType for an unsupported value, got %v", err)
+	}
+
+}
+
+func TestExport(t *testing.T) {
+
+	ctx, done, _ := aetest.NewContext()
+	defer done()
+
+	parent := datastore.NewKey(ctx, "User", "jsmith@example.com", 0, nil)
+	keys := []*datastore.Key{
+		parent,
+		datastore.NewKey(ctx, "Address", "", 12, parent),
+		datastore.NewKey(ctx, "Identity", "https://login.example.com 1234", 0, parent),
+		datastore.NewKey(ctx, "Address", "12", 0, parent),
+	}
+	entities := []datastore.PropertyList{
+		{{Name: "Name", Value: "John Smith"}},
+		{{Name: "Owner", Value: parent}},
+		{{Name: "Subject", Value: "1234"}},
+		{{Name: "Street", Value: "12 Main St."}},
+	}
+
+	if EncodeKey(keys[1]) != "User/jsmith%40example.com/Address/12" {
+		t.Errorf("Unexpected encoded key %s", EncodeKey(keys[1]))
+	}
+
+	// a string ID of digits must not read back as an integer ID
+	if EncodeKey(keys[3]) != "User/jsmith%40example.com/Address/%31%32" {
+		t.Errorf("Unexpected encoded key %s", EncodeKey(keys[3]))
+	}
+
+	export, err := Export(keys, entities)
+	if err != nil {
+		t.Fatalf("Unexpected error %s exporting entities", err)
+	} else if err := Process(ctx, strings.NewReader(string(export))); err != nil {
+		t.Fatalf("Unexpected error %s processing export %s", err, export)
+	}
+
+	for i, key := range keys {
+		var pl datastore.PropertyList
+		if err := nds.Get(ctx, key, &pl); err != nil {
+			t.Errorf("Unexpected error %s retrieving %s", err, key)
+		} else if !reflect.DeepEqual(pl, entities[i]) {
+			t.Errorf("Expected %s to be %+v, got %+v", key, entities[i], pl)
+		}
+	}
+
+}
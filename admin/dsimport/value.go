@@ -56,7 +56,7 @@ func decodeDatastoreKey(ctx context.Context, encodedString string) (*datastore.K
 type explicitValue struct {
 	Type    string
 	Value   interface{}
-	NoIndex bool
+	NoIndex bool `json:",omitempty"`
 }
 
 type innerValue struct {
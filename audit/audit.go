@@ -0,0 +1,161 @@
+// Package audit keeps an append-only log of changes made to accounts and configuration.
+//
+// Package account and package config write to it automatically whenever they change
+// something, so you only need this package to record changes of your own, or to read
+// the log back. The ori command-line utility reads it with `ori audit`.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/qedus/nds"
+	"github.com/the-information/ori/internal"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"sort"
+	"time"
+)
+
+// Entity is the name of the Datastore entity used to store audit records.
+var Entity = "APIAuditRecord"
+
+// The actions package account and package config record.
+const (
+	AccountSave        = "account.save"
+	AccountLogin       = "account.login"
+	AccountChangeEmail = "account.change_email"
+	AccountRemove      = "account.remove"
+	ConfigSave         = "config.save"
+)
+
+// Redacted stands in for the values of fields that are too sensitive to record,
+// such as password hashes and signing keys. Changes to them are still recorded.
+var Redacted = json.RawMessage(`"(redacted)"`)
+
+// Change records a change to a single field.
+type Change struct {
+	Field string `json:"field"`
+	// Before and After are the JSON encoding of the field's value before and after the
+	// change. One of them is empty if the field was added or removed.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Record is a single entry in the audit log.
+type Record struct {
+	// Actor is the email address of the account that made the change, as found by
+	// auth.GetAccount, which is "super@" for the superuser and "nobody@" for requests
+	// that weren't authenticated. It is empty if the change wasn't made while handling
+	// a request that went through auth.Middleware.
+	Actor string `json:"actor"`
+	// Action is what was done, such as AccountSave.
+	Action string `json:"action"`
+	// Target identifies what it was done to, such as the email address of an account.
+	Target string `json:"target"`
+	// Changes lists the fields that changed, in order of name.
+	Changes []Change `json:"changes,omitempty" datastore:",noindex"`
+	// At is when it was done.
+	At time.Time `json:"at"`
+}
+
+// Write appends a record of action on target to the audit log, taking the actor from ctx.
+// Call it in the same transaction as the change, so that one isn't saved without the other;
+// the transaction will need to be cross-group.
+func Write(ctx context.Context, action, target string, changes []Change) error {
+
+	record := Record{
+		Actor:   Actor(ctx),
+		Action:  action,
+		Target:  target,
+		Changes: changes,
+		At:      time.Now(),
+	}
+
+	_, err := nds.Put(ctx, datastore.NewIncompleteKey(ctx, Entity, nil), &record)
+	return err
+
+}
+
+// Actor returns the name Write records as the actor for ctx.
+func Actor(ctx context.Context) string {
+
+	// auth.Middleware stores the *account.Account here; package account imports this one,
+	// so it is identified through its String method instead
+	if acct, ok := ctx.Value(internal.AuthContextKey).(fmt.Stringer); ok {
+		return acct.String()
+	}
+	return ""
+
+}
+
+// Diff lists the differences between two versions of an entity's properties, in order of
+// field name. Properties with several values are compared as a whole. The values of the
+// fields named in redact are recorded as Redacted.
+func Diff(before, after []datastore.Property, redact ...string) []Change {
+
+	beforeValues, afterValues := propertyValues(before), propertyValues(after)
+
+	redacted := map[string]bool{}
+	for _, field := range redact {
+		redacted[field] = true
+	}
+
+	var fields []string
+	for field := range beforeValues {
+		fields = append(fields, field)
+	}
+	for field := range afterValues {
+		if _, ok := beforeValues[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	var changes []Change
+	for _, field := range fields {
+
+		b, a := beforeValues[field], afterValues[field]
+		if string(b) == string(a) {
+			continue
+		}
+
+		if redacted[field] {
+			if b != nil {
+				b = Redacted
+			}
+			if a != nil {
+				a = Redacted
+			}
+		}
+
+		changes = append(changes, Change{Field: field, Before: b, After: a})
+
+	}
+
+	return changes
+
+}
+
+// propertyValues JSON-encodes the value of each property in props.
+func propertyValues(props []datastore.Property) map[string]json.RawMessage {
+
+	multiple := map[string][]interface{}{}
+	values := map[string]json.RawMessage{}
+
+	for _, prop := range props {
+		if prop.Multiple {
+			multiple[prop.Name] = append(multiple[prop.Name], prop.Value)
+		} else if encoded, err := json.Marshal(prop.Value); err == nil {
+			values[prop.Name] = encoded
+		}
+	}
+
+	for name, value := range multiple {
+		if encoded, err := json.Marshal(value); err == nil {
+			values[name] = encoded
+		}
+	}
+
+	return values
+
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"errors"
+	"github.com/the-information/ori/internal"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+type stringer string
+
+func (s stringer) String() string {
+	return string(s)
+}
+
+func TestDiff(t *testing.T) {
+
+	before := []datastore.Property{
+		{Name: "Email", Value: "foo@bar.com"},
+		{Name: "Roles", Value: "admin", Multiple: true},
+		{Name: "SecurePassword", Value: []byte("old")},
+		{Name: "Verified", Value: true},
+		{Name: "Gone", Value: int64(1)},
+	}
+
+	after := []datastore.Property{
+		{Name: "Email", Value: "foo@bar.com"},
+		{Name: "Roles", Value: "admin", Multiple: true},
+		{Name: "Roles", Value: "editor", Multiple: true},
+		{Name: "SecurePassword", Value: []byte("new")},
+		{Name: "Verified", Value: false},
+		{Name: "Added", Value: "yes"},
+	}
+
+	changes := Diff(before, after, "SecurePassword")
+
+	expected := []Change{
+		{Field: "Added", After: []byte(`"yes"`)},
+		{Field: "Gone", Before: []byte(`1`)},
+		{Field: "Roles", Before: []byte(`["admin"]`), After: []byte(`["admin","editor"]`)},
+		{Field: "SecurePassword", Before: Redacted, After: Redacted},
+		{Field: "Verified", Before: []byte(`true`), After: []byte(`false`)},
+	}
+
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %d: %+v", len(expected), len(changes), changes)
+	}
+
+	for i := range expected {
+		if changes[i].Field != expected[i].Field ||
+			string(changes[i].Before) != string(expected[i].Before) ||
+			string(changes[i].After) != string(expected[i].After) {
+			t.Errorf("Expected change %d to be %s: %s -> %s, got %s: %s -> %s", i,
+				expected[i].Field, expected[i].Before, expected[i].After,
+				changes[i].Field, changes[i].Before, changes[i].After)
+		}
+	}
+
+	if changes := Diff(before, before); len(changes) != 0 {
+		t.Errorf("Expected no changes between identical properties, got %+v", changes)
+	}
+
+}
+
+func TestActor(t *testing.T) {
+
+	if actor := Actor(context.Background()); actor != "" {
+		t.Errorf("Expected no actor outside an auth context, got %q", actor)
+	}
+
+	ctx := context.WithValue(context.Background(), internal.AuthContextKey, errors.New("bad JWT"))
+	if actor := Actor(ctx); actor != "" {
+		t.Errorf("Expected no actor for a failed authentication, got %q", actor)
+	}
+
+	ctx = context.WithValue(context.Background(), internal.AuthContextKey, stringer("foo@bar.com"))
+	if actor := Actor(ctx); actor != "foo@bar.com" {
+		t.Errorf("Expected actor foo@bar.com, got %q", actor)
+	}
+
+}
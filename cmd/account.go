@@ -7,7 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/urfave/cli"
-	_ "strings"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func AddAccount(c *cli.Context) error {
@@ -29,6 +34,30 @@ func AddAccount(c *cli.Context) error {
 
 }
 
+func ExportAccount(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	export := json.RawMessage{}
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	path := "accounts/" + key + "/export"
+	if c.Bool("secrets") {
+		path += "?secrets=true"
+	}
+
+	if err := get(c, path, &export); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(export)
+
+	return nil
+
+}
+
 func RemoveAccount(c *cli.Context) error {
 
 	if c.NArg() != 1 {
@@ -37,6 +66,10 @@ func RemoveAccount(c *cli.Context) error {
 
 	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
 
+	if c.Bool("batched") {
+		return removeAccountInBatches(c, key)
+	}
+
 	if err := del(c, "accounts/"+key); err != nil {
 		return cli.NewExitError("Server error: "+err.Error(), 1)
 	}
@@ -45,6 +78,36 @@ func RemoveAccount(c *cli.Context) error {
 
 }
 
+// removeAccountInBatches asks the server to delete the account's entities a batch at a time
+// until they are all gone, reporting progress as it goes. If it is interrupted, running it
+// again carries on where it stopped.
+func removeAccountInBatches(c *cli.Context, key string) error {
+
+	var progress struct {
+		Deleted int  `json:"deleted"`
+		Done    bool `json:"done"`
+	}
+
+	body := map[string]int{
+		"batchSize": c.Int("batch-size"),
+	}
+
+	for total := 0; !progress.Done; total += progress.Deleted {
+
+		if err := post(c, "accounts/"+key+"/removal", &body, &progress); err != nil {
+			return cli.NewExitError("Server error: "+err.Error(), 1)
+		} else if !progress.Done {
+			fmt.Printf("Deleted %d entities\n", total+progress.Deleted)
+		}
+
+	}
+
+	fmt.Println("Removed account")
+
+	return nil
+
+}
+
 func GetAccount(c *cli.Context) error {
 
 	if c.NArg() != 1 {
@@ -68,6 +131,83 @@ func GetAccount(c *cli.Context) error {
 	return nil
 }
 
+type accountListing struct {
+	Accounts []struct {
+		Email     string    `json:"email"`
+		Roles     []string  `json:"roles"`
+		Verified  bool      `json:"verified"`
+		CreatedAt time.Time `json:"createdAt"`
+	} `json:"accounts"`
+	Next string `json:"next"`
+}
+
+func ListAccounts(c *cli.Context) error {
+
+	if c.NArg() != 0 {
+		return cli.NewExitError("Too many arguments specified", 1)
+	}
+
+	params := url.Values{}
+	if role := c.String("role"); role != "" {
+		// quote it so roles like "true" or "1" aren't taken for other types
+		params.Set("Roles", `"`+role+`"`)
+	}
+	if after := c.String("created-after"); after != "" {
+		params.Set("CreatedAt_ge", after)
+	}
+	if before := c.String("created-before"); before != "" {
+		params.Set("CreatedAt_lt", before)
+	}
+	if limit := c.Int("limit"); limit > 0 {
+		params.Set("_limit", strconv.Itoa(limit))
+	}
+	if start := c.String("start"); start != "" {
+		params.Set("_start", start)
+	}
+
+	path := "accounts"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	if c.Bool("json") {
+
+		accounts := json.RawMessage{}
+		formattedAccounts := bytes.NewBuffer(nil)
+
+		if err := get(c, path, &accounts); err != nil {
+			return cli.NewExitError("Server error: "+err.Error(), 1)
+		}
+
+		json.Indent(formattedAccounts, accounts, "", "  ")
+
+		fmt.Println(formattedAccounts)
+
+		return nil
+
+	}
+
+	var listing accountListing
+
+	if err := get(c, path, &listing); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tROLES\tVERIFIED\tCREATED")
+	for _, acct := range listing.Accounts {
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", acct.Email, strings.Join(acct.Roles, ","), acct.Verified, acct.CreatedAt.Format(time.RFC3339))
+	}
+	tw.Flush()
+
+	if listing.Next != "" {
+		fmt.Printf("\nMore accounts: pass --start %s\n", listing.Next)
+	}
+
+	return nil
+
+}
+
 func GetJwt(c *cli.Context) error {
 
 	if c.NArg() != 1 {
@@ -87,6 +227,89 @@ func GetJwt(c *cli.Context) error {
 
 }
 
+func RevokeAccountTokens(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := del(c, "accounts/"+key+"/tokens"); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
+
+func UnlockAccount(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := del(c, "accounts/"+key+"/lockout"); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
+
+func DisableAccountTOTP(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := del(c, "accounts/"+key+"/totp"); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
+
+func DisableAccount(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+	body := map[string]string{
+		"reason": c.String("reason"),
+	}
+
+	if err := post(c, "accounts/"+key+"/disable", &body, nil); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
+
+func EnableAccount(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := del(c, "accounts/"+key+"/disable"); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
+
 func ChangeAccountEmail(c *cli.Context) error {
 
 	if c.NArg() != 2 {
@@ -106,6 +329,38 @@ func ChangeAccountEmail(c *cli.Context) error {
 
 }
 
+func PatchAccount(c *cli.Context) error {
+
+	if c.NArg() != 2 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	var body interface{}
+	if err := json.Unmarshal([]byte(c.Args().Get(1)), &body); err != nil {
+		return cli.NewExitError("Invalid JSON: "+err.Error(), 1)
+	}
+
+	if c.Bool("profile") {
+		body = map[string]interface{}{"profile": body}
+	}
+
+	account := json.RawMessage{}
+	formattedAccount := bytes.NewBuffer(nil)
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := patch(c, "accounts/"+key, body, &account); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	json.Indent(formattedAccount, account, "", "  ")
+
+	fmt.Println(formattedAccount)
+
+	return nil
+
+}
+
 func ChangeAccountPassword(c *cli.Context) error {
 
 	if c.NArg() != 2 {
@@ -122,6 +377,29 @@ func ChangeAccountPassword(c *cli.Context) error {
 	return nil
 }
 
+func ShowAccountRoles(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	roles := json.RawMessage{}
+	formattedRoles := bytes.NewBuffer(nil)
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := get(c, "accounts/"+key+"/roles", &roles); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	json.Indent(formattedRoles, roles, "", "  ")
+
+	fmt.Println(formattedRoles)
+
+	return nil
+
+}
+
 type rolesRequest struct {
 	Roles []string `json:"roles"`
 }
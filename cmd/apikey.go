@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"net/url"
+	"strings"
+)
+
+func CreateAPIKey(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	var result struct {
+		Key string `json:"key"`
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+	requestBody := map[string]interface{}{
+		"Name":  c.String("name"),
+		"Roles": []string{},
+	}
+
+	if roles := c.String("roles"); roles != "" {
+		requestBody["Roles"] = strings.Split(roles, ",")
+	}
+
+	if err := post(c, "accounts/"+key+"/apikeys", requestBody, &result); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	// this is the only time the key is ever shown
+	fmt.Println(result.Key)
+
+	return nil
+
+}
+
+func ListAPIKeys(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	apiKeys := json.RawMessage{}
+	formattedAPIKeys := bytes.NewBuffer(nil)
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := get(c, "accounts/"+key+"/apikeys", &apiKeys); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	json.Indent(formattedAPIKeys, apiKeys, "", "  ")
+
+	fmt.Println(formattedAPIKeys)
+
+	return nil
+
+}
+
+func RevokeAPIKey(c *cli.Context) error {
+
+	if c.NArg() != 2 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := del(c, "accounts/"+key+"/apikeys/"+url.PathEscape(c.Args().Get(1))); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
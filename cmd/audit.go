@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type auditListing struct {
+	Records []struct {
+		Actor   string `json:"actor"`
+		Action  string `json:"action"`
+		Target  string `json:"target"`
+		Changes []struct {
+			Field string `json:"field"`
+		} `json:"changes"`
+		At time.Time `json:"at"`
+	} `json:"records"`
+	Next string `json:"next"`
+}
+
+func ListAudit(c *cli.Context) error {
+
+	if c.NArg() != 0 {
+		return cli.NewExitError("Too many arguments specified", 1)
+	}
+
+	params := url.Values{}
+	// quote them so values like "true" or "1" aren't taken for other types
+	if actor := c.String("actor"); actor != "" {
+		params.Set("Actor", `"`+actor+`"`)
+	}
+	if action := c.String("action"); action != "" {
+		params.Set("Action", `"`+action+`"`)
+	}
+	if target := c.String("target"); target != "" {
+		params.Set("Target", `"`+target+`"`)
+	}
+	if since := c.String("since"); since != "" {
+		params.Set("At_ge", since)
+	}
+	if limit := c.Int("limit"); limit > 0 {
+		params.Set("_limit", strconv.Itoa(limit))
+	}
+	if start := c.String("start"); start != "" {
+		params.Set("_start", start)
+	}
+
+	path := "audit"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	if c.Bool("json") {
+
+		records := json.RawMessage{}
+		formattedRecords := bytes.NewBuffer(nil)
+
+		if err := get(c, path, &records); err != nil {
+			return cli.NewExitError("Server error: "+err.Error(), 1)
+		}
+
+		json.Indent(formattedRecords, records, "", "  ")
+
+		fmt.Println(formattedRecords)
+
+		return nil
+
+	}
+
+	var listing auditListing
+
+	if err := get(c, path, &listing); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "AT\tACTOR\tACTION\tTARGET\tCHANGED")
+	for _, record := range listing.Records {
+		fields := make([]string, len(record.Changes))
+		for i, change := range record.Changes {
+			fields[i] = change.Field
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", record.At.Format(time.RFC3339), record.Actor, record.Action, record.Target, strings.Join(fields, ","))
+	}
+	tw.Flush()
+
+	if listing.Next != "" {
+		fmt.Printf("\nMore records: pass --start %s\n", listing.Next)
+	}
+
+	return nil
+
+}
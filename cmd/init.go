@@ -36,8 +36,10 @@ func Initialize(c *cli.Context) error {
 	newAppSecret := base64.RawURLEncoding.EncodeToString(randomBytes)
 	conf := struct{ AuthSecret string }{newAppSecret}
 
+	// the server refuses to replace an existing secret, which would invalidate every JWT
+	// signed with it; rotate keys with `ori secret rotate` instead
 	if err := patch(c, "config", &conf, nil); err != nil {
-		return cli.NewExitError("Error from server: "+err.Error(), 1)
+		return cli.NewExitError("Error from server: "+err.Error()+" (has the app been initialized already?)", 1)
 	}
 
 	fmt.Println("Add this secret to your environment -- it won't be available again.")
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+)
+
+func printJSON(raw json.RawMessage) {
+	formatted := bytes.NewBuffer(nil)
+	json.Indent(formatted, raw, "", "  ")
+	fmt.Println(formatted)
+}
+
+func AddOrg(c *cli.Context) error {
+
+	if c.NArg() != 2 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	body := map[string]string{
+		"id":   c.Args().Get(0),
+		"name": c.Args().Get(1),
+	}
+	org := json.RawMessage{}
+
+	if err := post(c, "orgs", &body, &org); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(org)
+
+	return nil
+
+}
+
+func ListOrgs(c *cli.Context) error {
+
+	if c.NArg() != 0 {
+		return cli.NewExitError("Too many arguments specified", 1)
+	}
+
+	orgs := json.RawMessage{}
+
+	if err := get(c, "orgs", &orgs); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(orgs)
+
+	return nil
+
+}
+
+func GetOrg(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	org := json.RawMessage{}
+
+	if err := get(c, "orgs/"+c.Args().Get(0), &org); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(org)
+
+	return nil
+
+}
+
+func RemoveOrg(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	if err := del(c, "orgs/"+c.Args().Get(0)); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
+
+func ListOrgMembers(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	members := json.RawMessage{}
+
+	if err := get(c, "orgs/"+c.Args().Get(0)+"/members", &members); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(members)
+
+	return nil
+
+}
+
+func SetOrgMember(c *cli.Context) error {
+
+	if c.NArg() < 2 {
+		return cli.NewExitError("Must supply an organization and an account", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(1)))
+	body := map[string][]string{
+		"roles": c.Args()[2:],
+	}
+	membership := json.RawMessage{}
+
+	if err := put(c, "orgs/"+c.Args().Get(0)+"/members/"+key, &body, &membership); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(membership)
+
+	return nil
+
+}
+
+func RemoveOrgMember(c *cli.Context) error {
+
+	if c.NArg() != 2 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(1)))
+
+	if err := del(c, "orgs/"+c.Args().Get(0)+"/members/"+key); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
@@ -21,6 +21,10 @@ func patch(c *cli.Context, path string, src, dst interface{}) error {
 	return do(c, "PATCH", path, src, dst)
 }
 
+func put(c *cli.Context, path string, src, dst interface{}) error {
+	return do(c, "PUT", path, src, dst)
+}
+
 func del(c *cli.Context, path string) error {
 	return do(c, "DELETE", path, nil, nil)
 }
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+)
+
+func RotateSecret(c *cli.Context) error {
+
+	if c.NArg() != 0 {
+		return cli.NewExitError("Too many arguments specified", 1)
+	}
+
+	requestBody := map[string]string{
+		"GracePeriod": c.String("grace"),
+	}
+	ring := json.RawMessage{}
+
+	if err := post(c, "keys", &requestBody, &ring); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	formattedRing := bytes.NewBuffer(nil)
+	json.Indent(formattedRing, ring, "", "  ")
+
+	fmt.Println(formattedRing)
+
+	return nil
+
+}
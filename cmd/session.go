@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/urfave/cli"
+	"net/url"
+)
+
+func ListSessions(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	sessions := json.RawMessage{}
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := get(c, "accounts/"+key+"/sessions", &sessions); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	printJSON(sessions)
+
+	return nil
+
+}
+
+func RevokeSession(c *cli.Context) error {
+
+	if c.NArg() != 2 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	key := base64.RawURLEncoding.EncodeToString([]byte(c.Args().Get(0)))
+
+	if err := del(c, "accounts/"+key+"/sessions/"+url.PathEscape(c.Args().Get(1))); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
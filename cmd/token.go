@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+	"net/url"
+)
+
+func RevokeToken(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return cli.NewExitError("Too many or not enough arguments specified", 1)
+	}
+
+	if err := del(c, "tokens/"+url.PathEscape(c.Args().Get(0))); err != nil {
+		return cli.NewExitError("Server error: "+err.Error(), 1)
+	}
+
+	return nil
+
+}
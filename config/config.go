@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"github.com/qedus/nds"
+	"github.com/the-information/ori/audit"
 	"github.com/the-information/ori/errors"
 	"github.com/the-information/ori/internal"
 	"golang.org/x/net/context"
@@ -13,16 +14,110 @@ import (
 var ErrNotInConfigContext = errors.New(http.StatusInternalServerError, "That context was not run through the ori/config middleware")
 var ErrConflict = errors.New(http.StatusConflict, "There was a conflict between versions of the object being saved")
 
+var xgTransaction = &datastore.TransactionOptions{
+	XG: true,
+}
+
+// auditRedacted lists the settings whose values are kept out of the audit log.
+var auditRedacted = []string{"AuthSecret", "AuthKeys", "SigningKey"}
+
 // Entity is the string name for the Entity used to store the configuration
 // in the App Engine Datastore. Think of it like a table name.
 const Entity = "Config"
 
 // Global describes some configuration parameters that are required for the API to function.
 type Global struct {
-	// AuthSecret is the secret key by which all JWTs are signed using a SHA-256 HMAC.
+	// AuthSecret is the secret that identifies the Super account. JWTs are signed with
+	// it using a SHA-256 HMAC unless AuthKeys or SigningKey is set.
 	AuthSecret string `json:",omitempty"`
+	// AuthKeys is the JSON-encoded auth.KeyRing of secrets JWTs are signed with. The first
+	// rotation retires AuthSecret like any other key, so JWTs signed with it stop verifying
+	// after the grace period. Use `ori secret rotate` to change it.
+	AuthKeys string `json:",omitempty"`
+	// SigningKey is a PEM-encoded RSA or P-256 ECDSA private key. If it is set, JWTs are
+	// signed with it using RS256 or ES256 rather than with AuthSecret, and its public half
+	// is published by auth.JWKSHandler.
+	SigningKey string `json:",omitempty"`
 	// ValidOriginSuffix is the suffix for which CORS requests are valid for this app.
 	ValidOriginSuffix string `json:",omitempty"`
+	// TokenLifetime is how long a JWT issued by auth.Issue remains valid, written
+	// in a form time.ParseDuration understands (e.g., "24h").
+	TokenLifetime string `json:",omitempty"`
+	// DefaultScope is the comma-separated scope of a JWT issued by auth.Issue.
+	// If it is empty, the token is valid for all of the account's roles.
+	DefaultScope string `json:",omitempty"`
+	// TokenClaims is a JSON object whose members are added as private claims
+	// to every JWT issued by auth.Issue.
+	TokenClaims string `json:",omitempty"`
+	// TokenIssuer is the iss claim of every JWT issued by auth.Issue. If it is set,
+	// auth.Middleware rejects JWTs that were issued by anyone else.
+	TokenIssuer string `json:",omitempty"`
+	// TokenAudience is the aud claim of every JWT issued by auth.Issue. If it is set,
+	// auth.Middleware rejects JWTs that are intended for anyone else.
+	TokenAudience string `json:",omitempty"`
+	// ClockSkew is how far the clocks of the servers issuing and checking JWTs may
+	// disagree when the exp, nbf and iat claims are checked, written in a form
+	// time.ParseDuration understands (e.g., "30s"). It defaults to no leeway at all.
+	ClockSkew string `json:",omitempty"`
+	// RoleGraph is a JSON object mapping each role to the roles it implies, such as
+	// {"admin":["editor"],"editor":["viewer"]}. Account.HasRole and auth.HasRole
+	// resolve it transitively.
+	RoleGraph string `json:",omitempty"`
+	// PasswordResetURL is the page of the app where people choose a new password. Password
+	// reset emails link to it with the reset token in the token query parameter.
+	PasswordResetURL string `json:",omitempty"`
+	// PasswordResetLifetime is how long a password reset token remains valid, written
+	// in a form time.ParseDuration understands (e.g., "1h").
+	PasswordResetLifetime string `json:",omitempty"`
+	// EmailVerificationURL is the page of the app that confirms email addresses. Verification
+	// emails link to it with the verification token in the token query parameter.
+	EmailVerificationURL string `json:",omitempty"`
+	// EmailVerificationLifetime is how long an email verification token remains valid,
+	// written in a form time.ParseDuration understands (e.g., "24h").
+	EmailVerificationLifetime string `json:",omitempty"`
+	// LoginLockoutThreshold is the number of failed login attempts in a row after which
+	// auth.CheckLogin locks an account out, written as a decimal integer (e.g., "5").
+	LoginLockoutThreshold string `json:",omitempty"`
+	// LoginLockoutDuration is how long an account's first lockout lasts, written in a form
+	// time.ParseDuration understands (e.g., "1m"). Each lockout after it lasts twice as long
+	// as the one before, until a successful login.
+	LoginLockoutDuration string `json:",omitempty"`
+	// LoginLockoutMaxDuration is the longest a lockout can last, written in a form
+	// time.ParseDuration understands (e.g., "24h").
+	LoginLockoutMaxDuration string `json:",omitempty"`
+	// PasswordMinLength is the fewest characters a password may have, written as a decimal
+	// integer (e.g., "10"). It defaults to 6.
+	PasswordMinLength string `json:",omitempty"`
+	// PasswordMaxLength is the most bytes a password may have, written as a decimal integer.
+	// It defaults to, and may not exceed, the 72 bytes bcrypt can hash.
+	PasswordMaxLength string `json:",omitempty"`
+	// PasswordRequiredClasses is a comma-separated list of the classes of character every
+	// password must contain: any of "lower", "upper", "digit" and "symbol".
+	PasswordRequiredClasses string `json:",omitempty"`
+	// PasswordBlocklistFile is the path of a file deployed with the app listing passwords
+	// that may not be used, one per line. Matching ignores case.
+	PasswordBlocklistFile string `json:",omitempty"`
+	// PasswordHashScheme is how new passwords are hashed: "bcrypt", the default, or "argon2id".
+	// Passwords hashed some other way are rehashed the next time they are checked successfully.
+	PasswordHashScheme string `json:",omitempty"`
+	// PasswordBcryptCost is the bcrypt cost, written as a decimal integer. It defaults to 10.
+	PasswordBcryptCost string `json:",omitempty"`
+	// PasswordArgon2Time is the number of passes argon2id makes, written as a decimal integer.
+	// It defaults to 1.
+	PasswordArgon2Time string `json:",omitempty"`
+	// PasswordArgon2Memory is the memory argon2id uses in KiB, written as a decimal integer.
+	// It defaults to 65536 (64 MiB).
+	PasswordArgon2Memory string `json:",omitempty"`
+	// PasswordArgon2Threads is the parallelism of argon2id, written as a decimal integer.
+	// It defaults to 4.
+	PasswordArgon2Threads string `json:",omitempty"`
+	// TOTPIssuer names the app in authenticator apps when accounts set up two-factor
+	// authentication. It defaults to TokenIssuer, or else the app's host name.
+	TOTPIssuer string `json:",omitempty"`
+	// OIDCProviders is a JSON object mapping provider names to the settings of the
+	// OpenID Connect identity providers auth.OIDCLoginHandler accepts ID tokens from.
+	// See auth.OIDCProvider.
+	OIDCProviders string `json:",omitempty"`
 }
 
 // Config is a type that can represent the full state of the application at any time.
@@ -46,9 +141,12 @@ func (conf *Config) UnmarshalJSON(data []byte) error {
 	for k, v := range result {
 
 		if v != nil {
+			// config is never queried, and long values such as PEM keys
+			// can't be stored in indexed properties
 			*conf = append(*conf, datastore.Property{
-				Name:  k,
-				Value: v,
+				Name:    k,
+				Value:   v,
+				NoIndex: true,
 			})
 		}
 
@@ -114,15 +212,43 @@ func Get(ctx context.Context, conf interface{}) error {
 //
 // As a special case, calling Save with a *config.Config will replace
 // the entire contents of the configuration with the contents of Config.
+//
+// Every change is recorded in the audit log, with the values of AuthSecret,
+// AuthKeys and SigningKey redacted.
 func Save(ctx context.Context, conf interface{}) error {
 
 	if typedConfig, ok := conf.(*Config); ok {
-		pl := datastore.PropertyList(*typedConfig)
-		replaceKey := datastore.NewKey(ctx, Entity, Entity, 0, nil)
-		_, replaceErr := nds.Put(ctx, replaceKey, &pl)
-		return replaceErr
+		return datastore.RunInTransaction(ctx, func(txCtx context.Context) error {
+
+			before := datastore.PropertyList{}
+			pl := datastore.PropertyList(*typedConfig)
+			replaceKey := datastore.NewKey(txCtx, Entity, Entity, 0, nil)
+			if err := nds.Get(txCtx, replaceKey, &before); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			} else if _, err := nds.Put(txCtx, replaceKey, &pl); err != nil {
+				return err
+			} else {
+				return audit.Write(txCtx, audit.ConfigSave, Entity, audit.Diff(before, pl, auditRedacted...))
+			}
+
+		}, xgTransaction)
 	}
 
+	return save(ctx, conf, nil)
+
+}
+
+// Update reads the stored application configuration into conf, calls modify to change
+// it, and then saves conf as Save does, all in one transaction, so that concurrent
+// changes to the same settings can't be lost. If modify returns an error, nothing is saved.
+func Update(ctx context.Context, conf interface{}, modify func() error) error {
+	return save(ctx, conf, modify)
+}
+
+// save merges conf into the stored configuration, first loading the stored configuration
+// into conf and calling modify if it isn't nil.
+func save(ctx context.Context, conf interface{}, modify func() error) error {
+
 	return datastore.RunInTransaction(ctx, func(txCtx context.Context) error {
 
 		props := datastore.PropertyList{}
@@ -131,6 +257,18 @@ func Save(ctx context.Context, conf interface{}) error {
 		if err := nds.Get(txCtx, key, &props); err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
+		before := append(datastore.PropertyList{}, props...)
+
+		if modify != nil {
+			if err := datastore.LoadStruct(conf, props); err != nil {
+				if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+					return err
+				}
+			}
+			if err := modify(); err != nil {
+				return err
+			}
+		}
 
 		// merge existing config with the new values
 		if newProps, err := datastore.SaveStruct(conf); err != nil {
@@ -140,12 +278,12 @@ func Save(ctx context.Context, conf interface{}) error {
 			for _, newProp := range newProps {
 				newProp.NoIndex = true
 				replacing := false
-				for _, prop := range props {
+				for i := range props {
 					// make sure NoIndex is set
-					prop.NoIndex = true
-					if prop.Name == newProp.Name {
+					props[i].NoIndex = true
+					if props[i].Name == newProp.Name {
 						replacing = true
-						prop.Value = newProp.Value
+						props[i].Value = newProp.Value
 						break
 					}
 				}
@@ -158,9 +296,11 @@ func Save(ctx context.Context, conf interface{}) error {
 
 		}
 
-		_, err := nds.Put(txCtx, key, &props)
-		return err
+		if _, err := nds.Put(txCtx, key, &props); err != nil {
+			return err
+		}
+		return audit.Write(txCtx, audit.ConfigSave, Entity, audit.Diff(before, props, auditRedacted...))
 
-	}, nil)
+	}, xgTransaction)
 
 }
@@ -8,4 +8,6 @@ var (
 	ClaimSetContextKey  key = 2
 	ParamContextKey     key = 3
 	AuthCheckContextKey key = 4
+	ClaimsContextKey    key = 5
+	ClientContextKey    key = 6
 )
@@ -0,0 +1,4 @@
+// Package mail provides a Mailer interface for sending email from an API, along
+// with implementations that send through App Engine, write to the application log,
+// or write to files on disk for development and tests.
+package mail
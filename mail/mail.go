@@ -0,0 +1,72 @@
+package mail
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	aemail "google.golang.org/appengine/mail"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// Message is an email message.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// A Mailer sends email.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// AppEngine is a Mailer that sends email through the App Engine Mail API.
+type AppEngine struct {
+	// Sender is the From address. It must be one App Engine allows the app to send as.
+	Sender string
+}
+
+// Send sends msg.
+func (m *AppEngine) Send(ctx context.Context, msg *Message) error {
+
+	return aemail.Send(ctx, &aemail.Message{
+		Sender:  m.Sender,
+		To:      []string{msg.To},
+		Subject: msg.Subject,
+		Body:    msg.Body,
+	})
+
+}
+
+// Log is a Mailer that writes email to the application log instead of sending it,
+// which is handy during development.
+type Log struct{}
+
+// Send logs msg.
+func (m *Log) Send(ctx context.Context, msg *Message) error {
+	log.Infof(ctx, "To: %s\nSubject: %s\n\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// File is a Mailer that writes each email to a file of its own in Dir instead of
+// sending it, so tests can read back what would have been sent.
+type File struct {
+	Dir string
+}
+
+var fileCount int64
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9@._-]`)
+
+// Send writes msg to a new file in m.Dir.
+func (m *File) Send(ctx context.Context, msg *Message) error {
+
+	name := fmt.Sprintf("%d-%d-%s.eml", time.Now().UnixNano(), atomic.AddInt64(&fileCount, 1), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	contents := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", msg.To, msg.Subject, msg.Body)
+
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), []byte(contents), 0644)
+
+}
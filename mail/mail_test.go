@@ -0,0 +1,35 @@
+package mail
+
+import (
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ori-mail")
+	if err != nil {
+		t.Fatalf("Unexpected error %s creating temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &File{Dir: dir}
+	if err := m.Send(context.Background(), &Message{To: "foo@bar.com", Subject: "Hi", Body: "Hello there"}); err != nil {
+		t.Fatalf("Unexpected error %s from Send", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*foo@bar.com.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message on disk, but got %v", files)
+	}
+
+	data, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(data), "Subject: Hi") || !strings.HasSuffix(string(data), "Hello there") {
+		t.Errorf("Unexpected message contents %q", data)
+	}
+
+}
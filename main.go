@@ -77,6 +77,158 @@ func init() {
 				},
 			},
 		},
+		{
+			Name:  "secret",
+			Usage: "Manage the keys an application signs its JWTs with",
+			Subcommands: []cli.Command{
+				{
+					Name:   "rotate",
+					Usage:  "Add a new signing key, make it active, and retire the old one after a grace period",
+					Action: cmd.RotateSecret,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "grace",
+							Value: "720h",
+							Usage: "How long JWTs signed with the old key remain valid",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "token",
+			Usage: "Manage JWTs issued by the application",
+			Subcommands: []cli.Command{
+				{
+					Name:      "revoke",
+					Usage:     "Revoke a JWT by its ID",
+					ArgsUsage: "jti",
+					Action:    cmd.RevokeToken,
+				},
+			},
+		},
+		{
+			Name:  "apikey",
+			Usage: "Manage API keys for machine clients",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create",
+					Usage:     "Create an API key for account and print it",
+					ArgsUsage: "email",
+					Action:    cmd.CreateAPIKey,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "Label the key with `NAME`",
+						},
+						cli.StringFlag{
+							Name:  "roles",
+							Usage: "Restrict the key to comma-separated `ROLES_LIST`",
+						},
+					},
+				},
+				{
+					Name:      "list",
+					Usage:     "List the API keys for account",
+					ArgsUsage: "email",
+					Action:    cmd.ListAPIKeys,
+				},
+				{
+					Name:      "revoke",
+					Usage:     "Revoke an API key of account by its ID",
+					ArgsUsage: "email id",
+					Action:    cmd.RevokeAPIKey,
+				},
+			},
+		},
+		{
+			Name:  "org",
+			Usage: "Manage organizations and the roles their members have in them",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add an organization",
+					ArgsUsage: "id name",
+					Action:    cmd.AddOrg,
+				},
+				{
+					Name:   "list",
+					Usage:  "List organizations",
+					Action: cmd.ListOrgs,
+				},
+				{
+					Name:      "get",
+					Usage:     "Show organization",
+					ArgsUsage: "id",
+					Action:    cmd.GetOrg,
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove organization and all its memberships",
+					ArgsUsage: "id",
+					Action:    cmd.RemoveOrg,
+				},
+				{
+					Name:  "member",
+					Usage: "Manage the members of an organization",
+					Subcommands: []cli.Command{
+						{
+							Name:      "list",
+							Usage:     "List the members of organization and their roles",
+							ArgsUsage: "id",
+							Action:    cmd.ListOrgMembers,
+						},
+						{
+							Name:      "set",
+							Usage:     "Make account a member of organization with roles, replacing any it had there",
+							ArgsUsage: "id email [role...]",
+							Action:    cmd.SetOrgMember,
+						},
+						{
+							Name:      "remove",
+							Usage:     "Remove account from organization",
+							ArgsUsage: "id email",
+							Action:    cmd.RemoveOrgMember,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:   "audit",
+			Usage:  "List changes made to accounts and config, newest first, a page at a time",
+			Action: cmd.ListAudit,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "actor",
+					Usage: "Only list changes made by the account with email `EMAIL`",
+				},
+				cli.StringFlag{
+					Name:  "action",
+					Usage: "Only list changes of kind `ACTION`, such as account.save",
+				},
+				cli.StringFlag{
+					Name:  "target",
+					Usage: "Only list changes made to `TARGET`, such as an account's email or Config",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only list changes made at or after RFC 3339 time `TIME`",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Usage: "List at most `N` changes (at most 1000, default 100)",
+				},
+				cli.StringFlag{
+					Name:  "start",
+					Usage: "Start listing from `CURSOR`, as printed after the previous page",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the changes as JSON instead of a table",
+				},
+			},
+		},
 		{
 			Name:  "account",
 			Usage: "Modify accounts associated with the application",
@@ -93,11 +245,64 @@ func init() {
 						},
 					},
 				},
+				{
+					Name:   "list",
+					Usage:  "List accounts as a table, a page at a time",
+					Action: cmd.ListAccounts,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "role",
+							Usage: "Only list accounts with role `ROLE`",
+						},
+						cli.StringFlag{
+							Name:  "created-after",
+							Usage: "Only list accounts created at or after RFC 3339 time `TIME`",
+						},
+						cli.StringFlag{
+							Name:  "created-before",
+							Usage: "Only list accounts created before RFC 3339 time `TIME`",
+						},
+						cli.IntFlag{
+							Name:  "limit",
+							Usage: "List at most `N` accounts (at most 1000, default 100)",
+						},
+						cli.StringFlag{
+							Name:  "start",
+							Usage: "Start listing from `CURSOR`, as printed after the previous page",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the accounts as JSON instead of a table",
+						},
+					},
+				},
+				{
+					Name:      "patch",
+					Usage:     "Merge a JSON object into account and show the result",
+					ArgsUsage: "email json",
+					Action:    cmd.PatchAccount,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "profile",
+							Usage: "Merge the JSON object into the account's profile rather than the account itself",
+						},
+					},
+				},
 				{
 					Name:      "remove",
 					Usage:     "Remove account",
 					ArgsUsage: "email",
 					Action:    cmd.RemoveAccount,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "batched",
+							Usage: "Mark account deleted, then delete what it owns a batch at a time; rerun to resume",
+						},
+						cli.IntFlag{
+							Name:  "batch-size",
+							Usage: "With --batched, delete at most `N` entities per request (at most 500, default 500)",
+						},
+					},
 				},
 				{
 					Name:      "get",
@@ -105,17 +310,95 @@ func init() {
 					ArgsUsage: "email",
 					Action:    cmd.GetAccount,
 				},
+				{
+					Name:      "export",
+					Usage:     "Print account and everything stored under it as JSON that ori load can read back in",
+					ArgsUsage: "email",
+					Action:    cmd.ExportAccount,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "secrets",
+							Usage: "Include password hashes, TOTP secrets and API key hashes, for a full backup; keep the output safe",
+						},
+					},
+				},
 				{
 					Name:      "jwt",
 					Usage:     "Get auth jwt for account",
 					ArgsUsage: "email",
 					Action:    cmd.GetJwt,
 				},
+				{
+					Name:      "revoke-all",
+					Usage:     "Revoke every JWT issued to account so far",
+					ArgsUsage: "email",
+					Action:    cmd.RevokeAccountTokens,
+				},
+				{
+					Name:      "unlock",
+					Usage:     "Lift the lockout on account after too many failed logins",
+					ArgsUsage: "email",
+					Action:    cmd.UnlockAccount,
+				},
+				{
+					Name:      "disable",
+					Usage:     "Disable account, so it can't log in and its tokens and API keys stop working",
+					ArgsUsage: "email",
+					Action:    cmd.DisableAccount,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "reason",
+							Usage: "Why the account is being disabled",
+						},
+					},
+				},
+				{
+					Name:      "enable",
+					Usage:     "Re-enable a disabled account",
+					ArgsUsage: "email",
+					Action:    cmd.EnableAccount,
+				},
+				{
+					Name:  "sessions",
+					Usage: "Manage the sessions started by logging in to account",
+					Subcommands: []cli.Command{
+						{
+							Name:      "list",
+							Usage:     "List account's unexpired sessions, most recent first",
+							ArgsUsage: "email",
+							Action:    cmd.ListSessions,
+						},
+						{
+							Name:      "revoke",
+							Usage:     "Revoke one of account's sessions, so its tokens stop working",
+							ArgsUsage: "email session_id",
+							Action:    cmd.RevokeSession,
+						},
+					},
+				},
+				{
+					Name:  "totp",
+					Usage: "Manage two-factor authentication for account",
+					Subcommands: []cli.Command{
+						{
+							Name:      "disable",
+							Usage:     "Turn off two-factor authentication for account, forgetting its secret and recovery codes",
+							ArgsUsage: "email",
+							Action:    cmd.DisableAccountTOTP,
+						},
+					},
+				},
 
 				{
 					Name:  "roles",
 					Usage: "Actions related to user roles",
 					Subcommands: []cli.Command{
+						{
+							Name:      "show",
+							Usage:     "Show the roles account has, directly and by implication",
+							ArgsUsage: "email",
+							Action:    cmd.ShowAccountRoles,
+						},
 						{
 							Name:      "add",
 							Usage:     "Add roles to account",
@@ -8,10 +8,16 @@ import (
 	"google.golang.org/appengine/datastore"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
-var ErrDatastoreLimitTooLarge = errors.New("The limit specified by this query was greater than 1000")
+var (
+	ErrDatastoreLimitTooLarge = errors.New("The limit specified by this query was greater than 1000")
+	ErrDatastoreLimitTooSmall = errors.New("The limit specified by this query was less than 1")
+	ErrDatastoreBadField      = errors.New("A filter in this query did not name a valid field")
+)
 
 /*
 DatastoreWithValues produces a *datastore.Query given a set of URL query parameters.
@@ -32,14 +38,15 @@ The following four query keys are treated specially:
 	"_order" will be used to set the ordering of the query results.
 	"_start" and "_end", if supplied, are interpreted as encoded datastore.Cursor objects.
 	If they are not valid encoded cursors, DatastoreWithValues will fail.
-	"_limit" is interpreted as an integer to be used with q.Limit(). If its value is greater than 1000 or it cannot
-	be converted to an integer, DatastoreWithValues will fail.
+	"_limit" is interpreted as an integer to be used with q.Limit(). If its value is greater than 1000, less than 1
+	or it cannot be converted to an integer, DatastoreWithValues will fail.
 
 All other query parameters are interpreted as filters according to the following algorithm:
 
 The query key's last three characters are checked. If they are one of the following four values,
 the last three characters are stripped from the key and the given operator is used. Otherwise,
-strict equality is assumed.
+strict equality is assumed. The field name that's left must be made up of letters, digits,
+underscores and dots, or DatastoreWithValues will fail.
 
 	- "_gt": ">"
 	- "_lt": "<"
@@ -88,11 +95,17 @@ func DatastoreWithValues(kind string, params url.Values) (*datastore.Query, erro
 				return nil, err
 			} else if count > 1000 {
 				return nil, ErrDatastoreLimitTooLarge
+			} else if count < 1 {
+				return nil, ErrDatastoreLimitTooSmall
 			} else {
 				q = q.Limit(count)
 			}
 		default:
-			q = q.Filter(getFilterStr(k, &buf), getFilterValue(v))
+			filter := getFilterStr(k, &buf)
+			if !validFieldName(filter[:strings.LastIndex(filter, " ")]) {
+				return nil, ErrDatastoreBadField
+			}
+			q = q.Filter(filter, getFilterValue(v))
 		}
 	}
 
@@ -102,8 +115,11 @@ func DatastoreWithValues(kind string, params url.Values) (*datastore.Query, erro
 
 func getFilterStr(k string, buf *bytes.Buffer) string {
 
-	fieldName := k[:len(k)-3]
-	operator := k[len(k)-3:]
+	var fieldName, operator string
+	if len(k) >= 3 {
+		fieldName = k[:len(k)-3]
+		operator = k[len(k)-3:]
+	}
 
 	buf.Reset()
 
@@ -132,6 +148,24 @@ func getFilterStr(k string, buf *bytes.Buffer) string {
 
 }
 
+// validFieldName checks that name could be the name of a datastore property, so that
+// it can't smuggle an operator of its own into a filter.
+func validFieldName(name string) bool {
+
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c != '_' && c != '.' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
 func getFilterValue(v string) interface{} {
 
 	var lat, lng float64
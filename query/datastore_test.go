@@ -65,6 +65,31 @@ func TestDatastoreWithValues(t *testing.T) {
 	// TODO(goldibex): test _start and _end
 }
 
+func TestDatastoreWithValuesErrors(t *testing.T) {
+
+	cases := []struct {
+		query string
+		err   error
+	}{
+		{"a=1", nil},
+		{"_limit=1000", nil},
+		{"_limit=0", ErrDatastoreLimitTooSmall},
+		{"_limit=-1", ErrDatastoreLimitTooSmall},
+		{"_gt=1", ErrDatastoreBadField},
+		{"=1", ErrDatastoreBadField},
+		{"Email%20%3E=1", ErrDatastoreBadField},
+		{"Email%20%3E_ge=1", ErrDatastoreBadField},
+	}
+
+	for _, c := range cases {
+		params, _ := url.ParseQuery(c.query)
+		if _, err := DatastoreWithValues("Widget", params); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.query, c.err, err)
+		}
+	}
+
+}
+
 func Test_getFilterStr(t *testing.T) {
 
 	var buf bytes.Buffer
@@ -83,6 +108,9 @@ func Test_getFilterStr(t *testing.T) {
 	if r := getFilterStr("foobar", &buf); r != "foobar =" {
 		t.Errorf("Expected foobar =, got %s", r)
 	}
+	if r := getFilterStr("a", &buf); r != "a =" {
+		t.Errorf("Expected a =, got %s", r)
+	}
 
 }
 
@@ -15,6 +15,12 @@ func ReadJSON(r *http.Request, dst interface{}) error {
 
 }
 
+// codedError is an error that knows its HTTP status code.
+type codedError interface {
+	error
+	Code() int
+}
+
 // WriteJSON writes the JSON encoding
 // of src to the response body. It also sets the response's status code appropriately.
 //
@@ -22,7 +28,8 @@ func ReadJSON(r *http.Request, dst interface{}) error {
 // objects as JSON objects with a single field "message" holding
 // the error text.
 //
-// Error objects will get status codes based on their Code field.
+// Error objects will get status codes based on their Code field, as will
+// other errors with a Code method, which are serialized as they are.
 //
 // All other objects implementing the error interface will get
 // status code 500.
@@ -38,6 +45,11 @@ func WriteJSON(w http.ResponseWriter, src interface{}) error {
 			Code: t.Code(),
 			Body: t,
 		})
+	case codedError:
+		return writeResponse(w, &Response{
+			Code: t.Code(),
+			Body: t,
+		})
 	case error:
 		return writeResponse(w, &Response{
 			Code: http.StatusInternalServerError,
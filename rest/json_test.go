@@ -25,6 +25,19 @@ func TestReadJSON(t *testing.T) {
 
 }
 
+type teapotError struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+func (e *teapotError) Error() string {
+	return e.Message
+}
+
+func (e *teapotError) Code() int {
+	return http.StatusTeapot
+}
+
 func TestWriteJSON(t *testing.T) {
 
 	x := struct {
@@ -56,4 +69,12 @@ func TestWriteJSON(t *testing.T) {
 
 	}
 
+	w = httptest.NewRecorder()
+	WriteJSON(w, &teapotError{"Short and stout", "spout"})
+	if w.Code != http.StatusTeapot {
+		t.Errorf("Got unexpected response code, wanted 418, got %d", w.Code)
+	} else if strings.TrimSpace(w.Body.String()) != `{"message":"Short and stout","reason":"spout"}` {
+		t.Errorf("Got unexpected response %s", w.Body.String())
+	}
+
 }
@@ -25,6 +25,7 @@ type HandlerState struct {
 	config      interface{}
 	account     *account.Account
 	scope       string
+	claims      map[string]interface{}
 	routeParams map[string]string
 }
 
@@ -62,6 +63,14 @@ func (s *HandlerState) Config(c interface{}) *HandlerState {
 
 }
 
+// Claims sets private claims on the handler test's auth token, which handlers
+// can read back with auth.GetClaims. For example:
+//	s.Claims(map[string]interface{}{"u": 3})
+func (s *HandlerState) Claims(c map[string]interface{}) *HandlerState {
+	s.claims = c
+	return s
+}
+
 // Account sets the authenticated account for the handler test to a.
 func (s *HandlerState) Account(a *account.Account) *HandlerState {
 	s.account = a
@@ -117,19 +126,30 @@ func (s *HandlerState) Run(ctx context.Context, handler kami.HandlerFunc) *httpt
 	}
 
 	ctx = context.WithValue(ctx, internal.ConfigContextKey, &configPropList)
+
 	ctx = context.WithValue(ctx, internal.AuthContextKey, s.account)
-	if s.scope != "" {
-		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, &jws.ClaimSet{
-			Scope: s.scope,
-			Sub:   s.account.Email,
-			Exp:   time.Now().AddDate(0, 0, 1).Unix(),
-		})
+	claimSet := &jws.ClaimSet{
+		Scope:         s.scope,
+		Sub:           s.account.Email,
+		Exp:           time.Now().AddDate(0, 0, 1).Unix(),
+		PrivateClaims: s.claims,
+	}
+	if claimSet.Scope == "" {
+		claimSet.Scope = strings.Join(s.account.Roles, ",")
+	}
+	ctx = context.WithValue(ctx, internal.ClaimSetContextKey, claimSet)
+
+	claims := map[string]interface{}{}
+	for k, v := range s.claims {
+		claims[k] = v
+	}
+	claims["scope"] = claimSet.Scope
+	claims["sub"] = claimSet.Sub
+	claims["exp"] = claimSet.Exp
+	if payload, err := json.Marshal(claims); err != nil {
+		panic(err)
 	} else {
-		ctx = context.WithValue(ctx, internal.ClaimSetContextKey, &jws.ClaimSet{
-			Scope: strings.Join(s.account.Roles, ","),
-			Sub:   s.account.Email,
-			Exp:   time.Now().AddDate(0, 0, 1).Unix(),
-		})
+		ctx = context.WithValue(ctx, internal.ClaimsContextKey, payload)
 	}
 
 	ctx = context.WithValue(ctx, internal.ParamContextKey, s.routeParams)